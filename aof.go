@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+// appendfsync policies
+const (
+	fsyncAlways   = "always"
+	fsyncEverySec = "everysec"
+	fsyncNo       = "no"
+)
+
+// aofBatchSize caps the number of elements per command when the dataset
+// is written out as commands.
+const aofBatchSize = 64
+
+// AOF is the append-only file: every write command is appended to it in
+// RESP format and replayed on startup to rebuild the dataset.
+type AOF struct {
+	mu       sync.Mutex
+	filePath string
+	file     *os.File
+	fsync    string
+	size     int64
+	lastSync time.Time
+	syncing  bool
+	// baseSize is the size of the log after startup or the last rewrite,
+	// against which growth is measured for automatic rewrites.
+	baseSize int64
+	// While a rewrite runs, appended commands are also collected in
+	// rewriteBuf so they can be added to the rewritten log.
+	rewriting  bool
+	rewriteBuf []byte
+}
+
+// OpenAOF opens filePath for appending, creating it if needed.
+func OpenAOF(filePath, fsync string) (*AOF, error) {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open append-only file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat append-only file: %v", err)
+	}
+	return &AOF{
+		filePath: filePath,
+		file:     file,
+		fsync:    fsync,
+		size:     info.Size(),
+		baseSize: info.Size(),
+		lastSync: time.Now(),
+	}, nil
+}
+
+// Append writes a command to the log. Under the always policy the file is
+// fsynced before Append returns.
+func (a *AOF) Append(argv []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.write(redisprotocol.EncodeCommand(argv))
+}
+
+func (a *AOF) write(data []byte) error {
+	n, err := a.file.Write(data)
+	if err != nil {
+		// Drop a partially written record so the log stays loadable.
+		if n > 0 && a.file.Truncate(a.size) == nil {
+			n = 0
+		}
+		a.size += int64(n)
+		return fmt.Errorf("failed to write append-only file: %v", err)
+	}
+	a.size += int64(n)
+	if a.rewriting {
+		a.rewriteBuf = append(a.rewriteBuf, data...)
+	}
+	if a.fsync == fsyncAlways {
+		return a.file.Sync()
+	}
+	return nil
+}
+
+// Size returns the current size of the log in bytes.
+func (a *AOF) Size() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.size
+}
+
+// Sizes returns the current size of the log and its size after startup or
+// the last rewrite.
+func (a *AOF) Sizes() (size, baseSize int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.size, a.baseSize
+}
+
+// cron fsyncs the file once per second under the everysec policy. The
+// fsync runs in the background so writers are not held up by a slow disk.
+func (a *AOF) cron() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.fsync != fsyncEverySec || a.syncing || time.Since(a.lastSync) < time.Second {
+		return
+	}
+	a.syncing = true
+	a.lastSync = time.Now()
+	file := a.file
+	go func() {
+		// The file may have been replaced by a rewrite in the meantime.
+		if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			fmt.Println("Error syncing append-only file:", err)
+		}
+		a.mu.Lock()
+		a.syncing = false
+		a.mu.Unlock()
+	}()
+}
+
+// Close flushes the log to disk and closes it.
+func (a *AOF) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+	return a.file.Close()
+}
+
+// rewriteNeeded reports whether the log has grown by percentage since the
+// last rewrite and is at least minSize bytes. A zero percentage disables
+// automatic rewrites.
+func (a *AOF) rewriteNeeded(percentage int, minSize int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if percentage <= 0 || a.rewriting || a.size < minSize {
+		return false
+	}
+	base := a.baseSize
+	if base == 0 {
+		base = 1
+	}
+	return (a.size-base)*100/base >= int64(percentage)
+}
+
+// startRewrite begins collecting appended commands for the rewritten log.
+func (a *AOF) startRewrite() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rewriting = true
+	a.rewriteBuf = nil
+}
+
+// abortRewrite stops collecting commands after a failed rewrite.
+func (a *AOF) abortRewrite() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rewriting = false
+	a.rewriteBuf = nil
+}
+
+// finishRewrite appends the commands collected during the rewrite to the
+// rewritten log in file, then atomically replaces the current log with it.
+// Appends are blocked meanwhile so no command is lost or written twice.
+func (a *AOF) finishRewrite(file *os.File, tempPath string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	buf := a.rewriteBuf
+	a.rewriting = false
+	a.rewriteBuf = nil
+
+	fail := func(err error) error {
+		file.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if _, err := file.Write(buf); err != nil {
+		return fail(fmt.Errorf("failed to write rewritten append-only file: %v", err))
+	}
+	if err := file.Sync(); err != nil {
+		return fail(fmt.Errorf("failed to sync rewritten append-only file: %v", err))
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return fail(fmt.Errorf("failed to stat rewritten append-only file: %v", err))
+	}
+	if err := os.Rename(tempPath, a.filePath); err != nil {
+		return fail(fmt.Errorf("failed to rename rewritten append-only file: %v", err))
+	}
+	if err := syncDir(filepath.Dir(a.filePath)); err != nil {
+		fmt.Println("Error syncing append-only file directory:", err)
+	}
+	a.file.Close()
+	a.file = file
+	a.size = info.Size()
+	a.baseSize = info.Size()
+	a.lastSync = time.Now()
+	return nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// LoadAOF replays the commands stored in filePath and returns how many were
+// loaded. If the file ends in the middle of a command, or of a MULTI/EXEC
+// block, and allowTruncated is set, the incomplete tail is cut off the file
+// and loading succeeds with the commands before it.
+func LoadAOF(filePath string, allowTruncated bool, replay func(argv []string) error) (int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to open append-only file: %v", err)
+	}
+	defer file.Close()
+
+	counter := &countingReader{r: file}
+	resp := redisprotocol.NewResp(counter, nil)
+	var (
+		valid      int64 // offset just past the last complete command
+		multiStart int64
+		inMulti    bool
+		queued     [][]string
+		loaded     int
+	)
+	for {
+		value, err := resp.Read()
+		offset := counter.n - int64(resp.Buffered())
+		if err != nil {
+			if err == io.EOF && offset == valid && !inMulti {
+				return loaded, nil
+			}
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !(err == io.EOF && inMulti) {
+				return loaded, fmt.Errorf("bad file format reading the append-only file at offset %d: %v", valid, err)
+			}
+			cut := valid
+			if inMulti {
+				cut = multiStart
+			}
+			if !allowTruncated {
+				return loaded, fmt.Errorf("append-only file is truncated at offset %d, start with -aof-load-truncated to recover", cut)
+			}
+			fmt.Printf("Warning: append-only file ends with an incomplete command, truncating it to %d bytes\n", cut)
+			if err := os.Truncate(filePath, cut); err != nil {
+				return loaded, fmt.Errorf("failed to truncate append-only file: %v", err)
+			}
+			return loaded, nil
+		}
+
+		argv, err := commandArgs(value)
+		if err == nil && len(argv) == 0 {
+			err = errors.New("empty command")
+		}
+		if err != nil {
+			return loaded, fmt.Errorf("bad file format reading the append-only file at offset %d: %v", valid, err)
+		}
+		switch name := strings.ToUpper(argv[0]); {
+		case name == "MULTI":
+			inMulti, multiStart, queued = true, valid, nil
+		case name == "EXEC" && inMulti:
+			for _, queuedArgv := range queued {
+				if err := replay(queuedArgv); err != nil {
+					return loaded, err
+				}
+				loaded++
+			}
+			inMulti, queued = false, nil
+		case inMulti:
+			queued = append(queued, argv)
+		default:
+			if err := replay(argv); err != nil {
+				return loaded, err
+			}
+			loaded++
+		}
+		valid = offset
+	}
+}
+
+// WriteDataset appends commands recreating every key in kv, e.g. when the
+// log is created for a server that already holds data. The caller must hold
+// the store lock.
+func (a *AOF) WriteDataset(kv *KeyValueStore) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return writeDatasetCommands(kv, func(argv []string) error {
+		return a.write(redisprotocol.EncodeCommand(argv))
+	})
+}
+
+// writeDatasetCommands emits the shortest command sequence we know that
+// rebuilds every live key in kv, including its TTL.
+func writeDatasetCommands(kv *KeyValueStore, emit func(argv []string) error) error {
+	for key, obj := range kv.Keys {
+		if kv.isExpired(key) {
+			continue
+		}
+		if err := emitObjectCommands(key, obj, emit); err != nil {
+			return err
+		}
+		if when, ok := kv.Expirations[key]; ok {
+			if err := emit([]string{"PEXPIREAT", key, strconv.FormatInt(when.UnixMilli(), 10)}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func emitObjectCommands(key string, obj *Object, emit func(argv []string) error) error {
+	var cmd string
+	var items []string
+	switch obj.Type {
+	case TypeString:
+		return emit([]string{"SET", key, obj.Str})
+	case TypeList:
+		cmd, items = "RPUSH", obj.List.Slice()
+	case TypeHash:
+		cmd = "HSET"
+		for field, value := range obj.Hash {
+			items = append(items, field, value)
+		}
+	case TypeSet:
+		cmd = "SADD"
+		for member := range obj.Set {
+			items = append(items, member)
+		}
+	case TypeZSet:
+		cmd = "ZADD"
+		members := make([]string, 0, len(obj.ZSet))
+		for member := range obj.ZSet {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		for _, member := range members {
+			items = append(items, redisprotocol.FormatDouble(obj.ZSet[member]), member)
+		}
+	default:
+		return fmt.Errorf("unknown type %q for key %q", obj.Type, key)
+	}
+
+	// Pairs (field/value, score/member) must not be split across commands.
+	batch := aofBatchSize
+	if obj.Type == TypeHash || obj.Type == TypeZSet {
+		batch *= 2
+	}
+	for start := 0; start < len(items); start += batch {
+		end := start + batch
+		if end > len(items) {
+			end = len(items)
+		}
+		argv := append([]string{cmd, key}, items[start:end]...)
+		if err := emit(argv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startAOFRewrite begins rewriting the append-only file in the background
+// from a snapshot of the current dataset. The caller must hold the store lock, so
+// that the snapshot is taken and command buffering starts at the same point of
+// the write stream.
+func (s *Server) startAOFRewrite() error {
+	if !s.aofRewriting.CompareAndSwap(false, true) {
+		return errors.New("ERR Background append only file rewriting already in progress")
+	}
+	dataset := s.kvstore.snapshot()
+	if s.aof != nil {
+		s.aof.startRewrite()
+	}
+	go func() {
+		defer s.aofRewriting.Store(false)
+		defer s.kvstore.releaseSnapshot()
+		start := time.Now()
+		if err := s.rewriteAOF(dataset); err != nil {
+			if s.aof != nil {
+				s.aof.abortRewrite()
+			}
+			fmt.Println("Background append-only file rewrite failed:", err)
+			return
+		}
+		fmt.Printf("Background append-only file rewrite finished in %v\n", time.Since(start))
+	}()
+	return nil
+}
+
+// rewriteAOF writes the shortest log rebuilding dataset to a temporary file
+// next to the append-only file and swaps it in.
+func (s *Server) rewriteAOF(dataset *KeyValueStore) error {
+	tempPath := filepath.Join(filepath.Dir(config.AppendFilename), fmt.Sprintf("temp-rewriteaof-%d.aof", os.Getpid()))
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary append-only file: %v", err)
+	}
+	w := bufio.NewWriter(file)
+	err = writeDatasetCommands(dataset, func(argv []string) error {
+		_, err := w.Write(redisprotocol.EncodeCommand(argv))
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write temporary append-only file: %v", err)
+	}
+
+	if s.aof != nil {
+		return s.aof.finishRewrite(file, tempPath)
+	}
+	// With appendonly off there is no live log to carry over.
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to sync temporary append-only file: %v", err)
+	}
+	file.Close()
+	if err := os.Rename(tempPath, config.AppendFilename); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(config.AppendFilename))
+}
+
+// propagatedCommands returns the commands to log for an executed write.
+// Commands whose effect depends on the current time, or on float rounding,
+// are replaced with the state they left the key in, so that replaying the log
+// later rebuilds the same dataset. The caller must hold the store write lock.
+func (s *Server) propagatedCommands(argv []string) [][]string {
+	switch strings.ToUpper(argv[0]) {
+	case "EXPIRE", "PEXPIRE", "SETEX", "PSETEX":
+		return s.keyStateCommands(argv[1])
+	case "SET":
+		if hasRelativeExpire(argv[3:]) {
+			return s.keyStateCommands(argv[1])
+		}
+	case "GETEX":
+		if hasRelativeExpire(argv[2:]) {
+			return s.keyStateCommands(argv[1])
+		}
+	case "RESTORE", "RESTORE-ASKING":
+		return s.restoreCommands(argv[1])
+	case "HINCRBYFLOAT":
+		if hash := s.kvstore.lookup(argv[1]); hash != nil {
+			return [][]string{{"HSET", argv[1], argv[2], hash.Hash[argv[2]]}}
+		}
+	}
+	return [][]string{argv}
+}
+
+func hasRelativeExpire(options []string) bool {
+	for _, opt := range options {
+		if opt := strings.ToUpper(opt); opt == "EX" || opt == "PX" {
+			return true
+		}
+	}
+	return false
+}
+
+// keyStateCommands describes the current value of a string key, or the TTL
+// of a key of any other type, with absolute expiry times.
+func (s *Server) keyStateCommands(key string) [][]string {
+	obj := s.kvstore.lookup(key)
+	if obj == nil {
+		return [][]string{{"DEL", key}}
+	}
+	var cmds [][]string
+	if obj.Type == TypeString {
+		cmds = append(cmds, []string{"SET", key, obj.Str})
+	}
+	if when, ok := s.kvstore.Expirations[key]; ok {
+		cmds = append(cmds, []string{"PEXPIREAT", key, strconv.FormatInt(when.UnixMilli(), 10)})
+	} else if obj.Type != TypeString {
+		cmds = append(cmds, []string{"PERSIST", key})
+	}
+	return cmds
+}
+
+// propagateCommand writes a command to the append-only file and to the
+// replication stream. The caller must hold the store write lock.
+func (s *Server) propagateCommand(argv []string) {
+	if s.inExec && !s.execPropagated {
+		// Wrap the writes of a transaction so they are replayed atomically.
+		s.execPropagated = true
+		s.propagateCommand([]string{"MULTI"})
+	}
+	if s.aof != nil {
+		if err := s.aof.Append(argv); err != nil {
+			fmt.Println("Error:", err)
+		}
+	}
+	// Commands from our master reach our replicas verbatim instead.
+	if !s.repl.applyingMaster {
+		s.feedReplicationStream(redisprotocol.EncodeCommand(argv))
+	}
+}
+
+// replayCommand executes a command read back from the append-only file.
+func (s *Server) replayCommand(argv []string) error {
+	cmd, ok := s.commands[strings.ToUpper(argv[0])]
+	if !ok {
+		return fmt.Errorf("unknown command '%s' reading the append-only file", argv[0])
+	}
+	s.call(cmd, argv, nil)
+	return nil
+}
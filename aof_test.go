@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+// aofTestCommands is a log with a transaction in the middle. safe lists
+// the offsets, in commands, where the log may end without being truncated,
+// and loaded how many commands are replayed up to each of them.
+var aofTestCommands = [][]string{
+	{"SET", "a", "1"},
+	{"RPUSH", "l", "x", "y"},
+	{"MULTI"},
+	{"INCR", "n"},
+	{"INCR", "n"},
+	{"EXEC"},
+	{"DEL", "a"},
+}
+
+// writeTestAOF writes cmds to a new append-only file and returns its path
+// and the offset just past each command.
+func writeTestAOF(t *testing.T, cmds [][]string) (string, []int64) {
+	t.Helper()
+	var data []byte
+	var ends []int64
+	for _, argv := range cmds {
+		data = append(data, redisprotocol.EncodeCommand(argv)...)
+		ends = append(ends, int64(len(data)))
+	}
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, ends
+}
+
+// loadTestAOF loads the file at path and returns the replayed commands.
+func loadTestAOF(path string, allowTruncated bool) ([][]string, error) {
+	var replayed [][]string
+	loaded, err := LoadAOF(path, allowTruncated, func(argv []string) error {
+		replayed = append(replayed, argv)
+		return nil
+	})
+	if loaded != len(replayed) {
+		panic("LoadAOF miscounted the replayed commands")
+	}
+	return replayed, err
+}
+
+func TestLoadAOF(t *testing.T) {
+	path, _ := writeTestAOF(t, aofTestCommands)
+	got, err := loadTestAOF(path, false)
+	if err != nil {
+		t.Fatalf("LoadAOF failed: %v", err)
+	}
+	want := [][]string{aofTestCommands[0], aofTestCommands[1], aofTestCommands[3], aofTestCommands[4], aofTestCommands[6]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+
+	if got, err := loadTestAOF(filepath.Join(t.TempDir(), "missing.aof"), false); err != nil || len(got) != 0 {
+		t.Errorf("LoadAOF of a missing file = %q, %v, want nothing", got, err)
+	}
+}
+
+// TestLoadAOFTruncated cuts the log at every byte. A log that ends in the
+// middle of a command or of a transaction fails to load, unless truncated
+// logs are allowed: then the incomplete tail is cut off the file and the
+// commands before it are replayed.
+func TestLoadAOFTruncated(t *testing.T) {
+	full, ends := writeTestAOF(t, aofTestCommands)
+	data, err := os.ReadFile(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Commands 2 to 5 are the transaction, which is applied whole or not
+	// at all.
+	safe := []int64{0, ends[0], ends[1], ends[5], ends[6]}
+	replayedAt := []int{0, 1, 2, 4, 5}
+
+	for n := int64(0); n <= int64(len(data)); n++ {
+		valid, loaded := int64(0), 0
+		for i, offset := range safe {
+			if offset <= n {
+				valid, loaded = offset, replayedAt[i]
+			}
+		}
+		path := filepath.Join(t.TempDir(), "appendonly.aof")
+		if err := os.WriteFile(path, data[:n], 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := loadTestAOF(path, false)
+		if n == valid && err != nil {
+			t.Errorf("LoadAOF of the first %d bytes failed: %v", n, err)
+		} else if n != valid && err == nil {
+			t.Errorf("LoadAOF of the first %d bytes succeeded without -aof-load-truncated", n)
+		}
+		if info, _ := os.Stat(path); info.Size() != n {
+			t.Fatalf("LoadAOF changed the file to %d bytes without -aof-load-truncated", info.Size())
+		}
+
+		got, err := loadTestAOF(path, true)
+		if err != nil {
+			t.Errorf("LoadAOF of the first %d bytes failed: %v", n, err)
+			continue
+		}
+		if len(got) != loaded {
+			t.Errorf("LoadAOF of the first %d bytes replayed %d commands, want %d", n, len(got), loaded)
+		}
+		if info, _ := os.Stat(path); info.Size() != valid {
+			t.Errorf("LoadAOF of the first %d bytes truncated the file to %d bytes, want %d", n, info.Size(), valid)
+		}
+		// What remains loads cleanly.
+		if again, err := loadTestAOF(path, false); err != nil || len(again) != loaded {
+			t.Errorf("reloading the truncated file = %d commands, %v, want %d", len(again), err, loaded)
+		}
+	}
+}
+
+// TestLoadAOFBadFormat checks that garbage in the log is an error even
+// when truncated logs are allowed, and that the file is left alone.
+func TestLoadAOFBadFormat(t *testing.T) {
+	for _, garbage := range []string{"garbage\r\n", "+OK\r\n", "*0\r\n", "*1\r\n:1\r\n"} {
+		path, ends := writeTestAOF(t, aofTestCommands[:2])
+		data, _ := os.ReadFile(path)
+		data = append(data, garbage...)
+		data = append(data, redisprotocol.EncodeCommand([]string{"SET", "b", "2"})...)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadTestAOF(path, true); err == nil {
+			t.Errorf("LoadAOF with %q after %d bytes succeeded", garbage, ends[1])
+		}
+		if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+			t.Errorf("LoadAOF with %q truncated the file", garbage)
+		}
+	}
+}
+
+// TestAOFSkipsNoOpWrites checks that only writes that changed the dataset
+// are logged and counted, and that the log rebuilds the same dataset.
+func TestAOFSkipsNoOpWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	aof, err := OpenAOF(path, fsyncNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+	s := NewServer()
+	s.aof = aof
+	for _, argv := range [][]string{
+		{"SET", "k", "v"},
+		{"SETNX", "k", "w"},
+		{"SET", "k", "w", "NX"},
+		{"DEL", "missing"},
+		{"EXPIRE", "missing", "100"},
+		{"PERSIST", "k"},
+		{"HSETNX", "h", "f", "1"},
+		{"HSETNX", "h", "f", "2"},
+		{"LPOP", "missing"},
+		{"LREM", "missing", "0", "x"},
+		{"SADD", "s", "a"},
+		{"SADD", "s", "a"},
+		{"ZADD", "z", "1", "m"},
+		{"ZADD", "z", "1", "m"},
+		{"ZADD", "z", "2", "m"},
+	} {
+		s.call(s.commands[argv[0]], argv, nil)
+	}
+
+	got, err := loadTestAOF(path, false)
+	if err != nil {
+		t.Fatalf("LoadAOF failed: %v", err)
+	}
+	want := [][]string{
+		{"SET", "k", "v"},
+		{"HSETNX", "h", "f", "1"},
+		{"SADD", "s", "a"},
+		{"ZADD", "z", "1", "m"},
+		{"ZADD", "z", "2", "m"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+	if dirty := s.kvstore.dirty.Load(); dirty != int64(len(want)) {
+		t.Errorf("dirty = %d, want %d", dirty, len(want))
+	}
+
+	replayed := NewServer()
+	if _, err := LoadAOF(path, false, replayed.replayCommand); err != nil {
+		t.Fatalf("LoadAOF failed: %v", err)
+	}
+	checkSameStore(t, replayed.kvstore, s.kvstore)
+}
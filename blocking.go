@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+// Blocking list commands. BLPOP, BRPOP, BLMOVE and BRPOPLPUSH are in the
+// command table as their non-blocking forms, which is how they run inside
+// MULTI, when replayed and when received from a master: they reply with
+// null instead of blocking. Sent by a client, handleBlocking runs them the
+// same way and, if they found nothing, parks the client until a write to a
+// key it waits on (see blockingKeys) or the timeout.
+//
+// Clients blocked on a key are served in the order they blocked. After each
+// write command, or transaction, every key it touched that has blocked
+// clients is checked, and the command of the longest waiting client runs
+// again for as long as the key holds elements.
+
+var (
+	errTimeoutNotFloat = errors.New("ERR timeout is not a float or out of range")
+	errTimeoutNegative = errors.New("ERR timeout is negative")
+)
+
+// blockedClient is a client waiting in a blocking command.
+type blockedClient struct {
+	client *Client
+	argv   []string
+	keys   []string
+	// reply receives the reply of the command once a write served it.
+	reply chan redisprotocol.Value
+}
+
+func (s *Server) handleBLPop(args []string) redisprotocol.Value {
+	return s.blockingPop("BLPOP", args, true)
+}
+
+func (s *Server) handleBRPop(args []string) redisprotocol.Value {
+	return s.blockingPop("BRPOP", args, false)
+}
+
+// blockingPop pops from the first non-empty list among the keys and replies
+// with the key and the element, or with a null array.
+func (s *Server) blockingPop(cmd string, args []string, left bool) redisprotocol.Value {
+	if len(args) < 2 {
+		return wrongArgs(cmd)
+	}
+	if _, err := parseBlockTimeout(args[len(args)-1]); err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	for _, key := range args[:len(args)-1] {
+		list, err := s.kvstore.lookupWrite(key, TypeList)
+		if err != nil {
+			return redisprotocol.NewError(err.Error())
+		}
+		if list == nil {
+			continue
+		}
+		var elem string
+		if left {
+			elem = list.List.PopFront()
+		} else {
+			elem = list.List.PopBack()
+		}
+		s.kvstore.deleteIfEmpty(key, list)
+		return redisprotocol.NewBulkArray([]string{key, elem})
+	}
+	return redisprotocol.NewNullArray()
+}
+
+// handleBLMove implements BLMOVE source destination LEFT|RIGHT LEFT|RIGHT
+// timeout.
+func (s *Server) handleBLMove(args []string) redisprotocol.Value {
+	if len(args) != 5 {
+		return wrongArgs("BLMOVE")
+	}
+	srcLeft, ok1 := parseListEnd(args[2])
+	dstLeft, ok2 := parseListEnd(args[3])
+	if !ok1 || !ok2 {
+		return redisprotocol.NewError("ERR syntax error")
+	}
+	if _, err := parseBlockTimeout(args[4]); err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	return s.listMove(args[0], args[1], srcLeft, dstLeft)
+}
+
+// handleBRPopLPush implements BRPOPLPUSH source destination timeout, the
+// same as BLMOVE source destination RIGHT LEFT timeout.
+func (s *Server) handleBRPopLPush(args []string) redisprotocol.Value {
+	if len(args) != 3 {
+		return wrongArgs("BRPOPLPUSH")
+	}
+	if _, err := parseBlockTimeout(args[2]); err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	return s.listMove(args[0], args[1], false, true)
+}
+
+// parseBlockTimeout parses a timeout in seconds, which may have a fractional
+// part; 0 blocks forever.
+func parseBlockTimeout(arg string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, errTimeoutNotFloat
+	}
+	if seconds < 0 {
+		return 0, errTimeoutNegative
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// unblockedCommand returns the non-blocking command to propagate for a
+// blocking command that replied with reply, nil if it did nothing. The pops
+// are propagated for the key they were made from.
+func unblockedCommand(argv []string, reply redisprotocol.Value) []string {
+	if reply.Type == "null" || reply.Type == "nullarray" {
+		return nil
+	}
+	switch strings.ToUpper(argv[0]) {
+	case "BLPOP":
+		return []string{"LPOP", reply.Array[0].Bulk}
+	case "BRPOP":
+		return []string{"RPOP", reply.Array[0].Bulk}
+	case "BLMOVE":
+		return append([]string{"LMOVE"}, argv[1:5]...)
+	case "BRPOPLPUSH":
+		return []string{"RPOPLPUSH", argv[1], argv[2]}
+	}
+	return argv
+}
+
+// handleBlocking runs a blocking command for a client, waiting for one of
+// its keys to receive data if it cannot be served right away.
+func (s *Server) handleBlocking(argv []string, c *Client) redisprotocol.Value {
+	cmd := s.commands[strings.ToUpper(argv[0])]
+	s.kvstore.Lock()
+	reply := s.execute(cmd, argv)
+	s.serveBlockedClients()
+	c.woff = s.repl.offset
+	if reply.Type != "null" && reply.Type != "nullarray" {
+		s.kvstore.Unlock()
+		return reply
+	}
+
+	timeout, _ := parseBlockTimeout(argv[len(argv)-1])
+	b := &blockedClient{client: c, argv: argv, keys: blockingKeys(cmd, argv), reply: make(chan redisprotocol.Value, 1)}
+	for _, key := range b.keys {
+		s.blocked[key] = append(s.blocked[key], b)
+	}
+	s.kvstore.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	closed, stopWatching := watchDisconnect(c)
+	defer stopWatching()
+	select {
+	case reply := <-b.reply:
+		return reply
+	case <-expired:
+	case <-closed:
+	}
+
+	s.kvstore.Lock()
+	defer s.kvstore.Unlock()
+	select {
+	case reply := <-b.reply:
+		// Served while the timeout fired.
+		return reply
+	default:
+	}
+	s.unblockClient(b)
+	return redisprotocol.NewNullArray()
+}
+
+// blockingKeys returns the keys a blocking command waits on: all of them for
+// the pops, only the source for the moves, whose destination receiving data
+// does not let them proceed.
+func blockingKeys(cmd Command, argv []string) []string {
+	switch strings.ToUpper(argv[0]) {
+	case "BLMOVE", "BRPOPLPUSH":
+		return argv[1:2]
+	}
+	return cmd.keys(argv)
+}
+
+// watchDisconnect reports on closed when the client's connection is closed
+// while it is blocked. stop ends the watch and must be called before the
+// connection is read again.
+func watchDisconnect(c *Client) (closed <-chan struct{}, stop func()) {
+	ch := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// A client sending its next command is not closed; there is
+		// nothing left to watch then.
+		if err := c.resp.Peek(); err != nil && !isTimeout(err) {
+			close(ch)
+		}
+	}()
+	return ch, func() {
+		c.conn.SetReadDeadline(time.Now())
+		<-done
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// signalKeyAsReady records that a write touched key, if clients are blocked
+// on it. The caller must hold the store write lock.
+func (s *Server) signalKeyAsReady(key string) {
+	if len(s.blocked[key]) == 0 {
+		return
+	}
+	for _, ready := range s.readyKeys {
+		if ready == key {
+			return
+		}
+	}
+	s.readyKeys = append(s.readyKeys, key)
+}
+
+// serveBlockedClients runs the commands of clients blocked on the keys
+// written since the last call, for as long as those keys hold elements.
+// Serving a client can push to another key, which is then served too. The
+// caller must hold the store write lock.
+func (s *Server) serveBlockedClients() {
+	for len(s.readyKeys) > 0 {
+		key := s.readyKeys[0]
+		s.readyKeys = s.readyKeys[1:]
+		for len(s.blocked[key]) > 0 {
+			if list, _ := s.kvstore.lookupType(key, TypeList); list == nil {
+				break
+			}
+			b := s.blocked[key][0]
+			argv := b.argv
+			if name := strings.ToUpper(argv[0]); name == "BLPOP" || name == "BRPOP" {
+				// Pop from the key that is ready, not the first one listed.
+				argv = []string{name, key, argv[len(argv)-1]}
+			}
+			reply := s.execute(s.commands[strings.ToUpper(argv[0])], argv)
+			if reply.Type == "null" || reply.Type == "nullarray" {
+				// Not served: the client stays blocked.
+				break
+			}
+			s.unblockClient(b)
+			b.client.woff = s.repl.offset
+			b.reply <- reply
+		}
+	}
+}
+
+// unblockClient removes b from the queues of all its keys. The caller must
+// hold the store write lock.
+func (s *Server) unblockClient(b *blockedClient) {
+	for _, key := range b.keys {
+		queue := s.blocked[key]
+		for i, other := range queue {
+			if other == b {
+				queue = append(queue[:i:i], queue[i+1:]...)
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(s.blocked, key)
+		} else {
+			s.blocked[key] = queue
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+// blockAsync runs a blocking command for c in the background once it is
+// blocked on key, and returns the channel its reply arrives on.
+func blockAsync(t *testing.T, s *Server, c *Client, key string, argv ...string) <-chan redisprotocol.Value {
+	t.Helper()
+	reply := make(chan redisprotocol.Value, 1)
+	go func() { reply <- s.processCommand(argv, c) }()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		s.kvstore.RLock()
+		blocked := len(s.blocked[key])
+		s.kvstore.RUnlock()
+		if blocked > 0 {
+			return reply
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%q did not block on %q", argv, key)
+		}
+	}
+}
+
+// checkBlocked checks that nothing arrived on reply yet.
+func checkBlocked(t *testing.T, reply <-chan redisprotocol.Value) {
+	t.Helper()
+	select {
+	case v := <-reply:
+		t.Fatalf("served with %+v, want still blocked", v)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// checkServed waits for the reply of a blocked command.
+func checkServed(t *testing.T, reply <-chan redisprotocol.Value, want redisprotocol.Value) {
+	t.Helper()
+	select {
+	case got := <-reply:
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("served with %+v, want %+v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("not served, want %+v", want)
+	}
+}
+
+func TestBlockingPop(t *testing.T) {
+	s := NewServer()
+	a, b, c := newTestClient(t), newTestClient(t), newTestClient(t)
+
+	checkReply(t, s, c, redisprotocol.NewInteger(1), "RPUSH", "q2", "now")
+	checkReply(t, s, a, redisprotocol.NewBulkArray([]string{"q2", "now"}), "BLPOP", "q1", "q2", "0")
+
+	// Clients are served in the order they blocked.
+	first := blockAsync(t, s, a, "q1", "BLPOP", "q1", "q2", "0")
+	second := blockAsync(t, s, b, "q2", "BRPOP", "q2", "0")
+	checkReply(t, s, c, redisprotocol.NewInteger(3), "RPUSH", "q2", "x", "y", "z")
+	checkServed(t, first, redisprotocol.NewBulkArray([]string{"q2", "x"}))
+	checkServed(t, second, redisprotocol.NewBulkArray([]string{"q2", "z"}))
+	checkReply(t, s, c, redisprotocol.NewBulkArray([]string{"y"}), "LRANGE", "q2", "0", "-1")
+}
+
+func TestBlockingPopTimeout(t *testing.T) {
+	s := NewServer()
+	a := newTestClient(t)
+	start := time.Now()
+	checkReply(t, s, a, redisprotocol.NewNullArray(), "BLPOP", "q", "0.05")
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("BLPOP timed out after %v, want 50ms", elapsed)
+	}
+	s.kvstore.RLock()
+	defer s.kvstore.RUnlock()
+	if len(s.blocked) != 0 {
+		t.Errorf("timed out client still blocked on %v", s.blocked)
+	}
+}
+
+func TestBlockingErrors(t *testing.T) {
+	s := NewServer()
+	a := newTestClient(t)
+	checkReply(t, s, a, redisprotocol.NewError("ERR timeout is negative"), "BLPOP", "q", "-1")
+	checkReply(t, s, a, redisprotocol.NewError("ERR timeout is not a float or out of range"), "BLPOP", "q", "x")
+	checkReply(t, s, a, replyOK, "SET", "str", "v")
+	checkReply(t, s, a, redisprotocol.NewError(errWrongType.Error()), "BLPOP", "str", "0")
+	// Inside MULTI a blocking command does not block.
+	checkReply(t, s, a, replyOK, "MULTI")
+	checkReply(t, s, a, replyQueued, "BLPOP", "q", "0")
+	checkReply(t, s, a, redisprotocol.NewArray([]redisprotocol.Value{redisprotocol.NewNullArray()}), "EXEC")
+}
+
+// TestBlockingMove checks that BLMOVE waits for its source only, and is
+// served by a push made inside a transaction once the transaction ended.
+func TestBlockingMove(t *testing.T) {
+	s := NewServer()
+	a, b := newTestClient(t), newTestClient(t)
+	reply := blockAsync(t, s, a, "src", "BLMOVE", "src", "dst", "LEFT", "RIGHT", "0")
+	checkReply(t, s, b, redisprotocol.NewInteger(1), "RPUSH", "dst", "d")
+	checkBlocked(t, reply)
+
+	checkReply(t, s, b, replyOK, "MULTI")
+	checkReply(t, s, b, replyQueued, "RPUSH", "src", "m")
+	checkReply(t, s, b, replyQueued, "LLEN", "src")
+	checkReply(t, s, b, redisprotocol.NewArray([]redisprotocol.Value{redisprotocol.NewInteger(1), redisprotocol.NewInteger(1)}), "EXEC")
+	checkServed(t, reply, redisprotocol.NewBulk("m"))
+	checkReply(t, s, b, redisprotocol.NewBulkArray([]string{"d", "m"}), "LRANGE", "dst", "0", "-1")
+	checkReply(t, s, b, redisprotocol.NewInteger(0), "EXISTS", "src")
+}
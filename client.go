@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+const serverVersion = "7.2.0"
+
+var nextClientID int64
+
+// Client holds the state of a single client connection.
+type Client struct {
+	id   int64
+	name string
+	conn net.Conn
+	resp *redisprotocol.Resp
+	mu   sync.Mutex // serializes writes from the connection and from publishers
+
+	// Transaction state, see transaction.go. watched and dirtyCAS are
+	// guarded by the kvstore lock.
+	inMulti    bool
+	multiQueue [][]string
+	multiError bool
+	watched    map[string]bool // watched key -> whether it existed when watched
+	dirtyCAS   bool
+
+	// Replication state of a connection from a replica, see replication.go.
+	// replica is set once the connection has been turned into a replication
+	// link by PSYNC and is guarded by the kvstore lock.
+	replListeningPort string
+	replica           *replica
+	// woff is the replication offset just after the last write of the
+	// client, which WAIT waits for the replicas to acknowledge.
+	woff int64
+
+	// Cluster state, see cluster.go. asking is set by ASKING for the next
+	// command; multiSlot is the slot used by the queued commands, or -1.
+	asking    bool
+	multiSlot int
+}
+
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		id:   atomic.AddInt64(&nextClientID, 1),
+		conn: conn,
+		resp: redisprotocol.NewResp(conn, conn),
+
+		multiSlot: -1,
+	}
+}
+
+// Write sends a reply or push frame to the client.
+func (c *Client) Write(v redisprotocol.Value) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resp.Write(v)
+}
+
+// WriteRaw sends bytes that are already RESP encoded.
+func (c *Client) WriteRaw(p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write(p)
+	return err
+}
+
+func (c *Client) protocol() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resp.Protocol()
+}
+
+func (c *Client) setProtocol(version int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resp.SetProtocol(version)
+}
+
+// handleHello implements HELLO [protover [AUTH username password] [SETNAME clientname]].
+func (s *Server) handleHello(args []string, c *Client) redisprotocol.Value {
+	version := c.protocol()
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			return redisprotocol.NewError("ERR Protocol version is not an integer or out of range")
+		}
+		if v != 2 && v != 3 {
+			return redisprotocol.NewError("NOPROTO unsupported protocol version")
+		}
+		version = v
+	}
+
+	name := c.name
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return redisprotocol.NewError("ERR Syntax error in HELLO option 'AUTH'")
+			}
+			// Only the passwordless default user exists.
+			if args[i+1] != "default" {
+				return redisprotocol.NewError("WRONGPASS invalid username-password pair or user is disabled.")
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return redisprotocol.NewError("ERR Syntax error in HELLO option 'SETNAME'")
+			}
+			name = args[i+1]
+			i++
+		default:
+			return redisprotocol.NewError("ERR Syntax error in HELLO option '" + args[i] + "'")
+		}
+	}
+
+	c.name = name
+	c.setProtocol(version)
+	role := "master"
+	s.kvstore.RLock()
+	if s.isReplica() {
+		role = "replica"
+	}
+	s.kvstore.RUnlock()
+	mode := "standalone"
+	if s.cluster != nil {
+		mode = "cluster"
+	}
+	return redisprotocol.NewMap([]redisprotocol.Value{
+		redisprotocol.NewBulk("server"), redisprotocol.NewBulk("redis"),
+		redisprotocol.NewBulk("version"), redisprotocol.NewBulk(serverVersion),
+		redisprotocol.NewBulk("proto"), redisprotocol.NewInteger(version),
+		redisprotocol.NewBulk("id"), redisprotocol.NewInteger(int(c.id)),
+		redisprotocol.NewBulk("mode"), redisprotocol.NewBulk(mode),
+		redisprotocol.NewBulk("role"), redisprotocol.NewBulk(role),
+		redisprotocol.NewBulk("modules"), redisprotocol.NewArray(nil),
+	})
+}
@@ -0,0 +1,930 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+// clusterSlots is the number of hash slots the keyspace is divided into.
+const clusterSlots = 16384
+
+// clusterPollPeriod is how often a node asks every other node it knows for
+// its view of the cluster. There is no separate cluster bus: nodes talk to
+// each other with CLUSTER commands over the client port.
+const clusterPollPeriod = time.Second
+
+// crc16Table is the CRC16-CCITT (XModem) table used for key hash slots.
+var crc16Table = func() (table [256]uint16) {
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^s[i]]
+	}
+	return crc
+}
+
+// keyHashSlot returns the slot of key. When the key contains a non-empty
+// {hashtag}, only the tag is hashed, so that related keys can be put in the
+// same slot.
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) & (clusterSlots - 1))
+}
+
+// clusterNode is a node of the cluster as seen by this server.
+type clusterNode struct {
+	id   string
+	ip   string
+	port int
+
+	// lastPong is when the node last answered a poll, or when we learned
+	// about it. A node silent for longer than the node timeout is failing.
+	lastPong time.Time
+	linkUp   bool
+	failing  bool
+	polling  bool
+	lastPoll time.Time
+}
+
+func (n *clusterNode) addr() string {
+	return net.JoinHostPort(n.ip, strconv.Itoa(n.port))
+}
+
+// clusterState is the slot table and the nodes known to a cluster node. It
+// is guarded by the kvstore lock.
+//
+// Each node is the authority for the slots it serves: slot ownership is
+// changed with CLUSTER ADDSLOTS, DELSLOTS and SETSLOT on the nodes
+// concerned, and every node learns the others' slots, and about nodes it
+// has not met yet, by polling the nodes it knows with CLUSTER NODES.
+type clusterState struct {
+	myself *clusterNode
+	nodes  map[string]*clusterNode
+	slots  [clusterSlots]*clusterNode
+	// migrating and importing hold the target and source node of slots
+	// being moved with CLUSTER SETSLOT.
+	migrating map[int]*clusterNode
+	importing map[int]*clusterNode
+	// forgotten keeps nodes removed with CLUSTER FORGET from being learned
+	// again from other nodes for a minute.
+	forgotten map[string]time.Time
+	// saved is the content last written to the config file.
+	saved string
+}
+
+func newClusterState() *clusterState {
+	myself := &clusterNode{id: newReplID(), linkUp: true}
+	return &clusterState{
+		myself:    myself,
+		nodes:     map[string]*clusterNode{myself.id: myself},
+		migrating: make(map[int]*clusterNode),
+		importing: make(map[int]*clusterNode),
+		forgotten: make(map[string]time.Time),
+	}
+}
+
+// ok reports whether every slot is served by a reachable node.
+func (cs *clusterState) ok() bool {
+	for _, n := range cs.slots {
+		if n == nil || n.failing {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeSlots returns the slots served by n as ranges of [first, last].
+func (cs *clusterState) nodeSlots(n *clusterNode) [][2]int {
+	var ranges [][2]int
+	for slot := 0; slot < clusterSlots; slot++ {
+		if cs.slots[slot] != n {
+			continue
+		}
+		if last := len(ranges) - 1; last >= 0 && ranges[last][1] == slot-1 {
+			ranges[last][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+// sortedNodes returns the known nodes, myself first and then by ID.
+func (cs *clusterState) sortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(cs.nodes))
+	for _, n := range cs.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i] == cs.myself || nodes[j] == cs.myself {
+			return nodes[i] == cs.myself
+		}
+		return nodes[i].id < nodes[j].id
+	})
+	return nodes
+}
+
+// nodesDescription renders the cluster in the CLUSTER NODES format, which
+// is also the format of the config file.
+func (cs *clusterState) nodesDescription() string {
+	var b strings.Builder
+	for _, n := range cs.sortedNodes() {
+		flags := "master"
+		if n == cs.myself {
+			flags = "myself,master"
+		} else if n.failing {
+			flags += ",fail"
+		}
+		link := "connected"
+		if !n.linkUp {
+			link = "disconnected"
+		}
+		var pong int64
+		if n != cs.myself {
+			pong = n.lastPong.UnixMilli()
+		}
+		fmt.Fprintf(&b, "%s %s:%d@0 %s - 0 %d 0 %s", n.id, n.ip, n.port, flags, pong, link)
+		for _, r := range cs.nodeSlots(n) {
+			if r[0] == r[1] {
+				fmt.Fprintf(&b, " %d", r[0])
+			} else {
+				fmt.Fprintf(&b, " %d-%d", r[0], r[1])
+			}
+		}
+		if n == cs.myself {
+			for _, slot := range sortedSlots(cs.migrating) {
+				fmt.Fprintf(&b, " [%d->-%s]", slot, cs.migrating[slot].id)
+			}
+			for _, slot := range sortedSlots(cs.importing) {
+				fmt.Fprintf(&b, " [%d-<-%s]", slot, cs.importing[slot].id)
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func sortedSlots(m map[int]*clusterNode) []int {
+	slots := make([]int, 0, len(m))
+	for slot := range m {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	return slots
+}
+
+// clusterNodeLine is a line of CLUSTER NODES output.
+type clusterNodeLine struct {
+	id     string
+	ip     string
+	port   int
+	myself bool
+	slots  [][2]int
+	// migrating and importing map slots to the other node's ID.
+	migrating map[int]string
+	importing map[int]string
+}
+
+// parseClusterNodes parses CLUSTER NODES output.
+func parseClusterNodes(text string) ([]clusterNodeLine, error) {
+	var lines []clusterNodeLine
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == "vars" {
+			continue
+		}
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("invalid node line %q", line)
+		}
+		addr, _, _ := strings.Cut(fields[1], "@")
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node address %q", fields[1])
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node address %q", fields[1])
+		}
+		l := clusterNodeLine{
+			id:        fields[0],
+			ip:        host,
+			port:      port,
+			migrating: make(map[int]string),
+			importing: make(map[int]string),
+		}
+		for _, flag := range strings.Split(fields[2], ",") {
+			if flag == "myself" {
+				l.myself = true
+			}
+		}
+		for _, field := range fields[8:] {
+			if strings.HasPrefix(field, "[") {
+				spec := strings.Trim(field, "[]")
+				if slotStr, id, ok := strings.Cut(spec, "->-"); ok {
+					slot, err := parseSlot(slotStr)
+					if err != nil {
+						return nil, err
+					}
+					l.migrating[slot] = id
+				} else if slotStr, id, ok := strings.Cut(spec, "-<-"); ok {
+					slot, err := parseSlot(slotStr)
+					if err != nil {
+						return nil, err
+					}
+					l.importing[slot] = id
+				}
+				continue
+			}
+			firstStr, lastStr, isRange := strings.Cut(field, "-")
+			if !isRange {
+				lastStr = firstStr
+			}
+			first, err := parseSlot(firstStr)
+			if err != nil {
+				return nil, err
+			}
+			last, err := parseSlot(lastStr)
+			if err != nil || last < first {
+				return nil, fmt.Errorf("invalid slot range %q", field)
+			}
+			l.slots = append(l.slots, [2]int{first, last})
+		}
+		lines = append(lines, l)
+	}
+	return lines, nil
+}
+
+func parseSlot(s string) (int, error) {
+	slot, err := strconv.Atoi(s)
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return 0, fmt.Errorf("invalid slot %q", s)
+	}
+	return slot, nil
+}
+
+// loadClusterConfig restores the cluster state from the config file, or
+// creates a new node when there is none.
+func loadClusterConfig(path string) (*clusterState, error) {
+	cs := newClusterState()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		cs.myself.ip, cs.myself.port = config.ClusterAnnounceIP, clusterPort()
+		return cs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines, err := parseClusterNodes(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	cs.nodes = make(map[string]*clusterNode)
+	cs.myself = nil
+	for _, l := range lines {
+		n := &clusterNode{id: l.id, ip: l.ip, port: l.port, lastPong: time.Now()}
+		cs.nodes[n.id] = n
+		if l.myself {
+			cs.myself = n
+		}
+	}
+	if cs.myself == nil {
+		return nil, fmt.Errorf("%s: no node is flagged as myself", path)
+	}
+	cs.myself.ip, cs.myself.port, cs.myself.linkUp = config.ClusterAnnounceIP, clusterPort(), true
+	for _, l := range lines {
+		for _, r := range l.slots {
+			for slot := r[0]; slot <= r[1]; slot++ {
+				cs.slots[slot] = cs.nodes[l.id]
+			}
+		}
+		for slot, id := range l.migrating {
+			if n, ok := cs.nodes[id]; ok {
+				cs.migrating[slot] = n
+			}
+		}
+		for slot, id := range l.importing {
+			if n, ok := cs.nodes[id]; ok {
+				cs.importing[slot] = n
+			}
+		}
+	}
+	cs.saved = cs.nodesDescription()
+	return cs, nil
+}
+
+func clusterPort() int {
+	port, _ := strconv.Atoi(config.Port)
+	return port
+}
+
+// saveConfig writes the cluster state to the config file if it changed.
+// The caller must hold the store lock.
+func (cs *clusterState) saveConfig() {
+	text := cs.nodesDescription()
+	// The pong times change on every poll and are not worth a write.
+	if stripPongTimes(text) == stripPongTimes(cs.saved) {
+		return
+	}
+	tempPath := config.ClusterConfigFile + ".tmp"
+	if err := os.WriteFile(tempPath, []byte(text), 0644); err != nil {
+		fmt.Println("Error saving the cluster config:", err)
+		return
+	}
+	if err := os.Rename(tempPath, config.ClusterConfigFile); err != nil {
+		fmt.Println("Error saving the cluster config:", err)
+		return
+	}
+	cs.saved = text
+}
+
+func stripPongTimes(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if fields := strings.Fields(line); len(fields) >= 8 {
+			fields[5] = "0"
+			lines[i] = strings.Join(fields, " ")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// clusterRedirect checks that this node may serve a command with the given
+// keys. It returns a MOVED or ASK redirection or an error when it may not,
+// and noReply otherwise. The caller must hold the store lock.
+func (s *Server) clusterRedirect(name string, keys []string, asking bool) redisprotocol.Value {
+	cs := s.cluster
+	slot := keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			return redisprotocol.NewError("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+	if !cs.ok() {
+		return redisprotocol.NewError("CLUSTERDOWN The cluster is down")
+	}
+	owner := cs.slots[slot]
+
+	missing := 0
+	for _, key := range keys {
+		if s.kvstore.lookup(key) == nil {
+			missing++
+		}
+	}
+	migrating, importing := cs.migrating[slot], cs.importing[slot]
+	if name == "MIGRATE" && (migrating != nil || importing != nil) {
+		// Moving the keys of a slot is done where they are, on either side.
+		return noReply
+	}
+	if owner == cs.myself {
+		if migrating == nil || missing == 0 {
+			return noReply
+		}
+		// Keys already moved, or created from now on, live on the target.
+		if len(keys) > 1 && missing < len(keys) {
+			return redisprotocol.NewError("TRYAGAIN Multiple keys request during rehashing of slot")
+		}
+		return redisprotocol.NewError(fmt.Sprintf("ASK %d %s", slot, migrating.addr()))
+	}
+	if importing != nil && asking {
+		if len(keys) > 1 && missing > 0 {
+			return redisprotocol.NewError("TRYAGAIN Multiple keys request during rehashing of slot")
+		}
+		return noReply
+	}
+	return redisprotocol.NewError(fmt.Sprintf("MOVED %d %s", slot, owner.addr()))
+}
+
+// clusterCheck decides whether a command may run on this node, returning
+// the redirection or error to reply with otherwise, or noReply. Inside MULTI
+// all the commands must use the same slot.
+func (s *Server) clusterCheck(cmd Command, argv []string, c *Client, asking bool) redisprotocol.Value {
+	keys := cmd.keys(argv)
+	if len(keys) == 0 {
+		return noReply
+	}
+	if c.inMulti && c.multiSlot >= 0 && keyHashSlot(keys[0]) != c.multiSlot {
+		return redisprotocol.NewError("CROSSSLOT Keys in request don't hash to the same slot")
+	}
+	s.kvstore.RLock()
+	reply := s.clusterRedirect(strings.ToUpper(argv[0]), keys, asking)
+	s.kvstore.RUnlock()
+	if reply.Type == "" && c.inMulti {
+		c.multiSlot = keyHashSlot(keys[0])
+	}
+	return reply
+}
+
+// handleAsking implements ASKING, which lets the next command of the client
+// use a slot being imported by this node.
+func (s *Server) handleAsking(args []string, c *Client) redisprotocol.Value {
+	if len(args) != 0 {
+		return wrongArgs("ASKING")
+	}
+	if s.cluster == nil {
+		return redisprotocol.NewError("ERR This instance has cluster support disabled")
+	}
+	c.asking = true
+	return redisprotocol.NewString("OK")
+}
+
+// handleCluster implements the CLUSTER subcommands.
+func (s *Server) handleCluster(args []string, c *Client) redisprotocol.Value {
+	if len(args) == 0 {
+		return wrongArgs("CLUSTER")
+	}
+	if s.cluster == nil {
+		return redisprotocol.NewError("ERR This instance has cluster support disabled")
+	}
+	sub, args := strings.ToUpper(args[0]), args[1:]
+	switch sub {
+	case "MEET":
+		// Meeting involves talking to the other node, without the lock.
+		return s.clusterMeet(args, true)
+	case "KEYSLOT":
+		if len(args) != 1 {
+			return wrongArgs("CLUSTER|KEYSLOT")
+		}
+		return redisprotocol.NewInteger(keyHashSlot(args[0]))
+	}
+
+	s.kvstore.Lock()
+	defer s.kvstore.Unlock()
+	cs := s.cluster
+	switch sub {
+	case "MYID":
+		return redisprotocol.NewBulk(cs.myself.id)
+	case "INFO":
+		return redisprotocol.NewVerbatim("txt", s.clusterInfo())
+	case "NODES":
+		return redisprotocol.NewVerbatim("txt", cs.nodesDescription())
+	case "SLOTS":
+		return s.clusterSlotsReply()
+	case "SHARDS":
+		return s.clusterShardsReply()
+	case "COUNTKEYSINSLOT":
+		if len(args) != 1 {
+			return wrongArgs("CLUSTER|COUNTKEYSINSLOT")
+		}
+		slot, err := parseSlot(args[0])
+		if err != nil {
+			return redisprotocol.NewError("ERR Invalid slot")
+		}
+		return redisprotocol.NewInteger(s.countKeysInSlot(slot))
+	case "GETKEYSINSLOT":
+		if len(args) != 2 {
+			return wrongArgs("CLUSTER|GETKEYSINSLOT")
+		}
+		slot, err := parseSlot(args[0])
+		if err != nil {
+			return redisprotocol.NewError("ERR Invalid slot")
+		}
+		count, err := strconv.Atoi(args[1])
+		if err != nil || count < 0 {
+			return redisprotocol.NewError("ERR Invalid number of keys")
+		}
+		return redisprotocol.NewBulkArray(s.keysInSlot(slot, count))
+	case "ADDSLOTS", "DELSLOTS", "ADDSLOTSRANGE", "DELSLOTSRANGE":
+		return s.clusterChangeSlots(sub, args)
+	case "SETSLOT":
+		return s.clusterSetSlot(args)
+	case "FORGET":
+		if len(args) != 1 {
+			return wrongArgs("CLUSTER|FORGET")
+		}
+		n, ok := cs.nodes[args[0]]
+		if !ok {
+			return redisprotocol.NewError("ERR Unknown node " + args[0])
+		}
+		if n == cs.myself {
+			return redisprotocol.NewError("ERR I tried hard but I can't forget myself...")
+		}
+		s.clusterForget(n)
+		return redisprotocol.NewString("OK")
+	}
+	return redisprotocol.NewError("ERR unknown subcommand '" + strings.ToLower(sub) + "'. Try CLUSTER HELP.")
+}
+
+// clusterMeet implements CLUSTER MEET ip port: it asks the node there for
+// its ID and, when the node is new to us, introduces us to it in turn.
+func (s *Server) clusterMeet(args []string, meetBack bool) redisprotocol.Value {
+	if len(args) != 2 {
+		return wrongArgs("CLUSTER|MEET")
+	}
+	port, err := strconv.Atoi(args[1])
+	if err != nil || port <= 0 || port > 65535 {
+		return redisprotocol.NewError("ERR Invalid node address specified: " + args[0] + ":" + args[1])
+	}
+	addr := net.JoinHostPort(args[0], args[1])
+	peer, err := dialPeer(addr, time.Second)
+	if err != nil {
+		return redisprotocol.NewError(fmt.Sprintf("ERR Can't reach %s: %v", addr, err))
+	}
+	defer peer.Close()
+	peer.SetDeadline(5 * time.Second)
+	reply, err := peer.Do("CLUSTER", "MYID")
+	if err != nil {
+		return redisprotocol.NewError("ERR " + err.Error())
+	}
+	id := reply.Bulk
+
+	s.kvstore.Lock()
+	cs := s.cluster
+	_, known := cs.nodes[id]
+	if id == cs.myself.id {
+		s.kvstore.Unlock()
+		return redisprotocol.NewString("OK")
+	}
+	if !known {
+		delete(cs.forgotten, id)
+		s.addClusterNode(id, args[0], port)
+	}
+	myIP, myPort := cs.myself.ip, cs.myself.port
+	s.kvstore.Unlock()
+
+	if !known && meetBack {
+		if _, err := peer.Do("CLUSTER", "MEET", myIP, strconv.Itoa(myPort)); err != nil {
+			fmt.Println("Error introducing this node to", addr+":", err)
+		}
+	}
+	return redisprotocol.NewString("OK")
+}
+
+// addClusterNode records a node learned about. The caller must hold the
+// store lock.
+func (s *Server) addClusterNode(id, ip string, port int) {
+	cs := s.cluster
+	cs.nodes[id] = &clusterNode{id: id, ip: ip, port: port, lastPong: time.Now()}
+	fmt.Printf("Cluster node %s added at %s:%d\n", id, ip, port)
+	cs.saveConfig()
+}
+
+// clusterForget removes a node and the slots it serves. The caller must
+// hold the store lock.
+func (s *Server) clusterForget(n *clusterNode) {
+	cs := s.cluster
+	delete(cs.nodes, n.id)
+	cs.forgotten[n.id] = time.Now()
+	for slot, owner := range cs.slots {
+		if owner == n {
+			cs.slots[slot] = nil
+		}
+	}
+	for slot, other := range cs.migrating {
+		if other == n {
+			delete(cs.migrating, slot)
+		}
+	}
+	for slot, other := range cs.importing {
+		if other == n {
+			delete(cs.importing, slot)
+		}
+	}
+	cs.saveConfig()
+}
+
+// clusterChangeSlots implements ADDSLOTS, DELSLOTS and their RANGE forms.
+// The caller must hold the store lock.
+func (s *Server) clusterChangeSlots(sub string, args []string) redisprotocol.Value {
+	cs := s.cluster
+	ranged := strings.HasSuffix(sub, "RANGE")
+	if len(args) == 0 || ranged && len(args)%2 != 0 {
+		return wrongArgs("CLUSTER|" + sub)
+	}
+	var slots []int
+	if ranged {
+		for i := 0; i < len(args); i += 2 {
+			first, err1 := parseSlot(args[i])
+			last, err2 := parseSlot(args[i+1])
+			if err1 != nil || err2 != nil {
+				return redisprotocol.NewError("ERR Invalid or out of range slot")
+			}
+			if first > last {
+				return redisprotocol.NewError(fmt.Sprintf("ERR start slot number %d is greater than end slot number %d", first, last))
+			}
+			for slot := first; slot <= last; slot++ {
+				slots = append(slots, slot)
+			}
+		}
+	} else {
+		for _, arg := range args {
+			slot, err := parseSlot(arg)
+			if err != nil {
+				return redisprotocol.NewError("ERR Invalid or out of range slot")
+			}
+			slots = append(slots, slot)
+		}
+	}
+
+	adding := strings.HasPrefix(sub, "ADD")
+	seen := make(map[int]bool, len(slots))
+	for _, slot := range slots {
+		if seen[slot] {
+			return redisprotocol.NewError(fmt.Sprintf("ERR Slot %d specified multiple times", slot))
+		}
+		seen[slot] = true
+		if adding && cs.slots[slot] != nil {
+			return redisprotocol.NewError(fmt.Sprintf("ERR Slot %d is already busy", slot))
+		}
+		if !adding && cs.slots[slot] == nil {
+			return redisprotocol.NewError(fmt.Sprintf("ERR Slot %d is already unassigned", slot))
+		}
+	}
+	for _, slot := range slots {
+		if adding {
+			cs.slots[slot] = cs.myself
+			delete(cs.importing, slot)
+		} else {
+			cs.slots[slot] = nil
+		}
+	}
+	cs.saveConfig()
+	return redisprotocol.NewString("OK")
+}
+
+// clusterSetSlot implements CLUSTER SETSLOT slot MIGRATING|IMPORTING|NODE
+// node-id and CLUSTER SETSLOT slot STABLE. The caller must hold the store
+// lock.
+func (s *Server) clusterSetSlot(args []string) redisprotocol.Value {
+	cs := s.cluster
+	if len(args) < 2 {
+		return wrongArgs("CLUSTER|SETSLOT")
+	}
+	slot, err := parseSlot(args[0])
+	if err != nil {
+		return redisprotocol.NewError("ERR Invalid or out of range slot")
+	}
+	action := strings.ToUpper(args[1])
+	if action == "STABLE" {
+		delete(cs.migrating, slot)
+		delete(cs.importing, slot)
+		cs.saveConfig()
+		return redisprotocol.NewString("OK")
+	}
+	if len(args) != 3 {
+		return redisprotocol.NewError("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	n, ok := cs.nodes[args[2]]
+	if !ok {
+		return redisprotocol.NewError("ERR I don't know about node " + args[2])
+	}
+	switch action {
+	case "MIGRATING":
+		if cs.slots[slot] != cs.myself {
+			return redisprotocol.NewError(fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot))
+		}
+		if n == cs.myself {
+			return redisprotocol.NewError("ERR I can't migrate a slot to myself")
+		}
+		cs.migrating[slot] = n
+	case "IMPORTING":
+		if cs.slots[slot] == cs.myself {
+			return redisprotocol.NewError(fmt.Sprintf("ERR I'm already the owner of hash slot %d", slot))
+		}
+		if n == cs.myself {
+			return redisprotocol.NewError("ERR I can't import a slot from myself")
+		}
+		cs.importing[slot] = n
+	case "NODE":
+		if cs.slots[slot] == cs.myself && n != cs.myself && s.countKeysInSlot(slot) > 0 {
+			return redisprotocol.NewError(fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+		}
+		cs.slots[slot] = n
+		delete(cs.migrating, slot)
+		if n == cs.myself {
+			delete(cs.importing, slot)
+		}
+	default:
+		return redisprotocol.NewError("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	cs.saveConfig()
+	return redisprotocol.NewString("OK")
+}
+
+// countKeysInSlot counts the live keys hashing to slot. The caller must hold
+// the store lock.
+func (s *Server) countKeysInSlot(slot int) int {
+	n := 0
+	for key := range s.kvstore.Keys {
+		if keyHashSlot(key) == slot && !s.kvstore.isExpired(key) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) clusterInfo() string {
+	cs := s.cluster
+	assigned, failing := 0, 0
+	masters := make(map[*clusterNode]bool)
+	for _, n := range cs.slots {
+		if n == nil {
+			continue
+		}
+		assigned++
+		masters[n] = true
+		if n.failing {
+			failing++
+		}
+	}
+	state := "fail"
+	if cs.ok() {
+		state = "ok"
+	}
+	info := fmt.Sprintf("cluster_state:%s\r\n", state)
+	info += fmt.Sprintf("cluster_slots_assigned:%d\r\n", assigned)
+	info += fmt.Sprintf("cluster_slots_ok:%d\r\n", assigned-failing)
+	info += "cluster_slots_pfail:0\r\n"
+	info += fmt.Sprintf("cluster_slots_fail:%d\r\n", failing)
+	info += fmt.Sprintf("cluster_known_nodes:%d\r\n", len(cs.nodes))
+	info += fmt.Sprintf("cluster_size:%d\r\n", len(masters))
+	info += "cluster_current_epoch:0\r\n"
+	info += "cluster_my_epoch:0\r\n"
+	return info
+}
+
+// clusterSlotsReply builds the CLUSTER SLOTS reply: one entry per range of
+// consecutive slots served by the same node.
+func (s *Server) clusterSlotsReply() redisprotocol.Value {
+	cs := s.cluster
+	var entries []redisprotocol.Value
+	for slot := 0; slot < clusterSlots; {
+		n := cs.slots[slot]
+		first := slot
+		for slot < clusterSlots && cs.slots[slot] == n {
+			slot++
+		}
+		if n == nil {
+			continue
+		}
+		entries = append(entries, redisprotocol.NewArray([]redisprotocol.Value{
+			redisprotocol.NewInteger(first),
+			redisprotocol.NewInteger(slot - 1),
+			redisprotocol.NewArray([]redisprotocol.Value{
+				redisprotocol.NewBulk(n.ip),
+				redisprotocol.NewInteger(n.port),
+				redisprotocol.NewBulk(n.id),
+			}),
+		}))
+	}
+	return redisprotocol.NewArray(entries)
+}
+
+// clusterShardsReply builds the CLUSTER SHARDS reply. Every node is a shard
+// of its own since there are no cluster replicas.
+func (s *Server) clusterShardsReply() redisprotocol.Value {
+	cs := s.cluster
+	var shards []redisprotocol.Value
+	for _, n := range cs.sortedNodes() {
+		var slots []redisprotocol.Value
+		for _, r := range cs.nodeSlots(n) {
+			slots = append(slots, redisprotocol.NewInteger(r[0]), redisprotocol.NewInteger(r[1]))
+		}
+		health := "online"
+		if n.failing {
+			health = "failed"
+		}
+		offset := 0
+		if n == cs.myself {
+			offset = int(s.repl.offset)
+		}
+		node := redisprotocol.NewMap([]redisprotocol.Value{
+			redisprotocol.NewBulk("id"), redisprotocol.NewBulk(n.id),
+			redisprotocol.NewBulk("port"), redisprotocol.NewInteger(n.port),
+			redisprotocol.NewBulk("ip"), redisprotocol.NewBulk(n.ip),
+			redisprotocol.NewBulk("endpoint"), redisprotocol.NewBulk(n.ip),
+			redisprotocol.NewBulk("role"), redisprotocol.NewBulk("master"),
+			redisprotocol.NewBulk("replication-offset"), redisprotocol.NewInteger(offset),
+			redisprotocol.NewBulk("health"), redisprotocol.NewBulk(health),
+		})
+		shards = append(shards, redisprotocol.NewMap([]redisprotocol.Value{
+			redisprotocol.NewBulk("slots"), redisprotocol.NewArray(slots),
+			redisprotocol.NewBulk("nodes"), redisprotocol.NewArray([]redisprotocol.Value{node}),
+		}))
+	}
+	return redisprotocol.NewArray(shards)
+}
+
+// clusterCron polls the other nodes and flags those that stopped answering.
+func (s *Server) clusterCron() {
+	s.kvstore.Lock()
+	defer s.kvstore.Unlock()
+	cs := s.cluster
+	if cs == nil {
+		return
+	}
+	timeout := time.Duration(config.ClusterNodeTimeout) * time.Millisecond
+	for _, n := range cs.nodes {
+		if n == cs.myself {
+			continue
+		}
+		if failing := time.Since(n.lastPong) > timeout; failing != n.failing {
+			n.failing = failing
+			if failing {
+				fmt.Printf("Cluster node %s (%s) is failing\n", n.id, n.addr())
+			} else {
+				fmt.Printf("Cluster node %s (%s) is reachable again\n", n.id, n.addr())
+			}
+		}
+		if !n.polling && time.Since(n.lastPoll) >= clusterPollPeriod {
+			n.polling, n.lastPoll = true, time.Now()
+			go s.pollClusterNode(n, n.addr())
+		}
+	}
+	for id, when := range cs.forgotten {
+		if time.Since(when) > time.Minute {
+			delete(cs.forgotten, id)
+		}
+	}
+}
+
+// pollClusterNode asks a node for its view of the cluster and takes from
+// it the slots the node serves and the nodes we do not know yet.
+func (s *Server) pollClusterNode(n *clusterNode, addr string) {
+	lines, err := fetchClusterNodes(addr)
+
+	s.kvstore.Lock()
+	defer s.kvstore.Unlock()
+	n.polling = false
+	cs := s.cluster
+	if cs.nodes[n.id] != n {
+		// Forgotten meanwhile.
+		return
+	}
+	var self *clusterNodeLine
+	for i := range lines {
+		if lines[i].myself {
+			self = &lines[i]
+		}
+	}
+	if err != nil || self == nil || self.id != n.id {
+		n.linkUp = false
+		return
+	}
+	n.linkUp, n.lastPong = true, time.Now()
+
+	var claimed [clusterSlots]bool
+	for _, r := range self.slots {
+		for slot := r[0]; slot <= r[1]; slot++ {
+			claimed[slot] = true
+		}
+	}
+	for slot := range cs.slots {
+		switch {
+		case claimed[slot] && cs.slots[slot] != cs.myself:
+			// We keep the slots we serve: they only move on SETSLOT.
+			cs.slots[slot] = n
+		case !claimed[slot] && cs.slots[slot] == n:
+			cs.slots[slot] = nil
+		}
+	}
+	for _, l := range lines {
+		if _, known := cs.nodes[l.id]; known || l.myself {
+			continue
+		}
+		if _, forgotten := cs.forgotten[l.id]; forgotten {
+			continue
+		}
+		s.addClusterNode(l.id, l.ip, l.port)
+	}
+	cs.saveConfig()
+}
+
+func fetchClusterNodes(addr string) ([]clusterNodeLine, error) {
+	peer, err := dialPeer(addr, clusterPollPeriod)
+	if err != nil {
+		return nil, err
+	}
+	defer peer.Close()
+	peer.SetDeadline(clusterPollPeriod)
+	reply, err := peer.Do("CLUSTER", "NODES")
+	if err != nil {
+		return nil, err
+	}
+	return parseClusterNodes(reply.Bulk)
+}
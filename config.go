@@ -0,0 +1,229 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Config holds the server settings given on the command line.
+type Config struct {
+	Port string
+
+	AppendOnly       bool
+	AppendFilename   string
+	AppendFsync      string
+	AOFLoadTruncated bool
+
+	AutoAOFRewritePercentage int
+	AutoAOFRewriteMinSize    int64
+
+	// SavePoints trigger a background save once any of them is reached.
+	SavePoints []savePoint
+
+	// ReplicaOf is the "host port" of the master to replicate at startup.
+	ReplicaOf       string
+	ReplBacklogSize int64
+	ReplicaReadOnly bool
+
+	// ClusterEnabled shards the keyspace by hash slot, see cluster.go.
+	ClusterEnabled     bool
+	ClusterConfigFile  string
+	ClusterAnnounceIP  string
+	ClusterNodeTimeout int
+
+	// Sentinel runs a failover monitor instead of a data server, see
+	// sentinel.go.
+	Sentinel                bool
+	SentinelMonitor         sentinelMonitor
+	SentinelReplicas        []string
+	SentinelDownAfter       int
+	SentinelFailoverTimeout int
+	SentinelAnnounceIP      string
+}
+
+// sentinelMonitor is the master a sentinel watches and how many sentinels
+// must agree it is down before a failover.
+type sentinelMonitor struct {
+	Name   string
+	Host   string
+	Port   string
+	Quorum int
+}
+
+// savePoint asks for a snapshot once at least Changes writes happened and
+// Seconds have passed since the last save.
+type savePoint struct {
+	Seconds int
+	Changes int64
+}
+
+var config = Config{
+	Port: "6378",
+
+	AppendFilename:   "appendonly.aof",
+	AppendFsync:      fsyncEverySec,
+	AOFLoadTruncated: true,
+
+	AutoAOFRewritePercentage: 100,
+	AutoAOFRewriteMinSize:    64 << 20,
+
+	ReplBacklogSize: 1 << 20,
+	ReplicaReadOnly: true,
+
+	ClusterConfigFile:  "nodes.conf",
+	ClusterAnnounceIP:  "127.0.0.1",
+	ClusterNodeTimeout: 15000,
+
+	SentinelDownAfter:       30000,
+	SentinelFailoverTimeout: 180000,
+	SentinelAnnounceIP:      "127.0.0.1",
+}
+
+// sentinelPort is the default port in sentinel mode.
+const sentinelPort = "26379"
+
+// parseFlags fills config from the command line arguments.
+func parseFlags() error {
+	flag.StringVar(&config.Port, "port", config.Port, "TCP port to listen on")
+	flag.BoolVar(&config.AppendOnly, "appendonly", config.AppendOnly, "log every write command to the append-only file")
+	flag.StringVar(&config.AppendFilename, "appendfilename", config.AppendFilename, "name of the append-only file")
+	flag.StringVar(&config.AppendFsync, "appendfsync", config.AppendFsync, "when to fsync the append-only file: always, everysec or no")
+	flag.BoolVar(&config.AOFLoadTruncated, "aof-load-truncated", config.AOFLoadTruncated, "load an append-only file whose last command is incomplete, discarding that command")
+	flag.IntVar(&config.AutoAOFRewritePercentage, "auto-aof-rewrite-percentage", config.AutoAOFRewritePercentage, "rewrite the append-only file once it grows by this percentage since the last rewrite, 0 to disable")
+	minSize := flag.String("auto-aof-rewrite-min-size", "64mb", "smallest append-only file size that triggers an automatic rewrite")
+	save := flag.String("save", "3600 1 300 100 60 10000", `save points as "seconds changes" pairs, e.g. "900 1 300 10"; "" disables automatic snapshots`)
+	flag.StringVar(&config.ReplicaOf, "replicaof", config.ReplicaOf, `"host port" of a master to replicate`)
+	backlogSize := flag.String("repl-backlog-size", "1mb", "size of the replication backlog kept for partial resynchronization")
+	flag.BoolVar(&config.ReplicaReadOnly, "replica-read-only", config.ReplicaReadOnly, "reject writes from clients while running as a replica")
+	flag.BoolVar(&config.ClusterEnabled, "cluster-enabled", config.ClusterEnabled, "run as a cluster node serving a share of the hash slots")
+	flag.StringVar(&config.ClusterConfigFile, "cluster-config-file", config.ClusterConfigFile, "file where a cluster node keeps its view of the cluster")
+	flag.StringVar(&config.ClusterAnnounceIP, "cluster-announce-ip", config.ClusterAnnounceIP, "IP address other nodes and clients use to reach this node")
+	flag.IntVar(&config.ClusterNodeTimeout, "cluster-node-timeout", config.ClusterNodeTimeout, "milliseconds a node may be unreachable before it is considered failing")
+	flag.BoolVar(&config.Sentinel, "sentinel", config.Sentinel, "run as a sentinel monitoring a master and failing over to one of its replicas")
+	monitor := flag.String("sentinel-monitor", "", `"name host port quorum" of the master a sentinel monitors`)
+	replicas := flag.String("sentinel-replicas", "", `standby replicas a sentinel may promote, as "host:port host:port ..."`)
+	flag.IntVar(&config.SentinelDownAfter, "sentinel-down-after", config.SentinelDownAfter, "milliseconds without a valid PING reply before an instance is considered down")
+	flag.IntVar(&config.SentinelFailoverTimeout, "sentinel-failover-timeout", config.SentinelFailoverTimeout, "milliseconds to wait before retrying a failover of the same master")
+	flag.StringVar(&config.SentinelAnnounceIP, "sentinel-announce-ip", config.SentinelAnnounceIP, "IP address other sentinels use to reach this sentinel")
+	flag.Parse()
+
+	switch config.AppendFsync {
+	case fsyncAlways, fsyncEverySec, fsyncNo:
+	default:
+		return fmt.Errorf("invalid appendfsync policy %q", config.AppendFsync)
+	}
+	size, err := parseMemory(*minSize)
+	if err != nil {
+		return fmt.Errorf("invalid auto-aof-rewrite-min-size: %v", err)
+	}
+	config.AutoAOFRewriteMinSize = size
+
+	points, err := parseSavePoints(*save)
+	if err != nil {
+		return fmt.Errorf("invalid save points: %v", err)
+	}
+	config.SavePoints = points
+
+	if size, err = parseMemory(*backlogSize); err != nil || size < 1 {
+		return fmt.Errorf("invalid repl-backlog-size %q", *backlogSize)
+	}
+	config.ReplBacklogSize = size
+	if config.ReplicaOf != "" && len(strings.Fields(config.ReplicaOf)) != 2 {
+		return fmt.Errorf("invalid replicaof %q, expected \"host port\"", config.ReplicaOf)
+	}
+	if config.ClusterEnabled && config.ReplicaOf != "" {
+		return fmt.Errorf("replicaof is not supported in cluster mode")
+	}
+	if config.ClusterNodeTimeout < 1 {
+		return fmt.Errorf("invalid cluster-node-timeout %d", config.ClusterNodeTimeout)
+	}
+	if config.Sentinel {
+		return parseSentinelFlags(*monitor, *replicas)
+	}
+	return nil
+}
+
+// parseSentinelFlags checks the settings of sentinel mode, which listens on
+// port 26379 unless told otherwise.
+func parseSentinelFlags(monitor, replicas string) error {
+	fields := strings.Fields(monitor)
+	if len(fields) != 4 {
+		return fmt.Errorf("sentinel mode needs -sentinel-monitor \"name host port quorum\"")
+	}
+	quorum, err := strconv.Atoi(fields[3])
+	if err != nil || quorum < 1 {
+		return fmt.Errorf("invalid sentinel quorum %q", fields[3])
+	}
+	if _, err := strconv.Atoi(fields[2]); err != nil {
+		return fmt.Errorf("invalid sentinel master port %q", fields[2])
+	}
+	config.SentinelMonitor = sentinelMonitor{Name: fields[0], Host: fields[1], Port: fields[2], Quorum: quorum}
+	for _, addr := range strings.Fields(replicas) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid sentinel replica %q", addr)
+		}
+		config.SentinelReplicas = append(config.SentinelReplicas, addr)
+	}
+	if config.SentinelDownAfter < 1 || config.SentinelFailoverTimeout < 1 {
+		return fmt.Errorf("sentinel timeouts must be positive")
+	}
+	portSet := false
+	flag.Visit(func(f *flag.Flag) {
+		portSet = portSet || f.Name == "port"
+	})
+	if !portSet {
+		config.Port = sentinelPort
+	}
+	return nil
+}
+
+// parseSavePoints parses save points in the redis.conf form "900 1 300 10".
+func parseSavePoints(s string) ([]savePoint, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("%q is not a list of seconds and changes pairs", s)
+	}
+	var points []savePoint
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("invalid seconds %q", fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid number of changes %q", fields[i+1])
+		}
+		points = append(points, savePoint{Seconds: seconds, Changes: changes})
+	}
+	return points, nil
+}
+
+// memoryUnits are the size suffixes accepted by parseMemory.
+var memoryUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+	{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+	{"b", 1},
+}
+
+// parseMemory parses a size such as "64mb" the way redis.conf does.
+func parseMemory(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	scale := int64(1)
+	for _, unit := range memoryUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, scale = strings.TrimSuffix(s, unit.suffix), unit.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * scale, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// serverHz is how many times per second serverCron runs.
+const serverHz = 10
+
+// serverCron runs the periodic background tasks of the server.
+func (s *Server) serverCron() {
+	period := time.Second / serverHz
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.kvstore.activeExpireCycle(period * activeExpireCyclePercent / 100)
+		if s.aof != nil {
+			s.aof.cron()
+			s.autoRewriteAOF()
+		}
+		s.autoSave()
+		s.replicationCron()
+		s.clusterCron()
+	}
+}
+
+// autoRewriteAOF starts a background rewrite once the append-only file has
+// outgrown the auto-aof-rewrite thresholds.
+func (s *Server) autoRewriteAOF() {
+	if s.aofRewriting.Load() || !s.aof.rewriteNeeded(config.AutoAOFRewritePercentage, config.AutoAOFRewriteMinSize) {
+		return
+	}
+	s.kvstore.RLock()
+	defer s.kvstore.RUnlock()
+	if err := s.startAOFRewrite(); err == nil {
+		fmt.Printf("Starting automatic rewriting of append-only file on %d%% growth\n", config.AutoAOFRewritePercentage)
+	}
+}
+
+// autoSave starts a background save once one of the configured save points
+// is reached.
+func (s *Server) autoSave() {
+	if !persistence.SaveNeeded(config.SavePoints, s.kvstore.dirty.Load()) {
+		return
+	}
+	s.kvstore.RLock()
+	defer s.kvstore.RUnlock()
+	if err := persistence.Bgsave(s.kvstore); err == nil {
+		fmt.Printf("%d changes since the last save, background saving started\n", s.kvstore.dirty.Load())
+	}
+}
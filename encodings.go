@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+// Decoders for the compact encodings real Redis uses inside RDB files:
+// ziplist, listpack, intset, zipmap and LZF compressed strings. Integer
+// entries are returned in their decimal string form.
+
+var errCorruptEncoding = errors.New("corrupt encoded value")
+
+// lzfMaxExpansion bounds how many times larger than its compressed form LZF
+// data can expand: a three byte back reference copies at most 264 bytes.
+const lzfMaxExpansion = 88
+
+// lzfDecompress expands LZF compressed data into a buffer of outLen bytes.
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	if outLen < 0 || outLen > len(in)*lzfMaxExpansion {
+		return nil, errCorruptEncoding
+	}
+	out := make([]byte, 0, outLen)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < 1<<5 {
+			// Literal run of ctrl+1 bytes.
+			n := ctrl + 1
+			if ip+n > len(in) || len(out)+n > outLen {
+				return nil, errCorruptEncoding
+			}
+			out = append(out, in[ip:ip+n]...)
+			ip += n
+			continue
+		}
+		// Back reference of length+2 bytes.
+		length := ctrl >> 5
+		if length == 7 {
+			if ip >= len(in) {
+				return nil, errCorruptEncoding
+			}
+			length += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, errCorruptEncoding
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[ip]) - 1
+		ip++
+		length += 2
+		if ref < 0 || len(out)+length > outLen {
+			return nil, errCorruptEncoding
+		}
+		// The reference may overlap the bytes being written.
+		for i := 0; i < length; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out) != outLen {
+		return nil, errCorruptEncoding
+	}
+	return out, nil
+}
+
+// ziplistEntries decodes a ziplist.
+func ziplistEntries(zl []byte) ([]string, error) {
+	if len(zl) < 11 {
+		return nil, errCorruptEncoding
+	}
+	count := int(binary.LittleEndian.Uint16(zl[8:10]))
+	entries := make([]string, 0, count)
+	p := 10
+	for {
+		if p >= len(zl) {
+			return nil, errCorruptEncoding
+		}
+		if zl[p] == 0xFF {
+			return entries, nil
+		}
+		// Skip the length of the previous entry.
+		if zl[p] < 0xFE {
+			p++
+		} else {
+			p += 5
+		}
+		if p >= len(zl) {
+			return nil, errCorruptEncoding
+		}
+
+		enc := zl[p]
+		var entry string
+		switch {
+		case enc>>6 == 0:
+			entry, p = zlString(zl, p+1, int(enc&0x3F))
+		case enc>>6 == 1:
+			if p+1 >= len(zl) {
+				return nil, errCorruptEncoding
+			}
+			entry, p = zlString(zl, p+2, int(enc&0x3F)<<8|int(zl[p+1]))
+		case enc == 0x80:
+			if p+5 > len(zl) {
+				return nil, errCorruptEncoding
+			}
+			entry, p = zlString(zl, p+5, int(binary.BigEndian.Uint32(zl[p+1:])))
+		case enc == 0xC0:
+			entry, p = zlInt(zl, p+1, 2)
+		case enc == 0xD0:
+			entry, p = zlInt(zl, p+1, 4)
+		case enc == 0xE0:
+			entry, p = zlInt(zl, p+1, 8)
+		case enc == 0xF0:
+			entry, p = zlInt(zl, p+1, 3)
+		case enc == 0xFE:
+			entry, p = zlInt(zl, p+1, 1)
+		case enc >= 0xF1 && enc <= 0xFD:
+			// 4 bit immediate integer between 0 and 12.
+			entry, p = strconv.Itoa(int(enc&0x0F)-1), p+1
+		default:
+			return nil, errCorruptEncoding
+		}
+		if p < 0 {
+			return nil, errCorruptEncoding
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// zlString returns the n byte string at p and the offset just past it, or
+// a negative offset if it runs out of the buffer.
+func zlString(buf []byte, p, n int) (string, int) {
+	if p+n > len(buf) {
+		return "", -1
+	}
+	return string(buf[p : p+n]), p + n
+}
+
+// zlInt returns the little endian signed integer of size bytes at p and the
+// offset just past it, or a negative offset if it runs out of the buffer.
+func zlInt(buf []byte, p, size int) (string, int) {
+	if p+size > len(buf) {
+		return "", -1
+	}
+	return strconv.FormatInt(littleEndianInt(buf[p:p+size]), 10), p + size
+}
+
+// littleEndianInt sign-extends a little endian integer of 1 to 8 bytes.
+func littleEndianInt(b []byte) int64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	shift := 64 - 8*uint(len(b))
+	return int64(v<<shift) >> shift
+}
+
+// listpackEntries decodes a listpack.
+func listpackEntries(lp []byte) ([]string, error) {
+	if len(lp) < 7 {
+		return nil, errCorruptEncoding
+	}
+	count := int(binary.LittleEndian.Uint16(lp[4:6]))
+	entries := make([]string, 0, count)
+	p := 6
+	for {
+		if p >= len(lp) {
+			return nil, errCorruptEncoding
+		}
+		enc := lp[p]
+		if enc == 0xFF {
+			return entries, nil
+		}
+		var entry string
+		start := p
+		switch {
+		case enc>>7 == 0:
+			entry, p = strconv.Itoa(int(enc&0x7F)), p+1
+		case enc>>6 == 2:
+			entry, p = zlString(lp, p+1, int(enc&0x3F))
+		case enc>>5 == 6:
+			if p+1 >= len(lp) {
+				return nil, errCorruptEncoding
+			}
+			v := int(enc&0x1F)<<8 | int(lp[p+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			entry, p = strconv.Itoa(v), p+2
+		case enc>>4 == 0xE:
+			if p+1 >= len(lp) {
+				return nil, errCorruptEncoding
+			}
+			entry, p = zlString(lp, p+2, int(enc&0x0F)<<8|int(lp[p+1]))
+		case enc == 0xF0:
+			if p+5 > len(lp) {
+				return nil, errCorruptEncoding
+			}
+			entry, p = zlString(lp, p+5, int(binary.LittleEndian.Uint32(lp[p+1:])))
+		case enc == 0xF1:
+			entry, p = zlInt(lp, p+1, 2)
+		case enc == 0xF2:
+			entry, p = zlInt(lp, p+1, 3)
+		case enc == 0xF3:
+			entry, p = zlInt(lp, p+1, 4)
+		case enc == 0xF4:
+			entry, p = zlInt(lp, p+1, 8)
+		default:
+			return nil, errCorruptEncoding
+		}
+		if p < 0 {
+			return nil, errCorruptEncoding
+		}
+		// Skip the backlen, which holds the size of the entry so far.
+		p += listpackBacklenSize(p - start)
+		entries = append(entries, entry)
+	}
+}
+
+// listpackBacklenSize returns how many bytes encode an entry size of n.
+func listpackBacklenSize(n int) int {
+	switch {
+	case n < 1<<7:
+		return 1
+	case n < 1<<14:
+		return 2
+	case n < 1<<21:
+		return 3
+	case n < 1<<28:
+		return 4
+	}
+	return 5
+}
+
+// intsetEntries decodes an intset.
+func intsetEntries(is []byte) ([]string, error) {
+	if len(is) < 8 {
+		return nil, errCorruptEncoding
+	}
+	size := int(binary.LittleEndian.Uint32(is[0:4]))
+	count := int(binary.LittleEndian.Uint32(is[4:8]))
+	if size != 2 && size != 4 && size != 8 || 8+count*size > len(is) {
+		return nil, errCorruptEncoding
+	}
+	entries := make([]string, count)
+	for i := range entries {
+		entries[i] = strconv.FormatInt(littleEndianInt(is[8+i*size:8+(i+1)*size]), 10)
+	}
+	return entries, nil
+}
+
+// zipmapEntries decodes a zipmap into alternating keys and values.
+func zipmapEntries(zm []byte) ([]string, error) {
+	if len(zm) < 2 {
+		return nil, errCorruptEncoding
+	}
+	var entries []string
+	p := 1
+	readLen := func() (int, bool) {
+		if p >= len(zm) {
+			return 0, false
+		}
+		switch b := zm[p]; b {
+		case 254:
+			if p+5 > len(zm) {
+				return 0, false
+			}
+			n := int(binary.LittleEndian.Uint32(zm[p+1:]))
+			p += 5
+			return n, true
+		case 255:
+			return 0, false
+		default:
+			p++
+			return int(b), true
+		}
+	}
+	for p < len(zm) && zm[p] != 0xFF {
+		n, ok := readLen()
+		if !ok {
+			return nil, errCorruptEncoding
+		}
+		var key string
+		if key, p = zlString(zm, p, n); p < 0 {
+			return nil, errCorruptEncoding
+		}
+		if n, ok = readLen(); !ok || p >= len(zm) {
+			return nil, errCorruptEncoding
+		}
+		free := int(zm[p])
+		var value string
+		if value, p = zlString(zm, p+1, n); p < 0 {
+			return nil, errCorruptEncoding
+		}
+		p += free
+		entries = append(entries, key, value)
+	}
+	if p >= len(zm) {
+		return nil, errCorruptEncoding
+	}
+	return entries, nil
+}
+
+// pairsToHash builds a hash object from alternating fields and values.
+func pairsToHash(entries []string) (*Object, error) {
+	if len(entries)%2 != 0 {
+		return nil, fmt.Errorf("odd number of hash entries")
+	}
+	obj := newObject(TypeHash)
+	for i := 0; i < len(entries); i += 2 {
+		obj.Hash[entries[i]] = entries[i+1]
+	}
+	return obj, nil
+}
+
+// pairsToZSet builds a sorted set from alternating members and scores.
+func pairsToZSet(entries []string) (*Object, error) {
+	if len(entries)%2 != 0 {
+		return nil, fmt.Errorf("odd number of sorted set entries")
+	}
+	obj := newObject(TypeZSet)
+	for i := 0; i < len(entries); i += 2 {
+		score, err := redisprotocol.ParseDouble(entries[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid score %q", entries[i+1])
+		}
+		obj.ZSet[entries[i]] = score
+	}
+	return obj, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"time"
+)
+
+// Active expiration tuning, modelled on Redis' adaptive algorithm: each
+// cycle samples keys with a TTL and keeps going while more than a quarter
+// of the sample turned out to be expired, within a time budget.
+const (
+	activeExpireKeysPerLoop  = 20
+	activeExpireStalePercent = 25
+	activeExpireCyclePercent = 25 // share of each cron tick spent expiring keys
+)
+
+// isExpired reports whether key has a TTL that has already passed.
+func (kv *KeyValueStore) isExpired(key string) bool {
+	when, ok := kv.Expirations[key]
+	return ok && !time.Now().Before(when)
+}
+
+// expireIfNeeded deletes key if its TTL has passed and reports whether it did.
+// The caller must hold the write lock.
+func (kv *KeyValueStore) expireIfNeeded(key string) bool {
+	if kv.expireDisabled || !kv.isExpired(key) {
+		return false
+	}
+	kv.expire(key)
+	return true
+}
+
+// expire deletes a key whose TTL has passed.
+func (kv *KeyValueStore) expire(key string) {
+	delete(kv.Keys, key)
+	delete(kv.Expirations, key)
+	if kv.onExpire != nil {
+		kv.onExpire(key)
+	}
+}
+
+// activeExpireCycle samples keys with a TTL and deletes the expired ones,
+// repeating while the sample is mostly stale and the budget allows. The
+// store lock is taken per sample so clients are not starved.
+func (kv *KeyValueStore) activeExpireCycle(budget time.Duration) int {
+	start := time.Now()
+	total := 0
+	for {
+		kv.Lock()
+		if kv.expireDisabled {
+			kv.Unlock()
+			return total
+		}
+		sampled, expired := 0, 0
+		now := time.Now()
+		// Map iteration starts at a random position, which gives us the sample.
+		for key, when := range kv.Expirations {
+			if sampled == activeExpireKeysPerLoop {
+				break
+			}
+			sampled++
+			if !now.Before(when) {
+				kv.expire(key)
+				expired++
+			}
+		}
+		kv.Unlock()
+
+		total += expired
+		if sampled == 0 || expired*100/sampled <= activeExpireStalePercent {
+			return total
+		}
+		if time.Since(start) > budget {
+			return total
+		}
+	}
+}
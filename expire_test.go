@@ -0,0 +1,160 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+// TestExpireOptions runs EXPIRE with each flag against a key without a TTL
+// and a key expiring in 100 seconds.
+func TestExpireOptions(t *testing.T) {
+	tests := []struct {
+		argv    []string
+		hasTTL  bool
+		reply   int
+		wantTTL int // TTL afterwards, or a second less; -1 for none
+	}{
+		{[]string{"EXPIRE", "k", "50"}, false, 1, 50},
+		{[]string{"EXPIRE", "k", "50"}, true, 1, 50},
+		{[]string{"EXPIRE", "k", "50", "NX"}, false, 1, 50},
+		{[]string{"EXPIRE", "k", "50", "NX"}, true, 0, 100},
+		{[]string{"EXPIRE", "k", "50", "XX"}, false, 0, -1},
+		{[]string{"EXPIRE", "k", "50", "XX"}, true, 1, 50},
+		{[]string{"EXPIRE", "k", "200", "GT"}, true, 1, 200},
+		{[]string{"EXPIRE", "k", "50", "GT"}, true, 0, 100},
+		{[]string{"EXPIRE", "k", "50", "GT"}, false, 0, -1},
+		{[]string{"EXPIRE", "k", "50", "LT"}, true, 1, 50},
+		{[]string{"EXPIRE", "k", "200", "LT"}, true, 0, 100},
+		{[]string{"EXPIRE", "k", "50", "LT"}, false, 1, 50},
+		{[]string{"EXPIRE", "k", "50", "xx", "gt"}, true, 0, 100},
+		{[]string{"PEXPIRE", "k", "50000"}, false, 1, 50},
+		{[]string{"EXPIREAT", "k", strconv.FormatInt(time.Now().Unix()+50, 10)}, false, 1, 50},
+		{[]string{"PEXPIREAT", "k", strconv.FormatInt(time.Now().UnixMilli()+50000, 10)}, false, 1, 50},
+		{[]string{"PERSIST", "k"}, true, 1, -1},
+		{[]string{"PERSIST", "k"}, false, 0, -1},
+	}
+	for _, tt := range tests {
+		s := NewServer()
+		c := newTestClient(t)
+		checkReply(t, s, c, replyOK, "SET", "k", "v")
+		if tt.hasTTL {
+			checkReply(t, s, c, redisprotocol.NewInteger(1), "EXPIRE", "k", "100")
+		}
+		if got := s.processCommand(tt.argv, c); !reflect.DeepEqual(got, redisprotocol.NewInteger(tt.reply)) {
+			t.Errorf("%q with a TTL: %v = %+v, want %d", tt.argv, tt.hasTTL, got, tt.reply)
+		}
+		if got := s.processCommand([]string{"TTL", "k"}, c); got.Num < tt.wantTTL-1 || got.Num > tt.wantTTL || (tt.wantTTL == -1 && got.Num != -1) {
+			t.Errorf("TTL after %q with a TTL: %v = %+v, want %d", tt.argv, tt.hasTTL, got, tt.wantTTL)
+		}
+	}
+}
+
+func TestExpireErrors(t *testing.T) {
+	s := NewServer()
+	c := newTestClient(t)
+	checkReply(t, s, c, replyOK, "SET", "k", "v")
+	for _, tt := range []struct {
+		argv []string
+		err  string
+	}{
+		{[]string{"EXPIRE", "k", "x"}, "ERR value is not an integer or out of range"},
+		{[]string{"EXPIRE", "k", "9223372036854775807"}, "ERR invalid expire time in 'expire' command"},
+		{[]string{"EXPIRE", "k", "10", "NX", "XX"}, "ERR NX and XX, GT or LT options at the same time are not compatible"},
+		{[]string{"EXPIRE", "k", "10", "GT", "LT"}, "ERR GT and LT options at the same time are not compatible"},
+		{[]string{"EXPIRE", "k", "10", "BOGUS"}, "ERR Unsupported option BOGUS"},
+		{[]string{"SET", "k", "v", "EX", "0"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"SETEX", "k", "-1", "v"}, "ERR invalid expire time in 'setex' command"},
+	} {
+		checkReply(t, s, c, redisprotocol.NewError(tt.err), tt.argv...)
+	}
+	checkReply(t, s, c, redisprotocol.NewInteger(-1), "TTL", "k")
+}
+
+func TestTTL(t *testing.T) {
+	s := NewServer()
+	c := newTestClient(t)
+	at := time.Now().Add(time.Hour).UnixMilli()
+	checkReply(t, s, c, redisprotocol.NewInteger(-2), "TTL", "k")
+	checkReply(t, s, c, redisprotocol.NewInteger(-2), "PEXPIRETIME", "k")
+	checkReply(t, s, c, replyOK, "SET", "k", "v", "PXAT", strconv.FormatInt(at, 10))
+	checkReply(t, s, c, redisprotocol.NewInteger(3600), "TTL", "k")
+	checkReply(t, s, c, redisprotocol.NewInteger(int(at)), "PEXPIRETIME", "k")
+	checkReply(t, s, c, redisprotocol.NewInteger(int(at/1000)), "EXPIRETIME", "k")
+	if got := s.processCommand([]string{"PTTL", "k"}, c); got.Num <= 3599000 || got.Num > 3600000 {
+		t.Errorf("PTTL = %+v, want about 3600000", got)
+	}
+	// A plain SET clears the TTL, KEEPTTL keeps it.
+	checkReply(t, s, c, replyOK, "SET", "k", "w", "KEEPTTL")
+	checkReply(t, s, c, redisprotocol.NewInteger(int(at)), "PEXPIRETIME", "k")
+	checkReply(t, s, c, replyOK, "SET", "k", "w")
+	checkReply(t, s, c, redisprotocol.NewInteger(-1), "PEXPIRETIME", "k")
+}
+
+// TestLazyExpire checks that a key of every type is gone once its TTL has
+// passed, for reads and for writes, before active expiration removed it.
+func TestLazyExpire(t *testing.T) {
+	s := NewServer()
+	c := newTestClient(t)
+	checkReply(t, s, c, replyOK, "SET", "str", "v")
+	checkReply(t, s, c, redisprotocol.NewInteger(1), "RPUSH", "list", "a")
+	checkReply(t, s, c, redisprotocol.NewInteger(1), "HSET", "hash", "f", "v")
+	checkReply(t, s, c, redisprotocol.NewInteger(1), "SADD", "set", "m")
+	checkReply(t, s, c, redisprotocol.NewInteger(1), "ZADD", "zset", "1", "m")
+	for _, key := range []string{"str", "list", "hash", "set", "zset"} {
+		checkReply(t, s, c, redisprotocol.NewInteger(1), "PEXPIRE", key, "10")
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	checkReply(t, s, c, redisprotocol.NewNull(), "GET", "str")
+	checkReply(t, s, c, redisprotocol.NewInteger(0), "LLEN", "list")
+	checkReply(t, s, c, redisprotocol.NewNull(), "HGET", "hash", "f")
+	checkReply(t, s, c, redisprotocol.NewInteger(0), "SISMEMBER", "set", "m")
+	checkReply(t, s, c, redisprotocol.NewString("none"), "TYPE", "zset")
+	checkReply(t, s, c, redisprotocol.NewInteger(0), "EXISTS", "str", "list", "hash", "set", "zset")
+
+	// A write starts from an empty key, without the old TTL.
+	checkReply(t, s, c, redisprotocol.NewInteger(1), "RPUSH", "list", "b")
+	checkReply(t, s, c, redisprotocol.NewBulkArray([]string{"b"}), "LRANGE", "list", "0", "-1")
+	checkReply(t, s, c, redisprotocol.NewInteger(-1), "TTL", "list")
+}
+
+func TestActiveExpire(t *testing.T) {
+	kv := NewKeyValueStore()
+	var deleted []string
+	kv.onExpire = func(key string) { deleted = append(deleted, key) }
+	past, future := time.Now().Add(-time.Second), time.Now().Add(time.Hour)
+	for i := 0; i < 500; i++ {
+		key := "stale" + strconv.Itoa(i)
+		kv.Keys[key] = &Object{Type: TypeString}
+		kv.Expirations[key] = past
+	}
+	for i := 0; i < 10; i++ {
+		key := "live" + strconv.Itoa(i)
+		kv.Keys[key] = &Object{Type: TypeString}
+		kv.Expirations[key] = future
+	}
+	kv.Keys["persistent"] = &Object{Type: TypeString}
+
+	// The cycle keeps sampling while most of the sample is stale.
+	if n := kv.activeExpireCycle(time.Second); n != 500 {
+		t.Errorf("activeExpireCycle expired %d keys, want 500", n)
+	}
+	if len(kv.Keys) != 11 || len(kv.Expirations) != 10 || len(deleted) != 500 {
+		t.Errorf("%d keys and %d TTLs left after deleting %d, want 11, 10 and 500", len(kv.Keys), len(kv.Expirations), len(deleted))
+	}
+
+	// Replicas keep expired keys until their master deletes them.
+	kv.Keys["stale"] = &Object{Type: TypeString}
+	kv.Expirations["stale"] = past
+	kv.expireDisabled = true
+	if n := kv.activeExpireCycle(time.Second); n != 0 || kv.Keys["stale"] == nil {
+		t.Errorf("activeExpireCycle expired %d keys with expiration disabled", n)
+	}
+	if kv.lookup("stale") != nil {
+		t.Errorf("expired key is visible on a replica")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+// hashFields returns the fields of the hash at key for the read-only hash
+// commands, nil when the key does not exist.
+func (s *Server) hashFields(key string) (map[string]string, error) {
+	hash, err := s.kvstore.lookupType(key, TypeHash)
+	if err != nil || hash == nil {
+		return nil, err
+	}
+	return hash.Hash, nil
+}
+
+func (s *Server) handleHSetNX(args []string) redisprotocol.Value {
+	if len(args) != 3 {
+		return wrongArgs("HSETNX")
+	}
+	hash, err := s.kvstore.lookupOrCreate(args[0], TypeHash)
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	if _, exists := hash.Hash[args[1]]; exists {
+		return s.noChange(redisprotocol.NewInteger(0))
+	}
+	hash.Hash[args[1]] = args[2]
+	return redisprotocol.NewInteger(1)
+}
+
+func (s *Server) handleHIncrBy(args []string) redisprotocol.Value {
+	if len(args) != 3 {
+		return wrongArgs("HINCRBY")
+	}
+	delta, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return redisprotocol.NewError("ERR value is not an integer or out of range")
+	}
+	hash, err := s.kvstore.lookupOrCreate(args[0], TypeHash)
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	var value int64
+	if old, exists := hash.Hash[args[1]]; exists {
+		if value, err = strconv.ParseInt(old, 10, 64); err != nil {
+			return redisprotocol.NewError("ERR hash value is not an integer")
+		}
+	}
+	if (delta > 0 && value > math.MaxInt64-delta) || (delta < 0 && value < math.MinInt64-delta) {
+		return redisprotocol.NewError("ERR increment or decrement would overflow")
+	}
+	value += delta
+	hash.Hash[args[1]] = strconv.FormatInt(value, 10)
+	return redisprotocol.NewInteger(int(value))
+}
+
+func (s *Server) handleHIncrByFloat(args []string) redisprotocol.Value {
+	if len(args) != 3 {
+		return wrongArgs("HINCRBYFLOAT")
+	}
+	delta, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return redisprotocol.NewError("ERR value is not a valid float")
+	}
+	hash, err := s.kvstore.lookupOrCreate(args[0], TypeHash)
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	var value float64
+	if old, exists := hash.Hash[args[1]]; exists {
+		if value, err = strconv.ParseFloat(old, 64); err != nil {
+			return redisprotocol.NewError("ERR hash value is not a float")
+		}
+	}
+	value += delta
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		s.kvstore.deleteIfEmpty(args[0], hash)
+		return redisprotocol.NewError("ERR increment would produce NaN or Infinity")
+	}
+	// Like Redis, the result is stored without an exponent.
+	formatted := strconv.FormatFloat(value, 'f', -1, 64)
+	hash.Hash[args[1]] = formatted
+	return redisprotocol.NewBulk(formatted)
+}
+
+func (s *Server) handleHKeys(args []string) redisprotocol.Value {
+	if len(args) != 1 {
+		return wrongArgs("HKEYS")
+	}
+	fields, err := s.hashFields(args[0])
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	result := make([]redisprotocol.Value, 0, len(fields))
+	for field := range fields {
+		result = append(result, redisprotocol.NewBulk(field))
+	}
+	return redisprotocol.NewArray(result)
+}
+
+func (s *Server) handleHVals(args []string) redisprotocol.Value {
+	if len(args) != 1 {
+		return wrongArgs("HVALS")
+	}
+	fields, err := s.hashFields(args[0])
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	result := make([]redisprotocol.Value, 0, len(fields))
+	for _, value := range fields {
+		result = append(result, redisprotocol.NewBulk(value))
+	}
+	return redisprotocol.NewArray(result)
+}
+
+func (s *Server) handleHExists(args []string) redisprotocol.Value {
+	if len(args) != 2 {
+		return wrongArgs("HEXISTS")
+	}
+	fields, err := s.hashFields(args[0])
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	if _, exists := fields[args[1]]; exists {
+		return redisprotocol.NewInteger(1)
+	}
+	return redisprotocol.NewInteger(0)
+}
+
+func (s *Server) handleHStrLen(args []string) redisprotocol.Value {
+	if len(args) != 2 {
+		return wrongArgs("HSTRLEN")
+	}
+	fields, err := s.hashFields(args[0])
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	return redisprotocol.NewInteger(len(fields[args[1]]))
+}
+
+// hrandfieldMaxCount bounds the number of fields HRANDFIELD returns for a
+// negative count, which may repeat fields and so is not limited by the size
+// of the hash.
+const hrandfieldMaxCount = 1 << 20
+
+// handleHRandField implements HRANDFIELD key [count [WITHVALUES]]. Without a
+// count it replies with a single field. A positive count returns distinct
+// fields, at most the whole hash; a negative count returns exactly -count
+// fields, possibly repeated.
+func (s *Server) handleHRandField(args []string) redisprotocol.Value {
+	if len(args) < 1 || len(args) > 3 {
+		return wrongArgs("HRANDFIELD")
+	}
+	fields, err := s.hashFields(args[0])
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	if len(args) == 1 {
+		if len(names) == 0 {
+			return redisprotocol.NewNull()
+		}
+		return redisprotocol.NewBulk(names[rand.Intn(len(names))])
+	}
+
+	count, err := strconv.Atoi(args[1])
+	if err != nil {
+		return redisprotocol.NewError("ERR value is not an integer or out of range")
+	}
+	if count < -hrandfieldMaxCount {
+		return redisprotocol.NewError("ERR value is out of range")
+	}
+	withValues := false
+	if len(args) == 3 {
+		if !strings.EqualFold(args[2], "WITHVALUES") {
+			return redisprotocol.NewError("ERR syntax error")
+		}
+		withValues = true
+	}
+
+	var picked []string
+	switch {
+	case len(names) == 0:
+	case count >= 0:
+		rand.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+		picked = names[:min(count, len(names))]
+	default:
+		picked = make([]string, -count)
+		for i := range picked {
+			picked[i] = names[rand.Intn(len(names))]
+		}
+	}
+
+	result := make([]redisprotocol.Value, 0, len(picked)*2)
+	for _, field := range picked {
+		result = append(result, redisprotocol.NewBulk(field))
+		if withValues {
+			result = append(result, redisprotocol.NewBulk(fields[field]))
+		}
+	}
+	return redisprotocol.NewArray(result)
+}
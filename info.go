@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+// infoSection renders one section of the INFO reply. It runs with the store
+// read lock held.
+type infoSection struct {
+	name   string
+	render func(s *Server) string
+}
+
+// infoSections lists the INFO sections in the order they are printed.
+var infoSections = []infoSection{
+	{"server", (*Server).infoServer},
+	{"persistence", (*Server).infoPersistence},
+	{"replication", (*Server).infoReplication},
+	{"cluster", (*Server).infoCluster},
+	{"keyspace", (*Server).infoKeyspace},
+}
+
+// handleInfo replies with the requested sections, or all of them when no
+// section is given.
+func (s *Server) handleInfo(args []string) redisprotocol.Value {
+	wanted := make(map[string]bool)
+	for _, arg := range args {
+		wanted[strings.ToLower(arg)] = true
+	}
+	all := len(args) == 0 || wanted["all"] || wanted["default"] || wanted["everything"]
+
+	var sections []string
+	for _, section := range infoSections {
+		if all || wanted[section.name] {
+			title := strings.ToUpper(section.name[:1]) + section.name[1:]
+			sections = append(sections, "# "+title+"\r\n"+section.render(s))
+		}
+	}
+	return redisprotocol.NewVerbatim("txt", strings.Join(sections, "\r\n"))
+}
+
+func (s *Server) infoServer() string {
+	uptime := time.Since(s.startTime)
+	info := fmt.Sprintf("redis_version:%s\r\n", serverVersion)
+	info += fmt.Sprintf("process_id:%d\r\n", os.Getpid())
+	info += fmt.Sprintf("uptime_in_seconds:%d\r\n", int64(uptime.Seconds()))
+	info += fmt.Sprintf("uptime_in_days:%d\r\n", int64(uptime.Hours()/24))
+	info += fmt.Sprintf("hz:%d\r\n", serverHz)
+	return info
+}
+
+func (s *Server) infoPersistence() string {
+	status := persistence.Status()
+	info := "loading:0\r\n"
+	info += fmt.Sprintf("rdb_changes_since_last_save:%d\r\n", s.kvstore.dirty.Load())
+	info += fmt.Sprintf("rdb_bgsave_in_progress:%d\r\n", boolToInt(status.BgsaveInProgress))
+	info += fmt.Sprintf("rdb_last_save_time:%d\r\n", status.LastSave.Unix())
+	info += fmt.Sprintf("rdb_last_bgsave_status:%s\r\n", okOrErr(status.LastBgsaveOK))
+	info += fmt.Sprintf("rdb_last_bgsave_time_sec:%d\r\n", durationSeconds(status.LastBgsaveTime))
+	info += fmt.Sprintf("rdb_current_bgsave_time_sec:%d\r\n", durationSeconds(status.CurrentBgsaveTime))
+	info += fmt.Sprintf("aof_enabled:%d\r\n", boolToInt(s.aof != nil))
+	info += fmt.Sprintf("aof_rewrite_in_progress:%d\r\n", boolToInt(s.aofRewriting.Load()))
+	if s.aof != nil {
+		size, baseSize := s.aof.Sizes()
+		info += fmt.Sprintf("aof_current_size:%d\r\n", size)
+		info += fmt.Sprintf("aof_base_size:%d\r\n", baseSize)
+	}
+	return info
+}
+
+func (s *Server) infoReplication() string {
+	var info string
+	if link := s.repl.link; link != nil {
+		link.mu.Lock()
+		up, syncing, lastIO := link.up, link.syncing, link.lastIO
+		downSince := link.downSince
+		link.mu.Unlock()
+		info += "role:slave\r\n"
+		info += fmt.Sprintf("master_host:%s\r\n", link.host)
+		info += fmt.Sprintf("master_port:%s\r\n", link.port)
+		if up {
+			info += "master_link_status:up\r\n"
+		} else {
+			info += "master_link_status:down\r\n"
+		}
+		lastIOSeconds := -1
+		if !lastIO.IsZero() {
+			lastIOSeconds = int(time.Since(lastIO).Seconds())
+		}
+		info += fmt.Sprintf("master_last_io_seconds_ago:%d\r\n", lastIOSeconds)
+		info += fmt.Sprintf("master_sync_in_progress:%d\r\n", boolToInt(syncing))
+		info += fmt.Sprintf("slave_repl_offset:%d\r\n", s.repl.offset)
+		if !up {
+			info += fmt.Sprintf("master_link_down_since_seconds:%d\r\n", int(time.Since(downSince).Seconds()))
+		}
+		info += fmt.Sprintf("slave_read_only:%d\r\n", boolToInt(s.replicaReadOnly.Load()))
+	} else {
+		info += "role:master\r\n"
+	}
+
+	info += fmt.Sprintf("connected_slaves:%d\r\n", len(s.repl.replicas))
+	i := 0
+	for r := range s.repl.replicas {
+		ip, port := r.addr()
+		state := "wait_bgsave"
+		if r.online {
+			state = "online"
+		}
+		lag := -1
+		if !r.ackTime.IsZero() {
+			lag = int(time.Since(r.ackTime).Seconds())
+		}
+		info += fmt.Sprintf("slave%d:ip=%s,port=%s,state=%s,offset=%d,lag=%d\r\n", i, ip, port, state, r.ackOffset, lag)
+		i++
+	}
+	backlog := &s.repl.backlog
+	info += fmt.Sprintf("master_replid:%s\r\n", s.repl.replID)
+	if s.repl.replID2 != "" {
+		info += fmt.Sprintf("master_replid2:%s\r\n", s.repl.replID2)
+		info += fmt.Sprintf("second_repl_offset:%d\r\n", s.repl.secondOffset+1)
+	} else {
+		info += "master_replid2:0000000000000000000000000000000000000000\r\n"
+		info += "second_repl_offset:-1\r\n"
+	}
+	info += fmt.Sprintf("master_repl_offset:%d\r\n", s.repl.offset)
+	info += fmt.Sprintf("repl_backlog_active:%d\r\n", boolToInt(len(backlog.data) > 0))
+	info += fmt.Sprintf("repl_backlog_size:%d\r\n", backlog.size)
+	info += fmt.Sprintf("repl_backlog_first_byte_offset:%d\r\n", backlog.firstOffset())
+	info += fmt.Sprintf("repl_backlog_histlen:%d\r\n", len(backlog.data))
+	return info
+}
+
+func (s *Server) infoCluster() string {
+	return fmt.Sprintf("cluster_enabled:%d\r\n", boolToInt(s.cluster != nil))
+}
+
+func (s *Server) infoKeyspace() string {
+	counts := make(map[string]int)
+	expires := 0
+	for key, obj := range s.kvstore.Keys {
+		if s.kvstore.isExpired(key) {
+			continue
+		}
+		counts[obj.Type]++
+		if _, ok := s.kvstore.Expirations[key]; ok {
+			expires++
+		}
+	}
+	keys := 0
+	for _, n := range counts {
+		keys += n
+	}
+	if keys == 0 {
+		return ""
+	}
+
+	info := fmt.Sprintf("db0:keys=%d,expires=%d\r\n", keys, expires)
+	info += fmt.Sprintf("strings:%d\r\n", counts[TypeString])
+	info += fmt.Sprintf("lists:%d\r\n", counts[TypeList])
+	info += fmt.Sprintf("hashes:%d\r\n", counts[TypeHash])
+	info += fmt.Sprintf("sets:%d\r\n", counts[TypeSet])
+	info += fmt.Sprintf("sorted_sets:%d\r\n", counts[TypeZSet])
+	return info
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func okOrErr(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "err"
+}
+
+// durationSeconds formats a duration as INFO does, -1 meaning none.
+func durationSeconds(d time.Duration) int64 {
+	if d == 0 {
+		return -1
+	}
+	return int64(d.Seconds())
+}
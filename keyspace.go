@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Key types, as reported by the TYPE command.
+const (
+	TypeString = "string"
+	TypeList   = "list"
+	TypeHash   = "hash"
+	TypeSet    = "set"
+	TypeZSet   = "zset"
+)
+
+var errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// Object is the value stored under a key. Only the field matching Type is used.
+type Object struct {
+	Type string              `json:"type"`
+	Str  string              `json:"str,omitempty"`
+	List *quicklist          `json:"list,omitempty"`
+	Hash map[string]string   `json:"hash,omitempty"`
+	Set  map[string]struct{} `json:"set,omitempty"`
+	ZSet map[string]float64  `json:"zset,omitempty"`
+
+	// gen is the store generation the object was created in.
+	gen uint64
+}
+
+func newObject(typ string) *Object {
+	obj := &Object{Type: typ}
+	switch typ {
+	case TypeList:
+		obj.List = newQuicklist()
+	case TypeHash:
+		obj.Hash = make(map[string]string)
+	case TypeSet:
+		obj.Set = make(map[string]struct{})
+	case TypeZSet:
+		obj.ZSet = make(map[string]float64)
+	}
+	return obj
+}
+
+// Len returns the number of elements held by a container object.
+func (o *Object) Len() int {
+	switch o.Type {
+	case TypeList:
+		return o.List.Len()
+	case TypeHash:
+		return len(o.Hash)
+	case TypeSet:
+		return len(o.Set)
+	case TypeZSet:
+		return len(o.ZSet)
+	}
+	return 1
+}
+
+// The helpers below expect the caller to hold the store lock. Read helpers
+// only need the read lock and treat expired keys as missing; write helpers
+// need the write lock and delete expired keys on access.
+
+// lookup returns the object stored at key, or nil if the key does not exist
+// or has expired.
+func (kv *KeyValueStore) lookup(key string) *Object {
+	if kv.isExpired(key) {
+		return nil
+	}
+	return kv.Keys[key]
+}
+
+// lookupType returns the object stored at key if it has type typ. A missing
+// key returns nil, a key of another type returns errWrongType.
+func (kv *KeyValueStore) lookupType(key, typ string) (*Object, error) {
+	return checkType(kv.lookup(key), typ)
+}
+
+// lookupWrite is like lookupType but first deletes the key if it has expired,
+// so the returned object may be modified. An object shared with a snapshot
+// in progress is replaced by a private copy first.
+func (kv *KeyValueStore) lookupWrite(key, typ string) (*Object, error) {
+	kv.expireIfNeeded(key)
+	obj, err := checkType(kv.Keys[key], typ)
+	if obj != nil && kv.snapshots.Load() > 0 && obj.gen < kv.generation.Load() {
+		obj = obj.copy()
+		obj.gen = kv.generation.Load()
+		kv.Keys[key] = obj
+	}
+	return obj, err
+}
+
+// lookupOrCreate is like lookupWrite but creates an empty object of type typ
+// when the key does not exist.
+func (kv *KeyValueStore) lookupOrCreate(key, typ string) (*Object, error) {
+	obj, err := kv.lookupWrite(key, typ)
+	if err != nil || obj != nil {
+		return obj, err
+	}
+	obj = newObject(typ)
+	obj.gen = kv.generation.Load()
+	kv.Keys[key] = obj
+	return obj, nil
+}
+
+func checkType(obj *Object, typ string) (*Object, error) {
+	if obj == nil {
+		return nil, nil
+	}
+	if obj.Type != typ {
+		return nil, errWrongType
+	}
+	return obj, nil
+}
+
+// setString stores a string at key, replacing any existing value of any type
+// and discarding its TTL.
+func (kv *KeyValueStore) setString(key, value string) {
+	kv.Keys[key] = &Object{Type: TypeString, Str: value, gen: kv.generation.Load()}
+	delete(kv.Expirations, key)
+}
+
+// delete removes key and its expiration, reporting whether a live key existed.
+func (kv *KeyValueStore) delete(key string) bool {
+	if kv.expireIfNeeded(key) {
+		return false
+	}
+	if _, exists := kv.Keys[key]; !exists {
+		return false
+	}
+	delete(kv.Keys, key)
+	delete(kv.Expirations, key)
+	return true
+}
+
+// deleteIfEmpty removes a container key once its last element is gone.
+func (kv *KeyValueStore) deleteIfEmpty(key string, obj *Object) {
+	if obj != nil && obj.Type != TypeString && obj.Len() == 0 {
+		kv.delete(key)
+	}
+}
+
+// copy returns a deep copy of the object.
+func (o *Object) copy() *Object {
+	c := &Object{Type: o.Type, Str: o.Str}
+	switch o.Type {
+	case TypeList:
+		c.List = o.List.copy()
+	case TypeHash:
+		c.Hash = make(map[string]string, len(o.Hash))
+		for field, value := range o.Hash {
+			c.Hash[field] = value
+		}
+	case TypeSet:
+		c.Set = make(map[string]struct{}, len(o.Set))
+		for member := range o.Set {
+			c.Set[member] = struct{}{}
+		}
+	case TypeZSet:
+		c.ZSet = make(map[string]float64, len(o.ZSet))
+		for member, score := range o.ZSet {
+			c.ZSet[member] = score
+		}
+	}
+	return c
+}
+
+// snapshot returns a point-in-time view of the live keys and their
+// expirations that can be read without the store lock while writes go on.
+// Only the key maps are copied: the objects are shared until a writer
+// modifies one, which then copies it (see lookupWrite). The caller must hold
+// the store lock and call releaseSnapshot once done with the view.
+func (kv *KeyValueStore) snapshot() *KeyValueStore {
+	kv.generation.Add(1)
+	kv.snapshots.Add(1)
+	snap := &KeyValueStore{
+		Keys:        make(map[string]*Object, len(kv.Keys)),
+		Expirations: make(map[string]time.Time, len(kv.Expirations)),
+	}
+	for key, obj := range kv.Keys {
+		if kv.isExpired(key) {
+			continue
+		}
+		snap.Keys[key] = obj
+		if when, ok := kv.Expirations[key]; ok {
+			snap.Expirations[key] = when
+		}
+	}
+	return snap
+}
+
+// releaseSnapshot marks a view returned by snapshot as no longer in use.
+func (kv *KeyValueStore) releaseSnapshot() {
+	kv.snapshots.Add(-1)
+}
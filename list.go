@@ -0,0 +1,492 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+// listIndex converts a possibly negative index, counted from the tail when
+// negative, into a position in a list of n elements. The result may fall
+// outside the list.
+func listIndex(index, n int) int {
+	if index < 0 {
+		return n + index
+	}
+	return index
+}
+
+// listRange clamps start and stop the way LRANGE and LTRIM do and returns
+// the half-open range [from, to) they select, empty when from >= to.
+func listRange(start, stop, n int) (int, int) {
+	start, stop = listIndex(start, n), listIndex(stop, n)
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return start, stop + 1
+}
+
+// listPop implements LPOP and RPOP key [count]. Without count it replies
+// with the element, otherwise with an array of up to count elements.
+func (s *Server) listPop(cmd string, args []string, left bool) redisprotocol.Value {
+	if len(args) < 1 || len(args) > 2 {
+		return wrongArgs(cmd)
+	}
+	key := args[0]
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return redisprotocol.NewError("ERR value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	list, err := s.kvstore.lookupWrite(key, TypeList)
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	if list == nil {
+		if len(args) == 2 {
+			return s.noChange(redisprotocol.NewNullArray())
+		}
+		return s.noChange(redisprotocol.NewNull())
+	}
+	popped := make([]string, min(count, list.List.Len()))
+	for i := range popped {
+		if left {
+			popped[i] = list.List.PopFront()
+		} else {
+			popped[i] = list.List.PopBack()
+		}
+	}
+	if len(popped) == 0 {
+		return s.noChange(redisprotocol.NewBulkArray(popped))
+	}
+	s.kvstore.deleteIfEmpty(key, list)
+	if len(args) == 1 {
+		return redisprotocol.NewBulk(popped[0])
+	}
+	return redisprotocol.NewBulkArray(popped)
+}
+
+// pushExisting implements LPUSHX and RPUSHX, which only push to a list that
+// already exists.
+func (s *Server) pushExisting(cmd string, args []string, left bool) redisprotocol.Value {
+	if len(args) < 2 {
+		return wrongArgs(cmd)
+	}
+	list, err := s.kvstore.lookupWrite(args[0], TypeList)
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	if list == nil {
+		return s.noChange(redisprotocol.NewInteger(0))
+	}
+	for _, value := range args[1:] {
+		if left {
+			list.List.PushFront(value)
+		} else {
+			list.List.PushBack(value)
+		}
+	}
+	return redisprotocol.NewInteger(list.List.Len())
+}
+
+func (s *Server) handleLPushX(args []string) redisprotocol.Value {
+	return s.pushExisting("LPUSHX", args, true)
+}
+
+func (s *Server) handleRPushX(args []string) redisprotocol.Value {
+	return s.pushExisting("RPUSHX", args, false)
+}
+
+func (s *Server) handleLRange(args []string) redisprotocol.Value {
+	if len(args) != 3 {
+		return wrongArgs("LRANGE")
+	}
+	start, err1 := strconv.Atoi(args[1])
+	stop, err2 := strconv.Atoi(args[2])
+	if err1 != nil || err2 != nil {
+		return redisprotocol.NewError("ERR value is not an integer or out of range")
+	}
+	list, err := s.kvstore.lookupType(args[0], TypeList)
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	if list == nil {
+		return redisprotocol.NewBulkArray(nil)
+	}
+	from, to := listRange(start, stop, list.List.Len())
+	return redisprotocol.NewBulkArray(list.List.Range(from, to))
+}
+
+func (s *Server) handleLIndex(args []string) redisprotocol.Value {
+	if len(args) != 2 {
+		return wrongArgs("LINDEX")
+	}
+	index, err := strconv.Atoi(args[1])
+	if err != nil {
+		return redisprotocol.NewError("ERR value is not an integer or out of range")
+	}
+	list, err := s.kvstore.lookupType(args[0], TypeList)
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	if list == nil {
+		return redisprotocol.NewNull()
+	}
+	i := listIndex(index, list.List.Len())
+	if i < 0 || i >= list.List.Len() {
+		return redisprotocol.NewNull()
+	}
+	return redisprotocol.NewBulk(list.List.Index(i))
+}
+
+func (s *Server) handleLSet(args []string) redisprotocol.Value {
+	if len(args) != 3 {
+		return wrongArgs("LSET")
+	}
+	index, err := strconv.Atoi(args[1])
+	if err != nil {
+		return redisprotocol.NewError("ERR value is not an integer or out of range")
+	}
+	list, err := s.kvstore.lookupWrite(args[0], TypeList)
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	if list == nil {
+		return redisprotocol.NewError("ERR no such key")
+	}
+	i := listIndex(index, list.List.Len())
+	if i < 0 || i >= list.List.Len() {
+		return redisprotocol.NewError("ERR index out of range")
+	}
+	list.List.Set(i, args[2])
+	return redisprotocol.NewString("OK")
+}
+
+// handleLInsert implements LINSERT key BEFORE|AFTER pivot element. It
+// replies with the new length, 0 when the key does not exist and -1 when
+// the pivot is not found.
+func (s *Server) handleLInsert(args []string) redisprotocol.Value {
+	if len(args) != 4 {
+		return wrongArgs("LINSERT")
+	}
+	var after bool
+	switch strings.ToUpper(args[1]) {
+	case "BEFORE":
+	case "AFTER":
+		after = true
+	default:
+		return redisprotocol.NewError("ERR syntax error")
+	}
+	list, err := s.kvstore.lookupWrite(args[0], TypeList)
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	if list == nil {
+		return s.noChange(redisprotocol.NewInteger(0))
+	}
+	for i := 0; i < list.List.Len(); i++ {
+		if list.List.Index(i) != args[2] {
+			continue
+		}
+		if after {
+			i++
+		}
+		list.List.Insert(i, args[3])
+		return redisprotocol.NewInteger(list.List.Len())
+	}
+	return s.noChange(redisprotocol.NewInteger(-1))
+}
+
+// handleLRem implements LREM key count element: count > 0 removes the first
+// count occurrences, count < 0 the last ones and 0 all of them.
+func (s *Server) handleLRem(args []string) redisprotocol.Value {
+	if len(args) != 3 {
+		return wrongArgs("LREM")
+	}
+	count, err := strconv.Atoi(args[1])
+	if err != nil {
+		return redisprotocol.NewError("ERR value is not an integer or out of range")
+	}
+	key, element := args[0], args[2]
+	list, err := s.kvstore.lookupWrite(key, TypeList)
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	if list == nil {
+		return s.noChange(redisprotocol.NewInteger(0))
+	}
+
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+	items := list.List.Slice()
+	n := len(items)
+	remove := make([]bool, n)
+	removed := 0
+	for j := 0; j < n && (limit == 0 || removed < limit); j++ {
+		i := j
+		if count < 0 {
+			i = n - 1 - j
+		}
+		if items[i] == element {
+			remove[i] = true
+			removed++
+		}
+	}
+	if removed == 0 {
+		return s.noChange(redisprotocol.NewInteger(0))
+	}
+	kept := items[:0]
+	for i, elem := range items {
+		if !remove[i] {
+			kept = append(kept, elem)
+		}
+	}
+	list.List.Reset(kept)
+	s.kvstore.deleteIfEmpty(key, list)
+	return redisprotocol.NewInteger(removed)
+}
+
+func (s *Server) handleLTrim(args []string) redisprotocol.Value {
+	if len(args) != 3 {
+		return wrongArgs("LTRIM")
+	}
+	start, err1 := strconv.Atoi(args[1])
+	stop, err2 := strconv.Atoi(args[2])
+	if err1 != nil || err2 != nil {
+		return redisprotocol.NewError("ERR value is not an integer or out of range")
+	}
+	key := args[0]
+	list, err := s.kvstore.lookupWrite(key, TypeList)
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	if list == nil {
+		return s.noChange(redisprotocol.NewString("OK"))
+	}
+	n := list.List.Len()
+	from, to := listRange(start, stop, n)
+	if from == 0 && to == n {
+		return s.noChange(redisprotocol.NewString("OK"))
+	}
+	list.List.Trim(from, to)
+	s.kvstore.deleteIfEmpty(key, list)
+	return redisprotocol.NewString("OK")
+}
+
+// handleLPos implements LPOS key element [RANK rank] [COUNT num-matches]
+// [MAXLEN len]. RANK picks the rank-th match, counting from the tail when
+// negative; COUNT returns up to that many matches (0 for all) as an array;
+// MAXLEN limits how many elements are compared (0 for all).
+func (s *Server) handleLPos(args []string) redisprotocol.Value {
+	if len(args) < 2 {
+		return wrongArgs("LPOS")
+	}
+	rank, count, maxLen := 1, -1, 0
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return redisprotocol.NewError("ERR syntax error")
+		}
+		n, err := strconv.Atoi(args[i+1])
+		if err != nil {
+			return redisprotocol.NewError("ERR value is not an integer or out of range")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "RANK":
+			if n == 0 {
+				return redisprotocol.NewError("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = n
+		case "COUNT":
+			if n < 0 {
+				return redisprotocol.NewError("ERR COUNT can't be negative")
+			}
+			count = n
+		case "MAXLEN":
+			if n < 0 {
+				return redisprotocol.NewError("ERR MAXLEN can't be negative")
+			}
+			maxLen = n
+		default:
+			return redisprotocol.NewError("ERR syntax error")
+		}
+	}
+
+	list, err := s.kvstore.lookupType(args[0], TypeList)
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	var matches []redisprotocol.Value
+	if list != nil {
+		n := list.List.Len()
+		skip := rank - 1
+		if rank < 0 {
+			skip = -rank - 1
+		}
+		for j := 0; j < n && (maxLen == 0 || j < maxLen); j++ {
+			i := j
+			if rank < 0 {
+				i = n - 1 - j
+			}
+			if list.List.Index(i) != args[1] {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			matches = append(matches, redisprotocol.NewInteger(i))
+			if count < 0 || (count > 0 && len(matches) == count) {
+				break
+			}
+		}
+	}
+	if count < 0 {
+		if len(matches) == 0 {
+			return redisprotocol.NewNull()
+		}
+		return matches[0]
+	}
+	return redisprotocol.NewArray(matches)
+}
+
+// listMove pops an element from the head (srcLeft) or tail of src and
+// pushes it to the head (dstLeft) or tail of dst, creating dst if needed.
+// src and dst may be the same list, which rotates it. It replies with the
+// element, or null when src does not exist.
+func (s *Server) listMove(src, dst string, srcLeft, dstLeft bool) redisprotocol.Value {
+	list, err := s.kvstore.lookupWrite(src, TypeList)
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	if list == nil {
+		return s.noChange(redisprotocol.NewNull())
+	}
+	target := list
+	if dst != src {
+		// The destination type is checked before anything is popped.
+		if target, err = s.kvstore.lookupWrite(dst, TypeList); err != nil {
+			return redisprotocol.NewError(err.Error())
+		}
+	}
+
+	var elem string
+	if srcLeft {
+		elem = list.List.PopFront()
+	} else {
+		elem = list.List.PopBack()
+	}
+	if target == nil {
+		target, _ = s.kvstore.lookupOrCreate(dst, TypeList)
+	}
+	if dstLeft {
+		target.List.PushFront(elem)
+	} else {
+		target.List.PushBack(elem)
+	}
+	s.kvstore.deleteIfEmpty(src, list)
+	return redisprotocol.NewBulk(elem)
+}
+
+// parseListEnd parses the LEFT|RIGHT argument of LMOVE and BLMOVE.
+func parseListEnd(arg string) (left bool, ok bool) {
+	switch strings.ToUpper(arg) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	}
+	return false, false
+}
+
+// handleLMove implements LMOVE source destination LEFT|RIGHT LEFT|RIGHT.
+func (s *Server) handleLMove(args []string) redisprotocol.Value {
+	if len(args) != 4 {
+		return wrongArgs("LMOVE")
+	}
+	srcLeft, ok1 := parseListEnd(args[2])
+	dstLeft, ok2 := parseListEnd(args[3])
+	if !ok1 || !ok2 {
+		return redisprotocol.NewError("ERR syntax error")
+	}
+	return s.listMove(args[0], args[1], srcLeft, dstLeft)
+}
+
+// handleRPopLPush implements RPOPLPUSH source destination, the same as
+// LMOVE source destination RIGHT LEFT.
+func (s *Server) handleRPopLPush(args []string) redisprotocol.Value {
+	if len(args) != 2 {
+		return wrongArgs("RPOPLPUSH")
+	}
+	return s.listMove(args[0], args[1], false, true)
+}
+
+// handleLMPop implements LMPOP numkeys key [key ...] LEFT|RIGHT [COUNT count].
+// It pops up to count elements (1 by default) from the first non-empty list
+// and replies with its name and the elements, or with a null array.
+func (s *Server) handleLMPop(args []string) redisprotocol.Value {
+	if len(args) < 3 {
+		return wrongArgs("LMPOP")
+	}
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return redisprotocol.NewError("ERR value is not an integer or out of range")
+	}
+	if numKeys < 1 {
+		return redisprotocol.NewError("ERR numkeys should be greater than 0")
+	}
+	if numKeys > len(args)-2 {
+		return redisprotocol.NewError("ERR Number of keys can't be greater than number of args")
+	}
+	keys, opts := args[1:1+numKeys], args[1+numKeys:]
+	left, ok := parseListEnd(opts[0])
+	if !ok {
+		return redisprotocol.NewError("ERR syntax error")
+	}
+	count := 1
+	switch {
+	case len(opts) == 1:
+	case len(opts) == 3 && strings.EqualFold(opts[1], "COUNT"):
+		if count, err = strconv.Atoi(opts[2]); err != nil || count < 1 {
+			return redisprotocol.NewError("ERR count should be greater than 0")
+		}
+	default:
+		return redisprotocol.NewError("ERR syntax error")
+	}
+
+	for _, key := range keys {
+		list, err := s.kvstore.lookupWrite(key, TypeList)
+		if err != nil {
+			return redisprotocol.NewError(err.Error())
+		}
+		if list == nil {
+			continue
+		}
+		popped := make([]string, min(count, list.List.Len()))
+		for i := range popped {
+			if left {
+				popped[i] = list.List.PopFront()
+			} else {
+				popped[i] = list.List.PopBack()
+			}
+		}
+		s.kvstore.deleteIfEmpty(key, list)
+		return redisprotocol.NewArray([]redisprotocol.Value{
+			redisprotocol.NewBulk(key),
+			redisprotocol.NewBulkArray(popped),
+		})
+	}
+	return s.noChange(redisprotocol.NewNullArray())
+}
@@ -1,421 +1,805 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"os"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
 )
 
+// KeyValueStore is a single keyspace; every key holds exactly one typed Object.
 type KeyValueStore struct {
-	Strings               map[string]string
-    Lists                 map[string][]string
-    Hashes                map[string]map[string]string
-    Sets                  map[string]map[string]struct{}
-    SortedSets            map[string]map[string]float64
+	Keys                  map[string]*Object
     Expirations           map[string]time.Time
 	sync.RWMutex
+	// generation counts the snapshots taken so far. Objects created before
+	// the current generation may be shared with a snapshot still being
+	// written while snapshots is non-zero, and are copied before they are
+	// modified.
+	generation atomic.Uint64
+	snapshots  atomic.Int32
+	// dirty counts the writes since the last successful save.
+	dirty atomic.Int64
+	// expireDisabled stops keys from being deleted when their TTL passes:
+	// replicas only hide them and wait for the master's DEL.
+	expireDisabled bool
+	// onExpire is called for every key deleted because its TTL passed.
+	onExpire func(key string)
 }
 
 func NewKeyValueStore() *KeyValueStore {
 	return &KeyValueStore{
-		Strings:               make(map[string]string),
-        Lists:                 make(map[string][]string),
-        Hashes:                make(map[string]map[string]string),
-        Sets:                  make(map[string]map[string]struct{}),
-        SortedSets:            make(map[string]map[string]float64),
+		Keys:                  make(map[string]*Object),
         Expirations:           make(map[string]time.Time),
 	}
 }
 
 var pubsub = NewPubSub()
 var persistence = NewPersistence("data.rdb")
-type CommandFunc func([]string) string
+type CommandFunc func([]string) redisprotocol.Value
+
+// Command flags
+const (
+	cmdWrite    = 1 << iota // modifies the keyspace; runs under the write lock
+	cmdReadonly             // only reads the keyspace
+	cmdBlocking             // may block the client until a key is ready, see blocking.go
+	cmdKeyCount             // argv[FirstKey-1] is the number of keys, as in LMPOP
+	cmdKeysOption           // an empty key means the keys follow a KEYS option, as in MIGRATE
+)
+
+// Command is an entry of the command table. FirstKey, LastKey and Step give
+// the positions of key arguments in the full command line (0 is the command
+// name); a negative LastKey counts from the end, and FirstKey 0 means the
+// command takes no keys.
+type Command struct {
+	Handler  CommandFunc
+	Flags    int
+	FirstKey int
+	LastKey  int
+	Step     int
+}
+
+// keys returns the key arguments of argv according to the command's key spec.
+func (cmd Command) keys(argv []string) []string {
+	if cmd.FirstKey == 0 || cmd.FirstKey >= len(argv) {
+		return nil
+	}
+	if cmd.Flags&cmdKeysOption != 0 && argv[cmd.FirstKey] == "" {
+		return migrateKeys(argv)
+	}
+	last := cmd.LastKey
+	if cmd.Flags&cmdKeyCount != 0 {
+		n, err := strconv.Atoi(argv[cmd.FirstKey-1])
+		if err != nil || n < 1 {
+			return nil
+		}
+		last = cmd.FirstKey + n - 1
+	} else if last < 0 {
+		last += len(argv)
+	}
+	if last >= len(argv) {
+		last = len(argv) - 1
+	}
+	var keys []string
+	for i := cmd.FirstKey; i <= last; i += cmd.Step {
+		keys = append(keys, argv[i])
+	}
+	return keys
+}
 
 type Server struct {
 	kvstore    *KeyValueStore
-	commands   map[string]CommandFunc
+	commands   map[string]Command
+	// watchedKeys maps each WATCHed key to the clients watching it.
+	// It is guarded by the kvstore lock.
+	watchedKeys map[string]map[*Client]struct{}
+	// aof is the append-only file, nil when appendonly is off.
+	aof *AOF
+	// inExec and execPropagated track whether the writes of the running
+	// EXEC have been wrapped in MULTI in the append-only file.
+	inExec         bool
+	execPropagated bool
+	startTime      time.Time
+	// aofRewriting is set while BGREWRITEAOF runs.
+	aofRewriting atomic.Bool
+	// repl is the replication state, see replication.go. It is guarded by
+	// the kvstore lock; replicaReadOnly mirrors whether clients' writes must
+	// be rejected, for checking without the lock.
+	repl            replicationState
+	replicaReadOnly atomic.Bool
+	// cluster is the cluster state, nil unless cluster mode is enabled. It
+	// is guarded by the kvstore lock.
+	cluster *clusterState
+	// blocked maps each key to the clients blocked on it, in arrival order,
+	// and readyKeys lists the keys written since they were last served.
+	// Both are guarded by the kvstore lock.
+	blocked   map[string][]*blockedClient
+	readyKeys []string
+	// unchanged is set by a write command that succeeded without modifying
+	// the keyspace, see noChange. It is guarded by the kvstore lock.
+	unchanged bool
 }
 
 func NewServer() *Server {
 	s := &Server{
 		kvstore:  NewKeyValueStore(),
-		commands: make(map[string]CommandFunc),
+		commands: make(map[string]Command),
+		watchedKeys: make(map[string]map[*Client]struct{}),
+		blocked: make(map[string][]*blockedClient),
+		startTime: time.Now(),
+		repl: newReplicationState(),
 	}
+	s.kvstore.onExpire = s.propagateExpire
 	s.registerCommands()
 	return s
 }
 
 func (s *Server) registerCommands() {
-    s.commands = map[string]CommandFunc{
-        "GET":    s.handleGet,
-        "SET":    s.handleSet,
-		"DEL":    s.handleDel,
-        "EXISTS": s.handleExists,
-        "INCR":   s.handleIncr,
-        "DECR":   s.handleDecr,
-        "INCRBY": s.handleIncrBy,
-        "DECRBY": s.handleDecrBy,
-		"MSET":   s.handleMSet,
-		"MGET":   s.handleMGet,
+    s.commands = map[string]Command{
+        "GET":    {s.handleGet, cmdReadonly, 1, 1, 1},
+        "SET":    {s.handleSet, cmdWrite, 1, 1, 1},
+        "SETNX":  {s.handleSetNX, cmdWrite, 1, 1, 1},
+        "SETEX":  {s.handleSetEX, cmdWrite, 1, 1, 1},
+        "PSETEX": {s.handlePSetEX, cmdWrite, 1, 1, 1},
+        "GETSET": {s.handleGetSet, cmdWrite, 1, 1, 1},
+        "GETDEL": {s.handleGetDel, cmdWrite, 1, 1, 1},
+        "GETEX":  {s.handleGetEx, cmdWrite, 1, 1, 1},
+		"DEL":    {s.handleDel, cmdWrite, 1, -1, 1},
+        "EXISTS": {s.handleExists, cmdReadonly, 1, -1, 1},
+        "INCR":   {s.handleIncr, cmdWrite, 1, 1, 1},
+        "DECR":   {s.handleDecr, cmdWrite, 1, 1, 1},
+        "INCRBY": {s.handleIncrBy, cmdWrite, 1, 1, 1},
+        "DECRBY": {s.handleDecrBy, cmdWrite, 1, 1, 1},
+		"MSET":   {s.handleMSet, cmdWrite, 1, -1, 2},
+		"MGET":   {s.handleMGet, cmdReadonly, 1, -1, 1},
         // Lists
-        "LPUSH":  s.handleLPush,
-        "LPOP":   s.handleLPop,
-        "LLEN":   s.handleLLen,
-        "RPUSH":  s.handleRPush,
-        "RPOP":   s.handleRPop,
+        "LPUSH":  {s.handleLPush, cmdWrite, 1, 1, 1},
+        "LPOP":   {s.handleLPop, cmdWrite, 1, 1, 1},
+        "LLEN":   {s.handleLLen, cmdReadonly, 1, 1, 1},
+        "RPUSH":  {s.handleRPush, cmdWrite, 1, 1, 1},
+        "RPOP":   {s.handleRPop, cmdWrite, 1, 1, 1},
+        "LPUSHX": {s.handleLPushX, cmdWrite, 1, 1, 1},
+        "RPUSHX": {s.handleRPushX, cmdWrite, 1, 1, 1},
+        "LRANGE": {s.handleLRange, cmdReadonly, 1, 1, 1},
+        "LINDEX": {s.handleLIndex, cmdReadonly, 1, 1, 1},
+        "LSET":   {s.handleLSet, cmdWrite, 1, 1, 1},
+        "LINSERT": {s.handleLInsert, cmdWrite, 1, 1, 1},
+        "LREM":   {s.handleLRem, cmdWrite, 1, 1, 1},
+        "LTRIM":  {s.handleLTrim, cmdWrite, 1, 1, 1},
+        "LPOS":   {s.handleLPos, cmdReadonly, 1, 1, 1},
+        "LMOVE":  {s.handleLMove, cmdWrite, 1, 2, 1},
+        "RPOPLPUSH": {s.handleRPopLPush, cmdWrite, 1, 2, 1},
+        "LMPOP":  {s.handleLMPop, cmdWrite | cmdKeyCount, 2, 0, 1},
+        "BLPOP":  {s.handleBLPop, cmdWrite | cmdBlocking, 1, -2, 1},
+        "BRPOP":  {s.handleBRPop, cmdWrite | cmdBlocking, 1, -2, 1},
+        "BLMOVE": {s.handleBLMove, cmdWrite | cmdBlocking, 1, 2, 1},
+        "BRPOPLPUSH": {s.handleBRPopLPush, cmdWrite | cmdBlocking, 1, 2, 1},
         // Hashes
-        "HSET":   s.handleHSet,
-        "HGET":   s.handleHGet,
-        "HDEL":   s.handleHDel,
-        "HLEN":   s.handleHLen,
-        "HMGET":  s.handleHMGet,
-        "HGETALL": s.handleHGetAll,
+        "HSET":   {s.handleHSet, cmdWrite, 1, 1, 1},
+        "HGET":   {s.handleHGet, cmdReadonly, 1, 1, 1},
+        "HDEL":   {s.handleHDel, cmdWrite, 1, 1, 1},
+        "HLEN":   {s.handleHLen, cmdReadonly, 1, 1, 1},
+        "HMGET":  {s.handleHMGet, cmdReadonly, 1, 1, 1},
+        "HGETALL": {s.handleHGetAll, cmdReadonly, 1, 1, 1},
+        "HSETNX": {s.handleHSetNX, cmdWrite, 1, 1, 1},
+        "HINCRBY": {s.handleHIncrBy, cmdWrite, 1, 1, 1},
+        "HINCRBYFLOAT": {s.handleHIncrByFloat, cmdWrite, 1, 1, 1},
+        "HKEYS":  {s.handleHKeys, cmdReadonly, 1, 1, 1},
+        "HVALS":  {s.handleHVals, cmdReadonly, 1, 1, 1},
+        "HEXISTS": {s.handleHExists, cmdReadonly, 1, 1, 1},
+        "HSTRLEN": {s.handleHStrLen, cmdReadonly, 1, 1, 1},
+        "HRANDFIELD": {s.handleHRandField, cmdReadonly, 1, 1, 1},
         // Sets
-        "SADD":   s.handleSAdd,
-        "SREM":   s.handleSRem,
-        "SMEMBERS": s.handleSMembers,
-        "SISMEMBER": s.handleSIsMember,
+        "SADD":   {s.handleSAdd, cmdWrite, 1, 1, 1},
+        "SREM":   {s.handleSRem, cmdWrite, 1, 1, 1},
+        "SMEMBERS": {s.handleSMembers, cmdReadonly, 1, 1, 1},
+        "SISMEMBER": {s.handleSIsMember, cmdReadonly, 1, 1, 1},
         // Sorted Sets
-        "ZADD":   s.handleZAdd,
-        "ZRANGE": s.handleZRange,
-        "ZREM":   s.handleZRem,
+        "ZADD":   {s.handleZAdd, cmdWrite, 1, 1, 1},
+        "ZRANGE": {s.handleZRange, cmdReadonly, 1, 1, 1},
+        "ZREM":   {s.handleZRem, cmdWrite, 1, 1, 1},
         // Server and connection commands
-        "EXPIRE": s.handleExpire,
-        "TTL": s.handleTTL,
-        "INFO": s.handleInfo,
-        "FLUSHALL": s.handleFlushAll,
-        "PING": s.handlePing,
+        "EXPIRE": {s.handleExpire, cmdWrite, 1, 1, 1},
+        "PEXPIRE": {s.handlePExpire, cmdWrite, 1, 1, 1},
+        "EXPIREAT": {s.handleExpireAt, cmdWrite, 1, 1, 1},
+        "PEXPIREAT": {s.handlePExpireAt, cmdWrite, 1, 1, 1},
+        "TTL": {s.handleTTL, cmdReadonly, 1, 1, 1},
+        "PTTL": {s.handlePTTL, cmdReadonly, 1, 1, 1},
+        "EXPIRETIME": {s.handleExpireTime, cmdReadonly, 1, 1, 1},
+        "PEXPIRETIME": {s.handlePExpireTime, cmdReadonly, 1, 1, 1},
+        "PERSIST": {s.handlePersist, cmdWrite, 1, 1, 1},
+        "TYPE": {s.handleType, cmdReadonly, 1, 1, 1},
+        "DUMP": {s.handleDump, cmdReadonly, 1, 1, 1},
+        "RESTORE": {s.handleRestore, cmdWrite, 1, 1, 1},
+        "MIGRATE": {s.handleMigrate, cmdWrite | cmdKeysOption, 3, 3, 1},
+        "RESTORE-ASKING": {s.handleRestore, cmdWrite, 1, 1, 1},
+        "INFO": {s.handleInfo, 0, 0, 0, 0},
+        "FLUSHALL": {s.handleFlushAll, cmdWrite, 0, 0, 0},
+        "PING": {s.handlePing, 0, 0, 0, 0},
+        "PUBLISH": {s.handlePublish, 0, 0, 0, 0},
         // Persistence commands
-        "SAVE": s.handleSave,
-        "BGSAVE": s.handleBgsave,
+        "SAVE": {s.handleSave, 0, 0, 0, 0},
+        "BGSAVE": {s.handleBgsave, 0, 0, 0, 0},
+        "BGREWRITEAOF": {s.handleBgrewriteaof, 0, 0, 0, 0},
+        "LASTSAVE": {s.handleLastsave, 0, 0, 0, 0},
         //TODO: More commands will be added here
     }
 }
 
-func (s *Server) handleCommandWithConn(cmd string, args []string, conn net.Conn) string {
+// connCommands are the commands that need the calling client's connection state.
+var connCommands = map[string]bool{
+    "SUBSCRIBE":   true,
+    "PUBLISH":     true,
+    "UNSUBSCRIBE": true,
+    "HELLO":       true,
+    "MULTI":       true,
+    "EXEC":        true,
+    "DISCARD":     true,
+    "WATCH":       true,
+    "UNWATCH":     true,
+    "REPLCONF":    true,
+    "PSYNC":       true,
+    "SYNC":        true,
+    "REPLICAOF":   true,
+    "SLAVEOF":     true,
+    "WAIT":        true,
+    "CLUSTER":     true,
+    "ASKING":      true,
+    "BLPOP":       true,
+    "BRPOP":       true,
+    "BLMOVE":      true,
+    "BRPOPLPUSH":  true,
+}
+
+// noReply is returned by handlers that already wrote their replies to the client.
+var noReply = redisprotocol.Value{}
+
+func (s *Server) handleCommandWithConn(cmd string, args []string, c *Client) redisprotocol.Value {
     switch cmd {
     case "SUBSCRIBE":
-        return s.handleSubscribe(args, conn)
+        return s.handleSubscribe(args, c)
+    case "UNSUBSCRIBE":
+        return s.handleUnsubscribe(args, c)
     case "PUBLISH":
+        // Run without the store lock, which a slow subscriber would
+        // otherwise hold up every writer on.
         return s.handlePublish(args)
-    case "UNSUBSCRIBE":
-        return s.handleUnsubscribe(args, conn)
+    case "HELLO":
+        return s.handleHello(args, c)
+    case "MULTI":
+        return s.handleMulti(args, c)
+    case "EXEC":
+        return s.handleExec(args, c)
+    case "DISCARD":
+        return s.handleDiscard(args, c)
+    case "WATCH":
+        return s.handleWatch(args, c)
+    case "UNWATCH":
+        return s.handleUnwatch(args, c)
+    case "REPLCONF":
+        return s.handleReplconf(args, c)
+    case "PSYNC":
+        if len(args) != 2 {
+            return wrongArgs("PSYNC")
+        }
+        return s.handlePsync(args, c)
+    case "SYNC":
+        return s.handlePsync(nil, c)
+    case "REPLICAOF", "SLAVEOF":
+        return s.handleReplicaof(args, c)
+    case "WAIT":
+        return s.handleWait(args, c)
+    case "CLUSTER":
+        return s.handleCluster(args, c)
+    case "ASKING":
+        return s.handleAsking(args, c)
+    case "BLPOP", "BRPOP", "BLMOVE", "BRPOPLPUSH":
+        return s.handleBlocking(append([]string{cmd}, args...), c)
     default:
-        return "ERR unknown command '" + cmd + "'"
+        return redisprotocol.NewError("ERR unknown command '" + cmd + "'")
     }
 }
 
-func (s *Server) handleGet(args []string) string {
+// wrongArgs builds the standard arity error for a command.
+func wrongArgs(cmd string) redisprotocol.Value {
+    return redisprotocol.NewError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
+
+func (s *Server) handleGet(args []string) redisprotocol.Value {
     if len(args) != 1 {
-		return "ERROR 'GET' command requires 1 argument"
+		return wrongArgs("GET")
 	}
 	key := args[0]
-	s.kvstore.RLock()
-	defer s.kvstore.RUnlock()
 
-	if value, ok := s.kvstore.Strings[key]; ok {
-		return value
+	obj, err := s.kvstore.lookupType(key, TypeString)
+	if err != nil {
+		return redisprotocol.NewError(err.Error())
 	}
-	return "(nil)"
+	if obj != nil {
+		return redisprotocol.NewBulk(obj.Str)
+	}
+	return redisprotocol.NewNull()
 }
 
-func (s *Server) handleSet(args []string) string {
-    if len(args) != 2 {
-        return "ERROR 'GET' command requires 2 arguments"
+// handleSet implements SET key value [NX|XX] [GET] [EX|PX|EXAT|PXAT time|KEEPTTL].
+func (s *Server) handleSet(args []string) redisprotocol.Value {
+    if len(args) < 2 {
+        return wrongArgs("SET")
     }
     key, value := args[0], args[1]
-    s.kvstore.Lock()
-	defer s.kvstore.Unlock()
 
-	s.kvstore.Strings[key] = value
-	return "OK"
+    var nx, xx, get, keepTTL, hasExpire bool
+    var expireAt time.Time
+    for i := 2; i < len(args); i++ {
+        opt := strings.ToUpper(args[i])
+        expireOpt, isExpireOpt := stringExpireOptions[opt]
+        switch {
+        case opt == "NX" && !xx:
+            nx = true
+        case opt == "XX" && !nx:
+            xx = true
+        case opt == "GET":
+            get = true
+        case opt == "KEEPTTL" && !hasExpire:
+            keepTTL = true
+        case isExpireOpt && !hasExpire && !keepTTL && i+1 < len(args):
+            when, err := parseExpireAt("SET", args[i+1], expireOpt)
+            if err != nil {
+                return redisprotocol.NewError(err.Error())
+            }
+            expireAt, hasExpire = when, true
+            i++
+        default:
+            return redisprotocol.NewError("ERR syntax error")
+        }
+    }
+
+    s.kvstore.expireIfNeeded(key)
+    old := s.kvstore.Keys[key]
+    if get && old != nil && old.Type != TypeString {
+        return redisprotocol.NewError(errWrongType.Error())
+    }
+    reply := redisprotocol.NewString("OK")
+    if get {
+        reply = redisprotocol.NewNull()
+        if old != nil {
+            reply = redisprotocol.NewBulk(old.Str)
+        }
+    }
+    if (nx && old != nil) || (xx && old == nil) {
+        if get {
+            return s.noChange(reply)
+        }
+        return s.noChange(redisprotocol.NewNull())
+    }
+
+    ttl, hadTTL := s.kvstore.Expirations[key]
+	s.kvstore.setString(key, value)
+    if hasExpire {
+        s.kvstore.Expirations[key] = expireAt
+    } else if keepTTL && hadTTL {
+        s.kvstore.Expirations[key] = ttl
+    }
+	return reply
+}
+
+// expireOption describes an EX, PX, EXAT or PXAT argument.
+type expireOption struct {
+    unit     time.Duration
+    absolute bool
+}
+
+var stringExpireOptions = map[string]expireOption{
+    "EX":   {time.Second, false},
+    "PX":   {time.Millisecond, false},
+    "EXAT": {time.Second, true},
+    "PXAT": {time.Millisecond, true},
+}
+
+// parseExpireAt turns the value of an expiry option into an absolute time.
+// The value must be a positive integer.
+func parseExpireAt(cmd, arg string, opt expireOption) (time.Time, error) {
+    amount, err := strconv.ParseInt(arg, 10, 64)
+    if err != nil {
+        return time.Time{}, errors.New("ERR value is not an integer or out of range")
+    }
+    base := int64(0)
+    if !opt.absolute {
+        base = time.Now().UnixMilli()
+    }
+    whenMs, ok := expireTimeMs(base, amount, opt.unit)
+    if amount <= 0 || !ok {
+        return time.Time{}, fmt.Errorf("ERR invalid expire time in '%s' command", strings.ToLower(cmd))
+    }
+    return time.UnixMilli(whenMs), nil
+}
+
+func (s *Server) handleSetNX(args []string) redisprotocol.Value {
+    if len(args) != 2 {
+        return wrongArgs("SETNX")
+    }
+
+    if s.kvstore.lookup(args[0]) != nil {
+        return s.noChange(redisprotocol.NewInteger(0))
+    }
+    s.kvstore.setString(args[0], args[1])
+    return redisprotocol.NewInteger(1)
+}
+
+func (s *Server) handleSetEX(args []string) redisprotocol.Value {
+    return s.setWithExpire("SETEX", args, time.Second)
+}
+
+func (s *Server) handlePSetEX(args []string) redisprotocol.Value {
+    return s.setWithExpire("PSETEX", args, time.Millisecond)
+}
+
+// setWithExpire implements SETEX and PSETEX: key ttl value.
+func (s *Server) setWithExpire(cmd string, args []string, unit time.Duration) redisprotocol.Value {
+    if len(args) != 3 {
+        return wrongArgs(cmd)
+    }
+    when, err := parseExpireAt(cmd, args[1], expireOption{unit: unit})
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+
+    s.kvstore.setString(args[0], args[2])
+    s.kvstore.Expirations[args[0]] = when
+    return redisprotocol.NewString("OK")
+}
+
+func (s *Server) handleGetSet(args []string) redisprotocol.Value {
+    if len(args) != 2 {
+        return wrongArgs("GETSET")
+    }
+
+    old, err := s.kvstore.lookupWrite(args[0], TypeString)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+    s.kvstore.setString(args[0], args[1])
+    if old == nil {
+        return redisprotocol.NewNull()
+    }
+    return redisprotocol.NewBulk(old.Str)
+}
+
+func (s *Server) handleGetDel(args []string) redisprotocol.Value {
+    if len(args) != 1 {
+        return wrongArgs("GETDEL")
+    }
+
+    obj, err := s.kvstore.lookupWrite(args[0], TypeString)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+    if obj == nil {
+        return s.noChange(redisprotocol.NewNull())
+    }
+    s.kvstore.delete(args[0])
+    return redisprotocol.NewBulk(obj.Str)
 }
 
-func (s *Server) handleDel(args []string) string {
+// handleGetEx implements GETEX key [EX|PX|EXAT|PXAT time|PERSIST].
+func (s *Server) handleGetEx(args []string) redisprotocol.Value {
     if len(args) < 1 {
-        return "ERROR 'DEL' command requires at least 1 argument"
+        return wrongArgs("GETEX")
+    }
+    key := args[0]
+
+    var persist, hasExpire bool
+    var expireAt time.Time
+    for i := 1; i < len(args); i++ {
+        opt := strings.ToUpper(args[i])
+        expireOpt, isExpireOpt := stringExpireOptions[opt]
+        switch {
+        case opt == "PERSIST" && !hasExpire:
+            persist = true
+        case isExpireOpt && !hasExpire && !persist && i+1 < len(args):
+            when, err := parseExpireAt("GETEX", args[i+1], expireOpt)
+            if err != nil {
+                return redisprotocol.NewError(err.Error())
+            }
+            expireAt, hasExpire = when, true
+            i++
+        default:
+            return redisprotocol.NewError("ERR syntax error")
+        }
+    }
+
+    obj, err := s.kvstore.lookupWrite(key, TypeString)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+    if obj == nil {
+        return s.noChange(redisprotocol.NewNull())
+    }
+    reply := redisprotocol.NewBulk(obj.Str)
+    if _, hasTTL := s.kvstore.Expirations[key]; persist && hasTTL {
+        delete(s.kvstore.Expirations, key)
+    } else if hasExpire {
+        s.kvstore.Expirations[key] = expireAt
+    } else {
+        return s.noChange(reply)
+    }
+    return reply
+}
+
+func (s *Server) handleDel(args []string) redisprotocol.Value {
+    if len(args) < 1 {
+        return wrongArgs("DEL")
     }
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
     deletedCount := 0
     for _, key := range args {
-        if _, exists := s.kvstore.Strings[key]; exists {
-            delete(s.kvstore.Strings, key)
+        if s.kvstore.delete(key) {
             deletedCount++
         }
     }
-    return fmt.Sprintf("(integer) %d", deletedCount)
+    if deletedCount == 0 {
+        return s.noChange(redisprotocol.NewInteger(0))
+    }
+    return redisprotocol.NewInteger(deletedCount)
 }
 
-func (s *Server) handleExists(args []string) string {
-    if len(args) != 1 {
-        return "ERROR 'EXISTS' command requires 1 argument"
+func (s *Server) handleExists(args []string) redisprotocol.Value {
+    if len(args) < 1 {
+        return wrongArgs("EXISTS")
     }
-    s.kvstore.RLock()
-    defer s.kvstore.RUnlock()
-    if _, exists := s.kvstore.Strings[args[0]]; exists {
-        return ":1"
+    count := 0
+    for _, key := range args {
+        if s.kvstore.lookup(key) != nil {
+            count++
+        }
     }
-    return ":0"
+    return redisprotocol.NewInteger(count)
 }
 
-func (s *Server) handleIncr(args []string) string {
-    return s.handleIncrDecr(args, 1)
+func (s *Server) handleIncr(args []string) redisprotocol.Value {
+    return s.handleIncrDecr("INCR", args, 1)
 }
 
-func (s *Server) handleDecr(args []string) string {
-    return s.handleIncrDecr(args, -1)
+func (s *Server) handleDecr(args []string) redisprotocol.Value {
+    return s.handleIncrDecr("DECR", args, -1)
 }
 
-func (s *Server) handleIncrDecr(args []string, delta int64) string {
+func (s *Server) handleIncrDecr(cmd string, args []string, delta int64) redisprotocol.Value {
     if len(args) != 1 {
-        return fmt.Sprintf("ERROR '%s' command requires 1 argument", strings.ToUpper(args[0]))
-    }
-    key := args[0]
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
-    value, exists := s.kvstore.Strings[key]
-    if !exists {
-        s.kvstore.Strings[key] = "0"
-        value = "0"
-    }
-    intValue, err := strconv.ParseInt(value, 10, 64)
-    if err != nil {
-        return "ERROR value is not an integer or out of range"
+        return wrongArgs(cmd)
     }
-    intValue += delta
-    s.kvstore.Strings[key] = strconv.FormatInt(intValue, 10)
-    return fmt.Sprintf("(integer) %d", intValue)
+    return s.incrementBy(args[0], delta)
 }
 
-func (s *Server) handleIncrBy(args []string) string {
-    return s.handleIncrDecrBy(args)
+func (s *Server) handleIncrBy(args []string) redisprotocol.Value {
+    return s.handleIncrDecrBy("INCRBY", args, 1)
 }
 
-func (s *Server) handleDecrBy(args []string) string {
-    return s.handleIncrDecrBy(args)
+func (s *Server) handleDecrBy(args []string) redisprotocol.Value {
+    return s.handleIncrDecrBy("DECRBY", args, -1)
 }
 
-func (s *Server) handleIncrDecrBy(args []string) string {
+func (s *Server) handleIncrDecrBy(cmd string, args []string, sign int64) redisprotocol.Value {
     if len(args) != 2 {
-        return fmt.Sprintf("ERROR '%s' command requires 2 arguments", strings.ToUpper(args[0]))
+        return wrongArgs(cmd)
     }
     key := args[0]
     delta, err := strconv.ParseInt(args[1], 10, 64)
     if err != nil {
-        return "ERROR increment/decrement value is not an integer"
+        return redisprotocol.NewError("ERR value is not an integer or out of range")
     }
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
-    value, exists := s.kvstore.Strings[key]
-    if !exists {
-        s.kvstore.Strings[key] = "0"
-        value = "0"
+    delta *= sign
+    return s.incrementBy(key, delta)
+}
+
+// incrementBy adds delta to the integer stored at key, creating it at 0 when missing.
+// The caller must hold the store lock.
+func (s *Server) incrementBy(key string, delta int64) redisprotocol.Value {
+    obj, err := s.kvstore.lookupWrite(key, TypeString)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+    value := "0"
+    if obj != nil {
+        value = obj.Str
     }
     intValue, err := strconv.ParseInt(value, 10, 64)
     if err != nil {
-        return "ERROR value is not an integer or out of range"
+        return redisprotocol.NewError("ERR value is not an integer or out of range")
     }
     intValue += delta
-    s.kvstore.Strings[key] = strconv.FormatInt(intValue, 10)
-    return fmt.Sprintf("(integer) %d", intValue)
+    if obj == nil {
+        s.kvstore.setString(key, strconv.FormatInt(intValue, 10))
+    } else {
+        obj.Str = strconv.FormatInt(intValue, 10)
+    }
+    return redisprotocol.NewInteger(int(intValue))
 }
 
-func (s *Server) handleMSet(args []string) string {
-    if len(args)%2 != 0 {
-        return "ERROR 'MSET' command requires an even number of arguments"
+func (s *Server) handleMSet(args []string) redisprotocol.Value {
+    if len(args) == 0 || len(args)%2 != 0 {
+        return wrongArgs("MSET")
     }
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
     for i := 0; i < len(args); i += 2 {
-        s.kvstore.Strings[args[i]] = args[i+1]
+        s.kvstore.setString(args[i], args[i+1])
     }
-    return "OK"
+    return redisprotocol.NewString("OK")
 }
 
-func (s *Server) handleMGet(args []string) string {
+func (s *Server) handleMGet(args []string) redisprotocol.Value {
     if len(args) < 1 {
-        return "ERROR 'MGET' command requires at least 1 argument"
+        return wrongArgs("MGET")
     }
-    s.kvstore.RLock()
-    defer s.kvstore.RUnlock()
-    results := make([]string, len(args))
+    results := make([]redisprotocol.Value, len(args))
     for i, key := range args {
-        if value, exists := s.kvstore.Strings[key]; exists {
-            results[i] = value
+        if obj, err := s.kvstore.lookupType(key, TypeString); err == nil && obj != nil {
+            results[i] = redisprotocol.NewBulk(obj.Str)
         } else {
-            results[i] = "(nil)"
+            results[i] = redisprotocol.NewNull()
         }
     }
-    return strings.Join(results, "\n")
+    return redisprotocol.NewArray(results)
 }
 
-func (s *Server) handleLPush(args []string) string {
+func (s *Server) handleLPush(args []string) redisprotocol.Value {
     if len(args) < 2 {
-        return "ERROR 'LPUSH' command requires at least 2 arguments"
+        return wrongArgs("LPUSH")
     }
     key := args[0]
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
     
     // Initialize the list if it doesn't exist
-    if _, exists := s.kvstore.Lists[key]; !exists {
-        s.kvstore.Lists[key] = make([]string, 0)
+    list, err := s.kvstore.lookupOrCreate(key, TypeList)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
     }
     // Prepend the new values to the list
     for _, value := range args[1:] {
-        s.kvstore.Lists[key] = append([]string{value}, s.kvstore.Lists[key]...)
+        list.List.PushFront(value)
     }
-    return fmt.Sprintf("(integer) %d", len(s.kvstore.Lists[key]))
+    return redisprotocol.NewInteger(list.List.Len())
 }
 
-func (s *Server) handleLPop(args []string) string {
-    if len(args) != 1 {
-        return "ERROR 'LPOP' command requires 1 argument"
-    }
-    key := args[0]
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
-
-    if list, exists := s.kvstore.Lists[key]; exists && len(list) > 0 {
-        poppedValue := list[0]
-        // Remove the first element
-        s.kvstore.Lists[key] = s.kvstore.Lists[key][1:]
-        return poppedValue
-    }
-    return "(nil)"
+func (s *Server) handleLPop(args []string) redisprotocol.Value {
+    return s.listPop("LPOP", args, true)
 }
 
-func (s *Server) handleLLen(args []string) string {
+func (s *Server) handleLLen(args []string) redisprotocol.Value {
     if len(args) != 1 {
-        return "ERROR 'LLEN' command requires 1 argument"
+        return wrongArgs("LLEN")
     }
     key := args[0]
-    s.kvstore.RLock()
-    defer s.kvstore.RUnlock()
 
-    if list, exists := s.kvstore.Lists[key]; exists {
-        return fmt.Sprintf("(integer) %d", len(list))
+    list, err := s.kvstore.lookupType(key, TypeList)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+    if list != nil {
+        return redisprotocol.NewInteger(list.List.Len())
     }
-    return "(integer) 0"
+    return redisprotocol.NewInteger(0)
 }
 
-func (s *Server) handleRPush(args []string) string {
+func (s *Server) handleRPush(args []string) redisprotocol.Value {
     if len(args) < 2 {
-        return "ERROR 'RPUSH' command requires at least 2 arguments"
+        return wrongArgs("RPUSH")
     }
     key := args[0]
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
 
     // Initialize the list if it doesn't exist
-    if _, exists := s.kvstore.Lists[key]; !exists {
-        s.kvstore.Lists[key] = make([]string, 0)
+    list, err := s.kvstore.lookupOrCreate(key, TypeList)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
     }
-    values := args[1:]
     // Append the new values to the list
-    s.kvstore.Lists[key] = append(s.kvstore.Lists[key], values...)
-    
-    return fmt.Sprintf("(integer) %d", len(s.kvstore.Lists[key]))
-}
-
-func (s *Server) handleRPop(args []string) string {
-    if len(args) != 1 {
-        return "ERROR 'RPOP' command requires 1 argument"
+    for _, value := range args[1:] {
+        list.List.PushBack(value)
     }
-    key := args[0]
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
+    return redisprotocol.NewInteger(list.List.Len())
+}
 
-    if value, exists := s.kvstore.Lists[key]; exists && len(value) > 0 {
-        poppedValue := value[len(value)-1] // Get the last element
-        // Remove the last element
-        s.kvstore.Lists[key] = value[:len(value)-1]
-        return poppedValue
-    }
-    return "(nil)"
+func (s *Server) handleRPop(args []string) redisprotocol.Value {
+    return s.listPop("RPOP", args, false)
 }
 
-func (s *Server) handleHSet(args []string) string {
+func (s *Server) handleHSet(args []string) redisprotocol.Value {
     if len(args) < 3 || len(args)%2 != 1 {
-        return "ERROR 'HSET' command requires at least 3 arguments with key-value pairs"
+        return wrongArgs("HSET")
     }
     key := args[0]
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
 
     // Initialize the hash if it doesn't exist
-    if _, exists := s.kvstore.Hashes[key]; !exists {
-        s.kvstore.Hashes[key] = make(map[string]string)
+    hash, err := s.kvstore.lookupOrCreate(key, TypeHash)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
     }
 
+    added := 0
     for i := 1; i < len(args)-1; i += 2 {
-        s.kvstore.Hashes[key][args[i]] = args[i+1]
+        if _, exists := hash.Hash[args[i]]; !exists {
+            added++
+        }
+        hash.Hash[args[i]] = args[i+1]
     }
 
-    return fmt.Sprintf("(integer) %d", len(s.kvstore.Hashes[key]))
+    return redisprotocol.NewInteger(added)
 }
 
-func (s *Server) handleHGet(args []string) string {
+func (s *Server) handleHGet(args []string) redisprotocol.Value {
     if len(args) != 2 {
-        return "ERROR 'HGET' command requires 2 arguments"
+        return wrongArgs("HGET")
     }
     key := args[0]
     field := args[1]
-    s.kvstore.RLock()
-    defer s.kvstore.RUnlock()
 
-    if value, exists := s.kvstore.Hashes[key][field]; exists {
-        return value
+    hash, err := s.kvstore.lookupType(key, TypeHash)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+    if hash != nil {
+        if value, exists := hash.Hash[field]; exists {
+            return redisprotocol.NewBulk(value)
+        }
     }
-    return "(nil)"
+    return redisprotocol.NewNull()
 }
 
-func (s *Server) handleHDel(args []string) string {
+func (s *Server) handleHDel(args []string) redisprotocol.Value {
     if len(args) < 2 {
-        return "ERROR 'HDEL' command requires at least 2 arguments"
+        return wrongArgs("HDEL")
     }
     key := args[0]
     fields := args[1:]
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
 
-    if _, exists := s.kvstore.Hashes[key]; !exists {
-        return "(integer) 0"
+    hash, err := s.kvstore.lookupWrite(key, TypeHash)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+    if hash == nil {
+        return s.noChange(redisprotocol.NewInteger(0))
     }
 
     count := 0
     for _, field := range fields {
-        if _, exists := s.kvstore.Hashes[key][field]; exists {
-            delete(s.kvstore.Hashes[key], field)
+        if _, exists := hash.Hash[field]; exists {
+            delete(hash.Hash, field)
             count++
         }
     }
+    s.kvstore.deleteIfEmpty(key, hash)
 
-    return fmt.Sprintf("(integer) %d", count)
+    if count == 0 {
+        return s.noChange(redisprotocol.NewInteger(0))
+    }
+    return redisprotocol.NewInteger(count)
 }
 
-func (s *Server) handleHLen(args []string) string {
+func (s *Server) handleHLen(args []string) redisprotocol.Value {
     if len(args) != 1 {
-        return "ERROR 'HLEN' command requires 1 argument"
+        return wrongArgs("HLEN")
     }
     key := args[0]
-    s.kvstore.RLock()
-    defer s.kvstore.RUnlock()
 
-    if fields, exists := s.kvstore.Hashes[key]; exists {
-        return fmt.Sprintf("(integer) %d", len(fields))
+    hash, err := s.kvstore.lookupType(key, TypeHash)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
     }
-    return "(integer) 0"
+    if hash != nil {
+        return redisprotocol.NewInteger(len(hash.Hash))
+    }
+    return redisprotocol.NewInteger(0)
 }
 
-// func (s *Server) handleHMGet(args []string) string {
+// func (s *Server) handleHMGet(args []string) redisprotocol.Value {
 //     if len(args) < 2 {
 //         return "ERROR 'HMGET' command requires at least 2 arguments"
 //     }
@@ -438,175 +822,200 @@ func (s *Server) handleHLen(args []string) string {
 //     return "(nil)"
 // }
 
-func (s *Server) handleHMGet(args []string) string {
+func (s *Server) handleHMGet(args []string) redisprotocol.Value {
     if len(args) < 2 {
-        return "ERROR 'HMGET' command requires at least 2 arguments"
+        return wrongArgs("HMGET")
     }
     key := args[0]
     fields := args[1:]
-    s.kvstore.RLock()
-    defer s.kvstore.RUnlock()
-
-    if values, exists := s.kvstore.Hashes[key]; exists {
-        var result []string
-        for i, field := range fields {
-            var value string
-            if val, fieldExists := values[field]; fieldExists {
-                value = fmt.Sprintf(`"%s"`, val)
-            } else {
-                value = "(nil)"
-            }
-            result = append(result, fmt.Sprintf("%d) %s", i+1, value))
+
+    hash, err := s.kvstore.lookupType(key, TypeHash)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+    var values map[string]string
+    if hash != nil {
+        values = hash.Hash
+    }
+    result := make([]redisprotocol.Value, len(fields))
+    for i, field := range fields {
+        if val, fieldExists := values[field]; fieldExists {
+            result[i] = redisprotocol.NewBulk(val)
+        } else {
+            result[i] = redisprotocol.NewNull()
         }
-        return strings.Join(result, "\n")
     }
-    return "(nil)"
+    return redisprotocol.NewArray(result)
 }
 
-func (s *Server) handleHGetAll(args []string) string {
+func (s *Server) handleHGetAll(args []string) redisprotocol.Value {
     if len(args) != 1 {
-        return "ERROR 'HGETALL' command requires 1 argument"
+        return wrongArgs("HGETALL")
     }
     key := args[0]
-    s.kvstore.RLock()
-    defer s.kvstore.RUnlock()
 
-    if fields, exists := s.kvstore.Hashes[key]; exists {
-        var result []string
-        index := 1
-        for field, value := range fields {
-            result = append(result, fmt.Sprintf("%d) \"%s\"", index, field))
-            index++
-            result = append(result, fmt.Sprintf("%d) \"%s\"", index, value))
-            index++
-        }
-        return strings.Join(result, "\n")
+    hash, err := s.kvstore.lookupType(key, TypeHash)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+    var fields map[string]string
+    if hash != nil {
+        fields = hash.Hash
     }
-    return "(empty)"
+    result := make([]redisprotocol.Value, 0, len(fields)*2)
+    for field, value := range fields {
+        result = append(result, redisprotocol.NewBulk(field), redisprotocol.NewBulk(value))
+    }
+    return redisprotocol.NewMap(result)
 }
 
-func (s *Server) handleSAdd(args []string) string {
+func (s *Server) handleSAdd(args []string) redisprotocol.Value {
     if len(args) < 2 {
-        return "ERROR 'SADD' command requires at least 2 arguments"
+        return wrongArgs("SADD")
     }
     key := args[0]
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
 
-    if _, exists := s.kvstore.Sets[key]; !exists {
-        s.kvstore.Sets[key] = make(map[string]struct{})
+    set, err := s.kvstore.lookupOrCreate(key, TypeSet)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
     }
 
     addedCount := 0
     for _, member := range args[1:] {
-        if _, exists := s.kvstore.Sets[key][member]; !exists {
-            s.kvstore.Sets[key][member] = struct{}{}
+        if _, exists := set.Set[member]; !exists {
+            set.Set[member] = struct{}{}
             addedCount++
         }
     }
-    return fmt.Sprintf("(integer) %d", addedCount)
+    if addedCount == 0 {
+        return s.noChange(redisprotocol.NewInteger(0))
+    }
+    return redisprotocol.NewInteger(addedCount)
 }
 
-func (s *Server) handleSRem(args []string) string {
+func (s *Server) handleSRem(args []string) redisprotocol.Value {
     if len(args) < 2 {
-        return "ERROR 'SREM' command requires at least 2 arguments"
+        return wrongArgs("SREM")
     }
     key := args[0]
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
 
-    if _, exists := s.kvstore.Sets[key]; !exists {
-        return "(integer) 0"
+    set, err := s.kvstore.lookupWrite(key, TypeSet)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+    if set == nil {
+        return s.noChange(redisprotocol.NewInteger(0))
     }
 
     removedCount := 0
     for _, member := range args[1:] {
-        if _, exists := s.kvstore.Sets[key][member]; exists {
-            delete(s.kvstore.Sets[key], member)
+        if _, exists := set.Set[member]; exists {
+            delete(set.Set, member)
             removedCount++
         }
     }
-    return fmt.Sprintf("(integer) %d", removedCount)
+    s.kvstore.deleteIfEmpty(key, set)
+    if removedCount == 0 {
+        return s.noChange(redisprotocol.NewInteger(0))
+    }
+    return redisprotocol.NewInteger(removedCount)
 }
 
-func (s *Server) handleSMembers(args []string) string {
+func (s *Server) handleSMembers(args []string) redisprotocol.Value {
     if len(args) != 1 {
-        return "ERROR 'SMEMBERS' command requires 1 argument"
+        return wrongArgs("SMEMBERS")
     }
     key := args[0]
-    s.kvstore.RLock()
-    defer s.kvstore.RUnlock()
 
-    if memberSet, exists := s.kvstore.Sets[key]; exists {
+    set, err := s.kvstore.lookupType(key, TypeSet)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+    if set != nil {
+        memberSet := set.Set
         result := make([]string, 0, len(memberSet))
         for member := range memberSet {
             result = append(result, member)
         }
         sort.Strings(result)  // Sort the slice
-        return strings.Join(result, "\n")
+        return redisprotocol.NewSet(redisprotocol.NewBulkArray(result).Array)
     }
-    return "(empty)"
+    return redisprotocol.NewSet(nil)
 }
 
-func (s *Server) handleSIsMember(args []string) string {
+func (s *Server) handleSIsMember(args []string) redisprotocol.Value {
     if len(args) != 2 {
-        return "ERROR 'SISMEMBER' command requires 2 arguments"
+        return wrongArgs("SISMEMBER")
     }
     key := args[0]
     member := args[1]
-    s.kvstore.RLock()
-    defer s.kvstore.RUnlock()
 
-    if set, exists := s.kvstore.Sets[key]; exists {
-        if _, exists := set[member]; exists {
-            return "(integer) 1"
+    set, err := s.kvstore.lookupType(key, TypeSet)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+    if set != nil {
+        if _, exists := set.Set[member]; exists {
+            return redisprotocol.NewInteger(1)
         }
     }
-    return "(integer) 0"
+    return redisprotocol.NewInteger(0)
 }
 
-func (s *Server) handleZAdd(args []string) string {
+func (s *Server) handleZAdd(args []string) redisprotocol.Value {
     if len(args) < 3 || len(args)%2 != 1 {
-        return "ERROR 'ZADD' command requires at least 3 arguments with score-member pairs"
+        return wrongArgs("ZADD")
     }
     key := args[0]
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
 
-    if _, exists := s.kvstore.SortedSets[key]; !exists {
-        s.kvstore.SortedSets[key] = make(map[string]float64)
-    }
-
-    addedCount := 0
+    scores := make([]float64, 0, len(args)/2)
     for i := 1; i < len(args)-1; i += 2 {
         score, err := strconv.ParseFloat(args[i], 64)
         if err != nil {
-            return "ERROR score is not a valid number"
+            return redisprotocol.NewError("ERR value is not a valid float")
         }
+        scores = append(scores, score)
+    }
+    zset, err := s.kvstore.lookupOrCreate(key, TypeZSet)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+
+    addedCount, changed := 0, false
+    for i := 1; i < len(args)-1; i += 2 {
         member := args[i+1]
-        if _, exists := s.kvstore.SortedSets[key][member]; !exists {
-            s.kvstore.SortedSets[key][member] = score
+        if old, exists := zset.ZSet[member]; !exists {
             addedCount++
+        } else if old == scores[i/2] {
+            continue
         }
+        zset.ZSet[member] = scores[i/2]
+        changed = true
+    }
+    if !changed {
+        return s.noChange(redisprotocol.NewInteger(0))
     }
-    return fmt.Sprintf("(integer) %d", addedCount)
+    return redisprotocol.NewInteger(addedCount)
 }
 
-func (s *Server) handleZRange(args []string) string {
+func (s *Server) handleZRange(args []string) redisprotocol.Value {
     if len(args) != 3 {
-        return "ERROR 'ZRANGE' command requires 3 arguments"
+        return wrongArgs("ZRANGE")
     }
     key := args[0]
     start, err1 := strconv.Atoi(args[1])
     end, err2 := strconv.Atoi(args[2])
-    s.kvstore.RLock()
-    defer s.kvstore.RUnlock()
 
     if err1 != nil || err2 != nil {
-        return "ERROR start or end is not a valid integer"
+        return redisprotocol.NewError("ERR value is not an integer or out of range")
     }
 
-    if sortedSet, exists := s.kvstore.SortedSets[key]; exists {
+    zset, err := s.kvstore.lookupType(key, TypeZSet)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+    if zset != nil {
+        sortedSet := zset.ZSet
         // Create a slice to hold the members
         var members []string
         for member := range sortedSet {
@@ -632,180 +1041,332 @@ func (s *Server) handleZRange(args []string) string {
             end = len(members) - 1
         }
         if start > end {
-            return "(empty)"
+            return redisprotocol.NewArray(nil)
         }
 
         // Prepare the result
         result := make([]string, 0, end-start+1)
         for i := start; i <= end; i++ {
-            result = append(result, fmt.Sprintf(`"%s"`, members[i]))
+            result = append(result, members[i])
         }
-        return strings.Join(result, "\n") // Return as separate lines
+        return redisprotocol.NewBulkArray(result)
     }
-    return "(empty)"
+    return redisprotocol.NewArray(nil)
 }
 
-func (s *Server) handleZRem(args []string) string {
+func (s *Server) handleZRem(args []string) redisprotocol.Value {
     if len(args) < 2 {
-        return "ERROR 'ZREM' command requires at least 2 arguments"
+        return wrongArgs("ZREM")
     }
     key := args[0]
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
 
-    if _, exists := s.kvstore.SortedSets[key]; !exists {
-        return "(integer) 0"
+    zset, err := s.kvstore.lookupWrite(key, TypeZSet)
+    if err != nil {
+        return redisprotocol.NewError(err.Error())
+    }
+    if zset == nil {
+        return s.noChange(redisprotocol.NewInteger(0))
     }
 
     removedCount := 0
     for _, member := range args[1:] {
-        if _, exists := s.kvstore.SortedSets[key][member]; exists {
-            delete(s.kvstore.SortedSets[key], member)
+        if _, exists := zset.ZSet[member]; exists {
+            delete(zset.ZSet, member)
             removedCount++
         }
     }
-    return fmt.Sprintf("(integer) %d", removedCount)
+    s.kvstore.deleteIfEmpty(key, zset)
+    if removedCount == 0 {
+        return s.noChange(redisprotocol.NewInteger(0))
+    }
+    return redisprotocol.NewInteger(removedCount)
 }
 
 
-func (s *Server) handleExpire(args []string) string {
-    if len(args) != 2 {
-        return "ERROR 'EXPIRE' command requires 2 arguments"
+func (s *Server) handleExpire(args []string) redisprotocol.Value {
+    return s.expireGeneric("EXPIRE", args, time.Second, false)
+}
+
+func (s *Server) handlePExpire(args []string) redisprotocol.Value {
+    return s.expireGeneric("PEXPIRE", args, time.Millisecond, false)
+}
+
+func (s *Server) handleExpireAt(args []string) redisprotocol.Value {
+    return s.expireGeneric("EXPIREAT", args, time.Second, true)
+}
+
+func (s *Server) handlePExpireAt(args []string) redisprotocol.Value {
+    return s.expireGeneric("PEXPIREAT", args, time.Millisecond, true)
+}
+
+// expireGeneric implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT with the
+// NX, XX, GT and LT flags. unit is the resolution of the time argument and
+// absolute tells whether it is a unix timestamp rather than a relative TTL.
+func (s *Server) expireGeneric(cmd string, args []string, unit time.Duration, absolute bool) redisprotocol.Value {
+    if len(args) < 2 {
+        return wrongArgs(cmd)
     }
     key := args[0]
-    seconds, err := strconv.ParseInt(args[1], 10, 64)
+    amount, err := strconv.ParseInt(args[1], 10, 64)
     if err != nil {
-        return "ERROR seconds must be a valid integer"
+        return redisprotocol.NewError("ERR value is not an integer or out of range")
+    }
+
+    var nx, xx, gt, lt bool
+    for _, opt := range args[2:] {
+        switch strings.ToUpper(opt) {
+        case "NX":
+            nx = true
+        case "XX":
+            xx = true
+        case "GT":
+            gt = true
+        case "LT":
+            lt = true
+        default:
+            return redisprotocol.NewError("ERR Unsupported option " + opt)
+        }
     }
-    
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
-    
-    if _, exists := s.kvstore.Strings[key]; exists {
-        s.kvstore.Expirations[key] = time.Now().Add(time.Duration(seconds) * time.Second) // Set expiration time
-        return "OK"
+    if nx && (xx || gt || lt) {
+        return redisprotocol.NewError("ERR NX and XX, GT or LT options at the same time are not compatible")
+    }
+    if gt && lt {
+        return redisprotocol.NewError("ERR GT and LT options at the same time are not compatible")
+    }
+
+    base := int64(0)
+    if !absolute {
+        base = time.Now().UnixMilli()
+    }
+    whenMs, ok := expireTimeMs(base, amount, unit)
+    if !ok {
+        return redisprotocol.NewError(fmt.Sprintf("ERR invalid expire time in '%s' command", strings.ToLower(cmd)))
+    }
+
+    s.kvstore.expireIfNeeded(key)
+    if s.kvstore.lookup(key) == nil {
+        return s.noChange(redisprotocol.NewInteger(0))
+    }
+
+    current, hasTTL := s.kvstore.Expirations[key]
+    switch {
+    case nx && hasTTL, xx && !hasTTL:
+        return s.noChange(redisprotocol.NewInteger(0))
+    // A key without a TTL counts as an infinite TTL for GT and LT.
+    case gt && (!hasTTL || whenMs <= current.UnixMilli()):
+        return s.noChange(redisprotocol.NewInteger(0))
+    case lt && hasTTL && whenMs >= current.UnixMilli():
+        return s.noChange(redisprotocol.NewInteger(0))
+    }
+
+    when := time.UnixMilli(whenMs)
+    if !time.Now().Before(when) {
+        // Expiring in the past deletes the key right away.
+        s.kvstore.delete(key)
+        return redisprotocol.NewInteger(1)
+    }
+    s.kvstore.Expirations[key] = when
+    return redisprotocol.NewInteger(1)
+}
+
+// expireTimeMs converts amount units on top of base (unix ms) to an absolute
+// unix time in milliseconds, reporting false on overflow.
+func expireTimeMs(base, amount int64, unit time.Duration) (int64, bool) {
+    perUnit := int64(unit / time.Millisecond)
+    if amount > math.MaxInt64/perUnit || amount < math.MinInt64/perUnit {
+        return 0, false
     }
-    return "(nil)"
+    amount *= perUnit
+    if (amount > 0 && base > math.MaxInt64-amount) || (amount < 0 && base < math.MinInt64-amount) {
+        return 0, false
+    }
+    return base + amount, true
+}
+
+func (s *Server) handleTTL(args []string) redisprotocol.Value {
+    return s.ttlGeneric("TTL", args, time.Second, false)
 }
 
-func (s *Server) handleTTL(args []string) string {
+func (s *Server) handlePTTL(args []string) redisprotocol.Value {
+    return s.ttlGeneric("PTTL", args, time.Millisecond, false)
+}
+
+func (s *Server) handleExpireTime(args []string) redisprotocol.Value {
+    return s.ttlGeneric("EXPIRETIME", args, time.Second, true)
+}
+
+func (s *Server) handlePExpireTime(args []string) redisprotocol.Value {
+    return s.ttlGeneric("PEXPIRETIME", args, time.Millisecond, true)
+}
+
+// ttlGeneric implements TTL, PTTL, EXPIRETIME and PEXPIRETIME. It replies -2
+// when the key does not exist and -1 when it exists without a TTL.
+func (s *Server) ttlGeneric(cmd string, args []string, unit time.Duration, absolute bool) redisprotocol.Value {
     if len(args) != 1 {
-        return "ERROR 'TTL' command requires 1 argument"
+        return wrongArgs(cmd)
     }
     key := args[0]
 
-    s.kvstore.RLock()
+    if s.kvstore.lookup(key) == nil {
+        return redisprotocol.NewInteger(-2) // Key does not exist
+    }
     expiration, exists := s.kvstore.Expirations[key]
-    s.kvstore.RUnlock()
-    
-    if exists {
-        if time.Now().Before(expiration) {
-            // Calculate remaining TTL
-            ttl := int(time.Until(expiration).Seconds())
-            return fmt.Sprintf("(integer) %d", ttl)
-        }
-        
-        // Key has expired, clean up
-        s.kvstore.Lock() // Acquire a write lock for cleanup
-        defer s.kvstore.Unlock()
-        
-        delete(s.kvstore.Expirations, key)
-        delete(s.kvstore.Strings, key)
-        delete(s.kvstore.Lists, key)
-        delete(s.kvstore.Hashes, key)
-        delete(s.kvstore.Sets, key)
-        delete(s.kvstore.SortedSets, key)
-        
-        return "(integer) -2" // Indicate the key existed but has expired
+    if !exists {
+        return redisprotocol.NewInteger(-1) // Key has no associated expire
+    }
+
+    if absolute {
+        return redisprotocol.NewInteger(int(expiration.UnixMilli() / int64(unit/time.Millisecond)))
     }
-    return "(integer) -1" // Key does not exist
+    // Round to the nearest unit, as Redis does for TTL.
+    remaining := time.Until(expiration)
+    return redisprotocol.NewInteger(int((remaining + unit/2) / unit))
 }
 
-func (s *Server) handleInfo(args []string) string {
-    info := "Server Info:\n"
-    info += fmt.Sprintf("Keys in store: %d\n", len(s.kvstore.Strings))
-    info += fmt.Sprintf("Lists: %d\n", len(s.kvstore.Lists))
-    info += fmt.Sprintf("Hashes: %d\n", len(s.kvstore.Hashes))
-    info += fmt.Sprintf("Sets: %d\n", len(s.kvstore.Sets))
-    info += fmt.Sprintf("Sorted Sets: %d\n", len(s.kvstore.SortedSets))
-    return info
+func (s *Server) handlePersist(args []string) redisprotocol.Value {
+    if len(args) != 1 {
+        return wrongArgs("PERSIST")
+    }
+    key := args[0]
+
+    if s.kvstore.lookup(key) == nil {
+        return s.noChange(redisprotocol.NewInteger(0))
+    }
+    if _, exists := s.kvstore.Expirations[key]; !exists {
+        return s.noChange(redisprotocol.NewInteger(0))
+    }
+    delete(s.kvstore.Expirations, key)
+    return redisprotocol.NewInteger(1)
 }
 
-func (s *Server) handleFlushAll(args []string) string {
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
-    s.kvstore.Strings = make(map[string]string)
-    s.kvstore.Lists = make(map[string][]string)
-    s.kvstore.Hashes = make(map[string]map[string]string)
-    s.kvstore.Sets = make(map[string]map[string]struct{})
-    s.kvstore.SortedSets = make(map[string]map[string]float64)
-    return "OK"
+func (s *Server) handleType(args []string) redisprotocol.Value {
+    if len(args) != 1 {
+        return wrongArgs("TYPE")
+    }
+
+    if obj := s.kvstore.lookup(args[0]); obj != nil {
+        return redisprotocol.NewString(obj.Type)
+    }
+    return redisprotocol.NewString("none")
 }
 
-func (s *Server) handlePing(args []string) string {
-    return "PONG"
+func (s *Server) handleFlushAll(args []string) redisprotocol.Value {
+    s.kvstore.Keys = make(map[string]*Object)
+    s.kvstore.Expirations = make(map[string]time.Time)
+    return redisprotocol.NewString("OK")
 }
 
-func (s *Server) handleSubscribe(args []string, conn net.Conn) string {
-    if len(args) != 1 {
-		return "ERROR 'SUBSCRIBE' command requires 1 argument"
+func (s *Server) handlePing(args []string) redisprotocol.Value {
+    if len(args) > 1 {
+        return wrongArgs("PING")
+    }
+    if len(args) == 1 {
+        return redisprotocol.NewBulk(args[0])
+    }
+    return redisprotocol.NewString("PONG")
+}
+
+func (s *Server) handleSubscribe(args []string, c *Client) redisprotocol.Value {
+    if len(args) < 1 {
+		return wrongArgs("SUBSCRIBE")
 	}
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
-	channel := args[0]
-	pubsub.Subscribe(channel, conn) // Subscribe the connection to the channel
-	// return "OK"
-    return fmt.Sprintf(`1) "subscribe" \n 2) "%s" \n 3) (integer) 1`, channel)
+	for _, channel := range args {
+		count := pubsub.Subscribe(channel, c) // Subscribe the connection to the channel
+		if err := c.Write(subscriptionReply("subscribe", channel, count)); err != nil {
+			break
+		}
+	}
+	return noReply
 }
 
-func (s *Server) handlePublish(args []string) string {
+func (s *Server) handlePublish(args []string) redisprotocol.Value {
     if len(args) < 2 {
-		return "ERROR 'PUBLISH' command requires at least 2 arguments"
+		return wrongArgs("PUBLISH")
 	}
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
 	channel := args[0]
 	message := strings.Join(args[1:], " ")
-	pubsub.Publish(channel, message) // Publish the message to the channel
-	return "(integer) 1"
+	receivers := pubsub.Publish(channel, message) // Publish the message to the channel
+	return redisprotocol.NewInteger(receivers)
 }   
 
-func (s *Server) handleUnsubscribe(args []string, conn net.Conn) string {
-    if len(args) != 1 {
-		return "ERROR 'UNSUBSCRIBE' command requires 1 argument"
+func (s *Server) handleUnsubscribe(args []string, c *Client) redisprotocol.Value {
+	channels := args
+	if len(channels) == 0 {
+		channels = pubsub.Channels(c)
+		if len(channels) == 0 {
+			return subscriptionReply("unsubscribe", "", 0)
+		}
 	}
-    s.kvstore.Lock()
-    defer s.kvstore.Unlock()
-	channel := args[0]
-	pubsub.Unsubscribe(channel, conn) // Unsubscribe the connection from the channel
-	// return "OK"
-    return fmt.Sprintf(`1) "unsubscribe" \n 2) "%s" \n 3) (integer) 0`, channel)
+	for _, channel := range channels {
+		count := pubsub.Unsubscribe(channel, c) // Unsubscribe the connection from the channel
+		if err := c.Write(subscriptionReply("unsubscribe", channel, count)); err != nil {
+			break
+		}
+	}
+	return noReply
 }
 
-func (s *Server) handleSave(args []string) string {
-	s.kvstore.Lock()
-	defer s.kvstore.Unlock()
+// subscriptionReply builds the confirmation sent for each (un)subscribed channel.
+// An empty channel is reported as null, as when unsubscribing with no subscriptions.
+func subscriptionReply(kind, channel string, count int) redisprotocol.Value {
+    name := redisprotocol.NewBulk(channel)
+    if channel == "" {
+        name = redisprotocol.NewNull()
+    }
+    return redisprotocol.NewPush([]redisprotocol.Value{
+        redisprotocol.NewBulk(kind),
+        name,
+        redisprotocol.NewInteger(count),
+    })
+}
+
+func (s *Server) handleSave(args []string) redisprotocol.Value {
 	err := persistence.Save(s.kvstore)
+	if err == errBgsaveInProgress {
+		return redisprotocol.NewError(err.Error())
+	}
 	if err != nil {
-		return "ERR " + err.Error()
+		return redisprotocol.NewError("ERR " + err.Error())
 	}
-	return "OK"
+	return redisprotocol.NewString("OK")
 }
 
-func (s *Server) handleBgsave(args []string) string {
-	s.kvstore.Lock()
-	defer s.kvstore.Unlock()
-	persistence.Bgsave(s.kvstore)
-	return "OK"
+func (s *Server) handleBgsave(args []string) redisprotocol.Value {
+	if err := persistence.Bgsave(s.kvstore); err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	return redisprotocol.NewString("Background saving started")
+}
+
+func (s *Server) handleLastsave(args []string) redisprotocol.Value {
+	if len(args) != 0 {
+		return wrongArgs("LASTSAVE")
+	}
+	return redisprotocol.NewInteger(int(persistence.Status().LastSave.Unix()))
+}
+
+func (s *Server) handleBgrewriteaof(args []string) redisprotocol.Value {
+	if len(args) != 0 {
+		return wrongArgs("BGREWRITEAOF")
+	}
+	if err := s.startAOFRewrite(); err != nil {
+		return redisprotocol.NewError(err.Error())
+	}
+	return redisprotocol.NewString("Background append only file rewriting started")
 }
 
 // TODO: Add more commands
+// readCommand reads the next command, either as a RESP array or as an inline command line.
 func readCommand(resp *redisprotocol.Resp) ([]string, error) {
-    value, err := resp.Read()
+    value, err := resp.ReadCommand()
     if err != nil {
         return nil, err
     }
+    return commandArgs(value)
+}
 
+// commandArgs converts a RESP array of bulk strings into command arguments.
+func commandArgs(value redisprotocol.Value) ([]string, error) {
     if value.Type != "array" {
         return nil, fmt.Errorf("invalid command format")
     }
@@ -821,43 +1382,146 @@ func readCommand(resp *redisprotocol.Resp) ([]string, error) {
     return command, nil
 }
 
-func (s *Server) processCommand(command []string, conn net.Conn) string {
+func (s *Server) processCommand(command []string, c *Client) redisprotocol.Value {
     fmt.Println("Received command:", command) // yo
     if len(command) == 0 {
-        return "ERR empty command"
+        return redisprotocol.NewError("ERR empty command")
     }
 
     cmd := strings.ToUpper(command[0])
     args := command[1:]
 
-    if cmd == "SUBSCRIBE" || cmd == "PUBLISH" || cmd == "UNSUBSCRIBE" {
-        return s.handleCommandWithConn(cmd, args, conn)
+    if handler, ok := s.commands[cmd]; ok && handler.Flags&cmdWrite != 0 && s.replicaReadOnly.Load() {
+        if c.inMulti {
+            c.multiError = true
+        }
+        return redisprotocol.NewError("READONLY You can't write against a read only replica.")
+    }
+
+    asking := c.asking
+    if cmd != "ASKING" {
+        c.asking = false
+    }
+    if handler, ok := s.commands[cmd]; ok && s.cluster != nil {
+        if reply := s.clusterCheck(handler, command, c, asking || cmd == "RESTORE-ASKING"); reply.Type != "" {
+            if c.inMulti {
+                c.multiError = true
+            }
+            return reply
+        }
+    }
+
+    if c.inMulti && !multiControlCommands[cmd] {
+        return s.queueCommand(cmd, command, c)
+    }
+
+    if connCommands[cmd] {
+        return s.handleCommandWithConn(cmd, args, c)
     }
 
     if handler, ok := s.commands[cmd]; ok {
-		return handler(args)
+		return s.call(handler, command, c)
 	}
 
-	return "ERR unknown command '" + cmd + "'"
+	return redisprotocol.NewError("ERR unknown command '" + cmd + "'")
+}
+
+// call runs a command with the store locked for the duration of the handler:
+// write commands take the write lock, everything else the read lock. After a
+// write, c (nil when replaying the append-only file) remembers the end of the
+// replication stream so that WAIT knows what its replicas must acknowledge.
+func (s *Server) call(cmd Command, argv []string, c *Client) redisprotocol.Value {
+    if cmd.Flags&cmdWrite == 0 {
+        s.kvstore.RLock()
+        defer s.kvstore.RUnlock()
+        return s.execute(cmd, argv)
+    }
+    s.kvstore.Lock()
+    defer s.kvstore.Unlock()
+    reply := s.execute(cmd, argv)
+    s.serveBlockedClients()
+    if c != nil {
+        c.woff = s.repl.offset
+    }
+    return reply
+}
+
+// execute runs a command handler and propagates the effects of successful
+// writes that modified the keyspace. The caller must hold the store lock.
+func (s *Server) execute(cmd Command, argv []string) redisprotocol.Value {
+    if cmd.Flags&cmdWrite == 0 {
+        return cmd.Handler(argv[1:])
+    }
+    s.unchanged = false
+    reply := cmd.Handler(argv[1:])
+    if reply.Type == "error" || s.unchanged {
+        return reply
+    }
+    if cmd.Flags&cmdBlocking != 0 {
+        // Only what the command did is propagated, if anything.
+        if argv = unblockedCommand(argv, reply); argv == nil {
+            return reply
+        }
+        cmd = s.commands[argv[0]]
+    }
+    s.propagate(cmd, argv)
+    return reply
+}
+
+// noChange marks the running write command as having left the keyspace as
+// it was, like a SETNX on an existing key, and returns reply. execute then
+// neither counts nor propagates it, so WATCH, blocked clients, the save
+// points, the append-only file and replicas ignore it.
+func (s *Server) noChange(reply redisprotocol.Value) redisprotocol.Value {
+    s.unchanged = true
+    return reply
+}
+
+// propagate records that a write command modified the keyspace.
+// The caller must hold the store write lock.
+func (s *Server) propagate(cmd Command, argv []string) {
+    s.kvstore.dirty.Add(1)
+    keys := cmd.keys(argv)
+    if cmd.FirstKey == 0 {
+        // Keyless writes such as FLUSHALL may touch any key.
+        s.touchAllWatchedKeys()
+    }
+    for _, key := range keys {
+        s.touchWatchedKey(key)
+        s.signalKeyAsReady(key)
+    }
+    for _, propagated := range s.propagatedCommands(argv) {
+        s.propagateCommand(propagated)
+    }
 }
 
 func handleConnection(conn net.Conn, server *Server) {
     defer conn.Close()
-    resp := redisprotocol.NewResp(conn, conn)
+    client := NewClient(conn)
+    defer pubsub.UnsubscribeAll(client)
+    defer server.unwatchAllKeys(client)
+    defer server.removeReplica(client)
 
     for {
-        command, err := readCommand(resp)
+        command, err := readCommand(client.resp)
         if err != nil {
             if err == io.EOF {
                 fmt.Println("Client disconnected")
                 return
             }
+            var protoErr *redisprotocol.ProtocolError
+            if errors.As(err, &protoErr) {
+                client.Write(redisprotocol.NewError("ERR " + protoErr.Error()))
+            }
             fmt.Println("Error reading command:", err)
             return
         }
 
-        response := server.processCommand(command, conn)
-        err = resp.Write(redisprotocol.Value{Type: "bulk", Bulk: response})
+        response := server.processCommand(command, client)
+        if response.Type == "" {
+            continue
+        }
+        err = client.Write(response)
         if err != nil {
             fmt.Println("Error writing response:", err)
             return
@@ -865,27 +1529,123 @@ func handleConnection(conn net.Conn, server *Server) {
     }
 }
 
-func initializePersistence(server *Server) {
-	if err := persistence.Load(server.kvstore); err != nil {
-		fmt.Println("Warning:", err)
+// initializePersistence loads the dataset on startup, from the append-only
+// file when it is enabled and present, otherwise from the snapshot, and then
+// opens the append-only file for writing.
+func initializePersistence(server *Server) error {
+	if config.AppendOnly {
+		if _, err := os.Stat(config.AppendFilename); err == nil {
+			loaded, err := LoadAOF(config.AppendFilename, config.AOFLoadTruncated, server.replayCommand)
+			if err != nil {
+				return err
+			}
+			// Replayed commands went through execute, which counted them
+			// as changes, but the dataset is exactly what is on disk.
+			server.kvstore.dirty.Store(0)
+			fmt.Printf("DB loaded from append-only file: %d commands\n", loaded)
+		} else if err := persistence.Load(server.kvstore); err != nil {
+			return err
+		}
+		return server.openAOF()
 	}
+	return persistence.Load(server.kvstore)
+}
+
+// openAOF opens the append-only file. A new file is seeded with the current
+// dataset so that it alone is enough to rebuild the server.
+func (s *Server) openAOF() error {
+	aof, err := OpenAOF(config.AppendFilename, config.AppendFsync)
+	if err != nil {
+		return err
+	}
+	s.kvstore.Lock()
+	defer s.kvstore.Unlock()
+	if aof.Size() == 0 && len(s.kvstore.Keys) > 0 {
+		if err := aof.WriteDataset(s.kvstore); err != nil {
+			aof.Close()
+			return err
+		}
+	}
+	s.aof = aof
+	return nil
+}
+
+// handleSignals shuts the server down gracefully on SIGINT or SIGTERM.
+func (s *Server) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	fmt.Printf("Received %v, shutting down\n", sig)
+	if err := s.shutdown(); err != nil {
+		fmt.Println("Error during shutdown:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// shutdown stops accepting writes, saves a final snapshot when save points
+// are configured and flushes the append-only file.
+func (s *Server) shutdown() error {
+	s.kvstore.Lock()
+	defer s.kvstore.Unlock()
+	if s.aof != nil {
+		if err := s.aof.Close(); err != nil {
+			return fmt.Errorf("failed to close append-only file: %v", err)
+		}
+	}
+	if len(config.SavePoints) > 0 {
+		persistence.WaitBgsave()
+		if err := persistence.Save(s.kvstore); err != nil {
+			return fmt.Errorf("failed to save the final snapshot: %v", err)
+		}
+		fmt.Println("DB saved on disk")
+	}
+	return nil
 }
 
 func main() {
-	port := "6378"
+	if err := parseFlags(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if config.Sentinel {
+		runSentinel()
+		return
+	}
 	server := NewServer()
+	if config.ClusterEnabled {
+		cluster, err := loadClusterConfig(config.ClusterConfigFile)
+		if err != nil {
+			fmt.Println("Error loading the cluster config:", err)
+			os.Exit(1)
+		}
+		cluster.saveConfig()
+		server.cluster = cluster
+		fmt.Println("Cluster node ID:", cluster.myself.id)
+	}
 
     // Load existing data on startup
-	initializePersistence(server)
+	if err := initializePersistence(server); err != nil {
+		fmt.Println("Error loading data:", err)
+		os.Exit(1)
+	}
+	go server.serverCron()
+	go server.handleSignals()
+	if config.ReplicaOf != "" {
+		master := strings.Fields(config.ReplicaOf)
+		server.kvstore.Lock()
+		server.replicate(master[0], master[1])
+		server.kvstore.Unlock()
+	}
 
-	listener, err := net.Listen("tcp", ":"+port)
+	listener, err := net.Listen("tcp", ":"+config.Port)
 	if err != nil {
 		fmt.Println("Error starting server:", err)
 		return
 	}
 	defer listener.Close()
 
-	fmt.Printf("Server listening on :%s\n", port)
+	fmt.Printf("Server listening on :%s\n", config.Port)
 
 	for {
 		conn, err := listener.Accept()
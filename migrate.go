@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+var (
+	errDumpChecksum = errors.New("DUMP payload version or checksum are wrong")
+	errDumpFormat   = errors.New("Bad data format")
+)
+
+// dumpObject serializes obj in the DUMP format: its RDB type and value,
+// followed by the RDB version as two little endian bytes and the CRC64 of
+// everything before the checksum.
+func dumpObject(obj *Object) ([]byte, error) {
+	var buf bytes.Buffer
+	e := newRDBWriter(&buf)
+	typ, err := rdbObjectType(obj)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.writeByte(typ); err != nil {
+		return nil, err
+	}
+	if err := e.writeObject(obj); err != nil {
+		return nil, err
+	}
+	if err := e.write([]byte{byte(rdbVersion), byte(rdbVersion >> 8)}); err != nil {
+		return nil, err
+	}
+	return binary.LittleEndian.AppendUint64(buf.Bytes(), e.crc), nil
+}
+
+// restoreObject decodes a DUMP payload, including those produced by real
+// Redis with any RDB version this server can load.
+func restoreObject(payload []byte) (*Object, error) {
+	if len(payload) < 10 {
+		return nil, errDumpChecksum
+	}
+	footer := payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer) > rdbMaxLoadVersion {
+		return nil, errDumpChecksum
+	}
+	if crc64Update(0, payload[:len(payload)-8]) != binary.LittleEndian.Uint64(footer[2:]) {
+		return nil, errDumpChecksum
+	}
+
+	d := newRDBReader(bytes.NewReader(payload[:len(payload)-10]), int64(len(payload)-10))
+	typ, err := d.readByte()
+	if err != nil {
+		return nil, errDumpFormat
+	}
+	if _, ok := rdbUnsupportedTypes[typ]; ok {
+		return nil, errDumpFormat
+	}
+	obj, err := d.readObject(typ)
+	if err != nil {
+		return nil, errDumpFormat
+	}
+	if _, err := d.r.ReadByte(); err != io.EOF {
+		return nil, errDumpFormat
+	}
+	if obj.Type != TypeString && obj.Len() == 0 {
+		return nil, errDumpFormat
+	}
+	return obj, nil
+}
+
+func (s *Server) handleDump(args []string) redisprotocol.Value {
+	if len(args) != 1 {
+		return wrongArgs("DUMP")
+	}
+	obj := s.kvstore.lookup(args[0])
+	if obj == nil {
+		return redisprotocol.NewNull()
+	}
+	payload, err := dumpObject(obj)
+	if err != nil {
+		return redisprotocol.NewError("ERR " + err.Error())
+	}
+	return redisprotocol.NewBulk(string(payload))
+}
+
+// handleRestore implements RESTORE key ttl serialized-value [REPLACE]
+// [ABSTTL] [IDLETIME seconds] [FREQ frequency]. The ttl is in milliseconds,
+// 0 meaning no expiry. IDLETIME and FREQ are accepted and ignored, since no
+// eviction policy uses them.
+func (s *Server) handleRestore(args []string) redisprotocol.Value {
+	if len(args) < 3 {
+		return wrongArgs("RESTORE")
+	}
+	key, payload := args[0], args[2]
+	ttl, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return redisprotocol.NewError("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return redisprotocol.NewError("ERR Invalid TTL value, must be >= 0")
+	}
+	replace, absTTL := false, false
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME", "FREQ":
+			if i+1 >= len(args) {
+				return redisprotocol.NewError("ERR syntax error")
+			}
+			if n, err := strconv.ParseInt(args[i+1], 10, 64); err != nil || n < 0 {
+				return redisprotocol.NewError("ERR Invalid " + strings.ToUpper(args[i]) + " value, must be >= 0")
+			}
+			i++
+		default:
+			return redisprotocol.NewError("ERR syntax error")
+		}
+	}
+
+	// A corrupt payload is reported even when the key exists.
+	obj, err := restoreObject([]byte(payload))
+	if err != nil {
+		return redisprotocol.NewError("ERR " + err.Error())
+	}
+	if !replace {
+		s.kvstore.expireIfNeeded(key)
+		if _, exists := s.kvstore.Keys[key]; exists {
+			return redisprotocol.NewError("BUSYKEY Target key name already exists.")
+		}
+	}
+
+	var expireAt time.Time
+	if ttl > 0 {
+		if absTTL {
+			expireAt = time.UnixMilli(ttl)
+		} else {
+			expireAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+		if !time.Now().Before(expireAt) {
+			// Already expired: the key is not created at all.
+			s.kvstore.delete(key)
+			return redisprotocol.NewString("OK")
+		}
+	}
+	obj.gen = s.kvstore.generation.Load()
+	s.kvstore.Keys[key] = obj
+	delete(s.kvstore.Expirations, key)
+	if ttl > 0 {
+		s.kvstore.Expirations[key] = expireAt
+	}
+	return redisprotocol.NewString("OK")
+}
+
+// restoreCommands describes a restored key with an absolute expiry time, or
+// its deletion when it was restored already expired.
+func (s *Server) restoreCommands(key string) [][]string {
+	obj := s.kvstore.lookup(key)
+	if obj == nil {
+		return [][]string{{"DEL", key}}
+	}
+	payload, err := dumpObject(obj)
+	if err != nil {
+		return [][]string{{"DEL", key}}
+	}
+	if when, ok := s.kvstore.Expirations[key]; ok {
+		return [][]string{{"RESTORE", key, strconv.FormatInt(when.UnixMilli(), 10), string(payload), "REPLACE", "ABSTTL"}}
+	}
+	return [][]string{{"RESTORE", key, "0", string(payload), "REPLACE"}}
+}
+
+// handleMigrate implements MIGRATE host port key|"" destination-db timeout
+// [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key ...].
+//
+// The keys are sent to the target with RESTORE and, unless COPY is given,
+// deleted here once the target accepted them. Like in Redis the whole
+// transfer runs with the store locked, so the keys cannot change while they
+// move; timeout (in milliseconds) bounds how long that can take. The caller
+// must hold the store write lock.
+func (s *Server) handleMigrate(args []string) redisprotocol.Value {
+	if len(args) < 5 {
+		return wrongArgs("MIGRATE")
+	}
+	host, port := args[0], args[1]
+	db, err := strconv.Atoi(args[3])
+	if err != nil || db < 0 {
+		return redisprotocol.NewError("ERR value is not an integer or out of range")
+	}
+	timeoutMs, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		return redisprotocol.NewError("ERR value is not an integer or out of range")
+	}
+	if timeoutMs <= 0 {
+		timeoutMs = 1000
+	}
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+
+	copyKeys, replace := false, false
+	var auth []string
+	keys := []string{args[2]}
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COPY":
+			copyKeys = true
+		case "REPLACE":
+			replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return redisprotocol.NewError("ERR syntax error")
+			}
+			auth = []string{"AUTH", args[i+1]}
+			i++
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return redisprotocol.NewError("ERR syntax error")
+			}
+			auth = []string{"AUTH", args[i+1], args[i+2]}
+			i += 2
+		case "KEYS":
+			if args[2] != "" {
+				return redisprotocol.NewError("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			keys = args[i+1:]
+			i = len(args)
+		default:
+			return redisprotocol.NewError("ERR syntax error")
+		}
+	}
+
+	peer, err := dialPeer(net.JoinHostPort(host, port), timeout)
+	if err != nil {
+		return redisprotocol.NewError("IOERR error or timeout connecting to the client")
+	}
+	defer peer.Close()
+	peer.SetDeadline(timeout)
+	var setup [][]string
+	if auth != nil {
+		setup = append(setup, auth)
+	}
+	if db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(db)})
+	}
+	for _, cmd := range setup {
+		if reply, err := peer.Do(cmd...); err != nil {
+			if reply.Type == "error" {
+				return redisprotocol.NewError("ERR Target instance replied with error: " + reply.Str)
+			}
+			return redisprotocol.NewError("IOERR error or timeout reading to target instance")
+		}
+	}
+
+	restoreCmd := "RESTORE"
+	if s.cluster != nil {
+		// Lets the target accept keys of a slot it is importing.
+		restoreCmd = "RESTORE-ASKING"
+	}
+	var cmds [][]string
+	var moved []string
+	for _, key := range keys {
+		obj := s.kvstore.lookup(key)
+		if obj == nil {
+			continue
+		}
+		payload, err := dumpObject(obj)
+		if err != nil {
+			return redisprotocol.NewError("ERR " + err.Error())
+		}
+		ttl := int64(0)
+		if when, ok := s.kvstore.Expirations[key]; ok {
+			if ttl = time.Until(when).Milliseconds(); ttl < 1 {
+				ttl = 1
+			}
+		}
+		cmd := []string{restoreCmd, key, strconv.FormatInt(ttl, 10), string(payload)}
+		if replace {
+			cmd = append(cmd, "REPLACE")
+		}
+		cmds = append(cmds, cmd)
+		moved = append(moved, key)
+	}
+	if len(moved) == 0 {
+		return s.noChange(redisprotocol.NewString("NOKEY"))
+	}
+
+	replies, err := peer.Pipeline(cmds)
+	if err != nil {
+		return redisprotocol.NewError("IOERR error or timeout reading to target instance")
+	}
+	// Keys the target accepted are deleted even if others were refused.
+	var failure string
+	var deleted []string
+	for i, reply := range replies {
+		if reply.Type != "error" {
+			deleted = append(deleted, moved[i])
+		} else if failure == "" {
+			failure = reply.Str
+		}
+	}
+
+	if !copyKeys && len(deleted) > 0 {
+		for _, key := range deleted {
+			s.kvstore.delete(key)
+		}
+		// Propagated here rather than by execute, which skips commands
+		// that failed, as this one does when the target refused a key,
+		// and would otherwise replicate the MIGRATE itself.
+		argv := append([]string{"DEL"}, deleted...)
+		s.propagate(s.commands["DEL"], argv)
+	}
+	if failure != "" {
+		return redisprotocol.NewError("ERR Target instance replied with error: " + failure)
+	}
+	return s.noChange(redisprotocol.NewString("OK"))
+}
+
+// migrateKeys returns the keys following the KEYS option of a MIGRATE
+// command, nil if it has none.
+func migrateKeys(argv []string) []string {
+	for i := 6; i < len(argv); i++ {
+		switch strings.ToUpper(argv[i]) {
+		case "AUTH":
+			i++
+		case "AUTH2":
+			i += 2
+		case "KEYS":
+			return argv[i+1:]
+		}
+	}
+	return nil
+}
+
+// keysInSlot returns up to count live keys hashing to slot, in order.
+// The caller must hold the store lock.
+func (s *Server) keysInSlot(slot, count int) []string {
+	var keys []string
+	for key := range s.kvstore.Keys {
+		if keyHashSlot(key) == slot && !s.kvstore.isExpired(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > count {
+		keys = keys[:count]
+	}
+	return keys
+}
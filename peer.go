@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+// peerConn is a connection to another server, used when this server acts as
+// a client: replicas talking to their master, key migration and monitoring.
+type peerConn struct {
+	addr string
+	conn net.Conn
+	resp *redisprotocol.Resp
+}
+
+func dialPeer(addr string, timeout time.Duration) (*peerConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &peerConn{addr: addr, conn: conn, resp: redisprotocol.NewResp(conn, conn)}, nil
+}
+
+// Send writes a command without waiting for the reply.
+func (p *peerConn) Send(args ...string) error {
+	_, err := p.conn.Write(redisprotocol.EncodeCommand(args))
+	return err
+}
+
+// Do sends a command and returns its reply. An error reply is returned as
+// an error.
+func (p *peerConn) Do(args ...string) (redisprotocol.Value, error) {
+	if err := p.Send(args...); err != nil {
+		return redisprotocol.Value{}, err
+	}
+	reply, err := p.resp.Read()
+	if err != nil {
+		return reply, err
+	}
+	if reply.Type == "error" {
+		return reply, fmt.Errorf("%s replied to %s: %s", p.addr, args[0], reply.Str)
+	}
+	return reply, nil
+}
+
+// Pipeline sends several commands at once and returns their replies, error
+// replies included.
+func (p *peerConn) Pipeline(cmds [][]string) ([]redisprotocol.Value, error) {
+	var buf []byte
+	for _, args := range cmds {
+		buf = append(buf, redisprotocol.EncodeCommand(args)...)
+	}
+	if _, err := p.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	replies := make([]redisprotocol.Value, len(cmds))
+	for i := range replies {
+		reply, err := p.resp.Read()
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// SetDeadline limits how long the next reads and writes may block.
+func (p *peerConn) SetDeadline(timeout time.Duration) {
+	p.conn.SetDeadline(time.Now().Add(timeout))
+}
+
+func (p *peerConn) Close() error {
+	return p.conn.Close()
+}
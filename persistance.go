@@ -1,68 +1,224 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
+var errBgsaveInProgress = errors.New("ERR Background save already in progress")
+
 type Persistence struct {
 	filePath string
+	// saveMu serializes writes of the snapshot file.
+	saveMu sync.Mutex
+
+	mu               sync.Mutex
+	bgsaveInProgress bool
+	bgsaveStart      time.Time
+	lastSave         time.Time
+	lastBgsaveOK     bool
+	lastBgsaveTime   time.Duration
+	lastBgsaveTry    time.Time
 }
 
+// bgsaveRetryDelay is how long automatic saves wait after a failed one.
+const bgsaveRetryDelay = 5 * time.Second
+
 func NewPersistence(filePath string) *Persistence {
-	return &Persistence{filePath: filePath}
+	return &Persistence{filePath: filePath, lastSave: time.Now(), lastBgsaveOK: true}
+}
+
+// SaveStatus describes the state of snapshotting, as reported by INFO.
+type SaveStatus struct {
+	BgsaveInProgress  bool
+	LastSave          time.Time
+	LastBgsaveOK      bool
+	LastBgsaveTime    time.Duration
+	CurrentBgsaveTime time.Duration
+}
+
+// Status returns the current snapshotting state.
+func (p *Persistence) Status() SaveStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := SaveStatus{
+		BgsaveInProgress: p.bgsaveInProgress,
+		LastSave:         p.lastSave,
+		LastBgsaveOK:     p.lastBgsaveOK,
+		LastBgsaveTime:   p.lastBgsaveTime,
+	}
+	if p.bgsaveInProgress {
+		status.CurrentBgsaveTime = time.Since(p.bgsaveStart)
+	}
+	return status
 }
 
-// SAVE command: saves the current database to disk
+// SAVE command: saves the current database to disk in RDB format
 func (p *Persistence) Save(kvstore *KeyValueStore) error {
-	data, err := json.Marshal(kvstore)
-	if err != nil {
-		return fmt.Errorf("failed to serialize database: %v", err)
+	p.mu.Lock()
+	inProgress := p.bgsaveInProgress
+	p.mu.Unlock()
+	if inProgress {
+		return errBgsaveInProgress
+	}
+	dirty := kvstore.dirty.Load()
+	if err := p.save(kvstore); err != nil {
+		return err
+	}
+	kvstore.dirty.Add(-dirty)
+	p.mu.Lock()
+	p.lastSave = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Persistence) save(kvstore *KeyValueStore) error {
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+
+	// Write the new snapshot next to the current one and only then rename
+	// it into place, so that a crash never leaves a partial file behind.
+	dir := filepath.Dir(p.filePath)
+	tempPath := filepath.Join(dir, fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	if err := saveRDBFile(tempPath, kvstore); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to save database: %v", err)
 	}
 
-	// Backup existing file
+	// Keep the current snapshot as the fallback in case the new one is
+	// found to be corrupt when loading.
 	if _, err := os.Stat(p.filePath); err == nil {
-		err = os.Rename(p.filePath, p.filePath+".bak")
-		if err != nil {
-			return fmt.Errorf("failed to create backup: %v", err)
+		backupPath := p.filePath + ".bak"
+		os.Remove(backupPath)
+		if err := os.Link(p.filePath, backupPath); err != nil {
+			if err := os.Rename(p.filePath, backupPath); err != nil {
+				os.Remove(tempPath)
+				return fmt.Errorf("failed to create backup: %v", err)
+			}
 		}
 	}
 
-	err = os.WriteFile(p.filePath, data, 0644)
-	if err != nil {
+	if err := os.Rename(tempPath, p.filePath); err != nil {
+		os.Remove(tempPath)
 		return fmt.Errorf("failed to save database: %v", err)
 	}
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("failed to sync directory: %v", err)
+	}
 	return nil
 }
 
-// BGSAVE command: saves the database to disk in the background
-func (p *Persistence) Bgsave(kvstore *KeyValueStore) {
+// SaveNeeded reports whether one of points is reached given dirty changes
+// since the last save. After a failed background save it waits
+// bgsaveRetryDelay before asking again.
+func (p *Persistence) SaveNeeded(points []savePoint, dirty int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bgsaveInProgress || !p.lastBgsaveOK && time.Since(p.lastBgsaveTry) < bgsaveRetryDelay {
+		return false
+	}
+	for _, point := range points {
+		if dirty >= point.Changes && time.Since(p.lastSave) >= time.Duration(point.Seconds)*time.Second {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitBgsave blocks until no background save is running.
+func (p *Persistence) WaitBgsave() {
+	for p.Status().BgsaveInProgress {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// syncDir fsyncs a directory so that renames inside it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// BGSAVE command: saves the database to disk in the background. The data
+// written is a snapshot of the store taken when Bgsave is called, so writes
+// can go on meanwhile. The caller must hold the store lock.
+func (p *Persistence) Bgsave(kvstore *KeyValueStore) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bgsaveInProgress {
+		return errBgsaveInProgress
+	}
+	p.bgsaveInProgress = true
+	p.bgsaveStart = time.Now()
+	p.lastBgsaveTry = p.bgsaveStart
+
+	snap := kvstore.snapshot()
+	dirty := kvstore.dirty.Load()
 	go func() {
-		time.Sleep(2 * time.Second) // Simulate time taken to save
-		err := p.Save(kvstore)
+		err := p.save(snap)
+		kvstore.releaseSnapshot()
+		if err == nil {
+			kvstore.dirty.Add(-dirty)
+		}
+
+		p.mu.Lock()
+		p.bgsaveInProgress = false
+		p.lastBgsaveOK = err == nil
+		p.lastBgsaveTime = time.Since(p.bgsaveStart)
+		if err == nil {
+			p.lastSave = time.Now()
+		}
+		p.mu.Unlock()
+
 		if err != nil {
 			fmt.Println(err)
 		} else {
 			fmt.Println("Database saved in the background.")
 		}
 	}()
+	return nil
 }
 
-// Load loads the database from disk
+// Load loads the database from disk. If the snapshot is missing or corrupt
+// (its checksum does not match, or it is truncated), the previous snapshot
+// kept in the .bak file is loaded instead.
 func (p *Persistence) Load(kvstore *KeyValueStore) error {
-	data, err := os.ReadFile(p.filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// File does not exist, return nil to indicate no data to load
+	backupPath := p.filePath + ".bak"
+	err := p.loadFile(p.filePath, kvstore)
+	if err == nil {
+		return nil
+	}
+	if os.IsNotExist(err) {
+		if _, statErr := os.Stat(backupPath); statErr != nil {
+			// No snapshot at all: start with an empty database.
 			return nil
 		}
-		return fmt.Errorf("failed to load database: %v", err)
 	}
-	err = json.Unmarshal(data, kvstore)
-	if err != nil {
-		return fmt.Errorf("failed to deserialize database: %v", err)
+	if backupErr := p.loadFile(backupPath, kvstore); backupErr != nil {
+		if os.IsNotExist(backupErr) {
+			return fmt.Errorf("failed to load database from %s: %v, and no previous snapshot exists", p.filePath, err)
+		}
+		return fmt.Errorf("failed to load database from %s: %v, and the previous snapshot %s is unusable too: %v", p.filePath, err, backupPath, backupErr)
+	}
+	fmt.Printf("Warning: failed to load database from %s: %v. Loaded the previous snapshot %s instead\n", p.filePath, err, backupPath)
+	return nil
+}
+
+// loadFile loads one snapshot file, leaving kvstore untouched unless the
+// whole file was read successfully.
+func (p *Persistence) loadFile(filePath string, kvstore *KeyValueStore) error {
+	loaded := NewKeyValueStore()
+	if err := loadRDBFile(filePath, loaded); err != nil {
+		return err
 	}
+	kvstore.Keys = loaded.Keys
+	kvstore.Expirations = loaded.Expirations
 	return nil
-}
\ No newline at end of file
+}
@@ -2,14 +2,15 @@ package main
 
 import (
 	"log"
-	"net"
+	"sort"
 	"sync"
-	"fmt"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
 )
 
 type Subscriber struct {
 	Channel string
-	Conn    net.Conn
+	Client  *Client
 }
 
 type PubSub struct {
@@ -23,46 +24,109 @@ func NewPubSub() *PubSub {
 	}
 }
 
-func (ps *PubSub) Subscribe(channel string, conn net.Conn) {
+// Subscribe adds client to channel and returns the number of channels client is now subscribed to.
+func (ps *PubSub) Subscribe(channel string, client *Client) int {
 	ps.Lock()
 	defer ps.Unlock()
-	subscriber := Subscriber{Channel: channel, Conn: conn}
-	ps.Subscribers[channel] = append(ps.Subscribers[channel], subscriber)
+	if !ps.isSubscribed(channel, client) {
+		subscriber := Subscriber{Channel: channel, Client: client}
+		ps.Subscribers[channel] = append(ps.Subscribers[channel], subscriber)
+	}
+	return ps.subscriptionCount(client)
 }
 
-func (ps *PubSub) Unsubscribe(channel string, conn net.Conn) {
+// Unsubscribe removes client from channel and returns the number of channels client is still subscribed to.
+func (ps *PubSub) Unsubscribe(channel string, client *Client) int {
 	ps.Lock()
 	defer ps.Unlock()
-	subscriber := Subscriber{Channel: channel, Conn: conn}
+	subscriber := Subscriber{Channel: channel, Client: client}
 	ps.removeSubscriber(channel, subscriber)
+	return ps.subscriptionCount(client)
 }
 
-func (ps *PubSub) Publish(channel, message string) {
+// Channels returns the channels client is subscribed to, sorted by name.
+func (ps *PubSub) Channels(client *Client) []string {
 	ps.RLock()
 	defer ps.RUnlock()
+	var channels []string
+	for channel := range ps.Subscribers {
+		if ps.isSubscribed(channel, client) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// UnsubscribeAll removes client from every channel, e.g. when it disconnects.
+func (ps *PubSub) UnsubscribeAll(client *Client) {
+	ps.Lock()
+	defer ps.Unlock()
+	for channel := range ps.Subscribers {
+		ps.removeSubscriber(channel, Subscriber{Channel: channel, Client: client})
+	}
+}
+
+// Publish sends message to every subscriber of channel and returns the number of receivers.
+// Messages are delivered as push frames, which RESP2 clients receive as plain arrays.
+// The subscribers are written to without holding the lock, so that a slow one does not
+// hold up subscribing and unsubscribing.
+func (ps *PubSub) Publish(channel, message string) int {
+	ps.RLock()
+	subscribers := append([]Subscriber(nil), ps.Subscribers[channel]...)
+	ps.RUnlock()
 
+	receivers := 0
+	msg := redisprotocol.NewPush([]redisprotocol.Value{
+		redisprotocol.NewBulk("message"),
+		redisprotocol.NewBulk(channel),
+		redisprotocol.NewBulk(message),
+	})
+	for _, sub := range subscribers {
+		err := sub.Client.Write(msg)
+		if err != nil {
+			log.Printf("Failed to send message to subscriber on channel %s: %v\n", channel, err)
+			sub.Client.conn.Close()
+			ps.Lock()
+			ps.removeSubscriber(channel, sub)
+			ps.Unlock()
+			continue
+		}
+		receivers++
+	}
+	return receivers
+}
+
+func (ps *PubSub) isSubscribed(channel string, client *Client) bool {
 	for _, sub := range ps.Subscribers[channel] {
-        formattedMessage := fmt.Sprintf(`1) "message" \n 2) "%s" \n 3) "%s"`, channel, message)
-        _, err := sub.Conn.Write([]byte(formattedMessage))
-        if err != nil {
-            log.Printf("Failed to send message to subscriber on channel %s: %v\n", channel, err)
-            sub.Conn.Close()
-            ps.removeSubscriber(channel, sub)
-        }
-    }
+		if sub.Client == client {
+			return true
+		}
+	}
+	return false
+}
+
+func (ps *PubSub) subscriptionCount(client *Client) int {
+	count := 0
+	for channel := range ps.Subscribers {
+		if ps.isSubscribed(channel, client) {
+			count++
+		}
+	}
+	return count
 }
 
 // removeSubscriber removes a subscriber from a channel.
 func (ps *PubSub) removeSubscriber(channel string, sub Subscriber) {
-    if subscribers, ok := ps.Subscribers[channel]; ok {
-        for i, subscriber := range subscribers {
-            if subscriber.Conn == sub.Conn {
-                ps.Subscribers[channel] = append(subscribers[:i], subscribers[i+1:]...)
-                break
-            }
-        }
-        if len(ps.Subscribers[channel]) == 0 {
-            delete(ps.Subscribers, channel)
-        }
-    }
-}
\ No newline at end of file
+	if subscribers, ok := ps.Subscribers[channel]; ok {
+		for i, subscriber := range subscribers {
+			if subscriber.Client == sub.Client {
+				ps.Subscribers[channel] = append(subscribers[:i], subscribers[i+1:]...)
+				break
+			}
+		}
+		if len(ps.Subscribers[channel]) == 0 {
+			delete(ps.Subscribers, channel)
+		}
+	}
+}
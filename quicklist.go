@@ -0,0 +1,207 @@
+package main
+
+// quicklistChunkSize is the number of elements a quicklist chunk holds.
+const quicklistChunkSize = 128
+
+// quicklist is the storage of a list: a deque made of fixed size chunks, so
+// that pushing and popping at either end is O(1) and never moves the other
+// elements, and memory is released chunk by chunk as elements are popped.
+//
+// Every chunk but the first is filled from its start and every chunk but
+// the last up to its end, which keeps access by index O(1) as well.
+// Operations in the middle of the list (LINSERT, LREM) rebuild it.
+type quicklist struct {
+	// chunks[head:] are in use; the free slots before head let chunks be
+	// added in front without moving the others every time.
+	chunks []*quicklistChunk
+	head   int
+	length int
+}
+
+// quicklistChunk holds the elements items[start:end].
+type quicklistChunk struct {
+	items      [quicklistChunkSize]string
+	start, end int
+}
+
+func newQuicklist() *quicklist {
+	return &quicklist{}
+}
+
+// newQuicklistFrom returns a list holding items, in order.
+func newQuicklistFrom(items []string) *quicklist {
+	ql := newQuicklist()
+	for _, item := range items {
+		ql.PushBack(item)
+	}
+	return ql
+}
+
+func (ql *quicklist) Len() int {
+	return ql.length
+}
+
+func (ql *quicklist) first() *quicklistChunk {
+	return ql.chunks[ql.head]
+}
+
+func (ql *quicklist) last() *quicklistChunk {
+	return ql.chunks[len(ql.chunks)-1]
+}
+
+func (ql *quicklist) PushFront(value string) {
+	if ql.length == 0 || ql.first().start == 0 {
+		if ql.head == 0 {
+			ql.grow()
+		}
+		ql.head--
+		ql.chunks[ql.head] = &quicklistChunk{start: quicklistChunkSize, end: quicklistChunkSize}
+	}
+	c := ql.first()
+	c.start--
+	c.items[c.start] = value
+	ql.length++
+}
+
+func (ql *quicklist) PushBack(value string) {
+	if ql.length == 0 || ql.last().end == quicklistChunkSize {
+		ql.chunks = append(ql.chunks, &quicklistChunk{})
+	}
+	c := ql.last()
+	c.items[c.end] = value
+	c.end++
+	ql.length++
+}
+
+// grow makes room for chunks in front of the first one, as many as there
+// are chunks in use, so that pushes in front are amortized O(1).
+func (ql *quicklist) grow() {
+	used := ql.chunks[ql.head:]
+	room := max(len(used), 1)
+	chunks := make([]*quicklistChunk, room+len(used), room+cap(used))
+	copy(chunks[room:], used)
+	ql.chunks, ql.head = chunks, room
+}
+
+// PopFront removes and returns the first element. The list must not be
+// empty.
+func (ql *quicklist) PopFront() string {
+	c := ql.first()
+	value := c.items[c.start]
+	c.items[c.start] = ""
+	c.start++
+	ql.length--
+	if c.start == c.end {
+		ql.chunks[ql.head] = nil
+		ql.head++
+		ql.shrink()
+	}
+	return value
+}
+
+// PopBack removes and returns the last element. The list must not be empty.
+func (ql *quicklist) PopBack() string {
+	c := ql.last()
+	c.end--
+	value := c.items[c.end]
+	c.items[c.end] = ""
+	ql.length--
+	if c.start == c.end {
+		ql.chunks[len(ql.chunks)-1] = nil
+		ql.chunks = ql.chunks[:len(ql.chunks)-1]
+		ql.shrink()
+	}
+	return value
+}
+
+// shrink releases the chunk index once the list is empty, or when it uses
+// a small part of it.
+func (ql *quicklist) shrink() {
+	used := len(ql.chunks) - ql.head
+	if used == 0 {
+		ql.chunks, ql.head = nil, 0
+	} else if used*4 < cap(ql.chunks) && cap(ql.chunks) > 16 {
+		ql.chunks, ql.head = append([]*quicklistChunk(nil), ql.chunks[ql.head:]...), 0
+	}
+}
+
+// locate returns the chunk and slot of the element at index, which must be
+// in range.
+func (ql *quicklist) locate(index int) (*quicklistChunk, int) {
+	c := ql.first()
+	n := c.end - c.start
+	if index < n {
+		return c, c.start + index
+	}
+	index -= n
+	return ql.chunks[ql.head+1+index/quicklistChunkSize], index % quicklistChunkSize
+}
+
+// Index returns the element at index, which must be in range.
+func (ql *quicklist) Index(index int) string {
+	c, i := ql.locate(index)
+	return c.items[i]
+}
+
+// Set replaces the element at index, which must be in range.
+func (ql *quicklist) Set(index int, value string) {
+	c, i := ql.locate(index)
+	c.items[i] = value
+}
+
+// Range returns the elements from index from up to, but excluding, to.
+func (ql *quicklist) Range(from, to int) []string {
+	items := make([]string, 0, to-from)
+	for i := from; i < to; {
+		c, j := ql.locate(i)
+		n := min(c.end-j, to-i)
+		items = append(items, c.items[j:j+n]...)
+		i += n
+	}
+	return items
+}
+
+// Slice returns all the elements.
+func (ql *quicklist) Slice() []string {
+	return ql.Range(0, ql.length)
+}
+
+// Trim keeps only the elements from index from up to, but excluding, to.
+func (ql *quicklist) Trim(from, to int) {
+	for n := ql.length - to; n > 0; n-- {
+		ql.PopBack()
+	}
+	for ; from > 0; from-- {
+		ql.PopFront()
+	}
+}
+
+// Reset replaces the elements of the list with items.
+func (ql *quicklist) Reset(items []string) {
+	*ql = *newQuicklistFrom(items)
+}
+
+// Insert adds value before the element at index, or at the end when index
+// is the length of the list.
+func (ql *quicklist) Insert(index int, value string) {
+	switch index {
+	case 0:
+		ql.PushFront(value)
+	case ql.length:
+		ql.PushBack(value)
+	default:
+		items := ql.Slice()
+		items = append(items[:index:index], append([]string{value}, items[index:]...)...)
+		ql.Reset(items)
+	}
+}
+
+// copy returns an independent copy of the list.
+func (ql *quicklist) copy() *quicklist {
+	c := &quicklist{chunks: make([]*quicklistChunk, len(ql.chunks)-ql.head), length: ql.length}
+	for i, chunk := range ql.chunks[ql.head:] {
+		dup := *chunk
+		c.chunks[i] = &dup
+	}
+	return c
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// checkQuicklist compares every way of reading ql with the reference slice.
+func checkQuicklist(t *testing.T, ql *quicklist, want []string) {
+	t.Helper()
+	if ql.Len() != len(want) {
+		t.Fatalf("Len() = %d, want %d", ql.Len(), len(want))
+	}
+	if got := ql.Slice(); !slices.Equal(got, want) {
+		t.Fatalf("Slice() = %v, want %v", got, want)
+	}
+	for i, w := range want {
+		if got := ql.Index(i); got != w {
+			t.Fatalf("Index(%d) = %q, want %q", i, got, w)
+		}
+	}
+}
+
+// quicklistOp applies the same change to a quicklist and to its reference
+// slice.
+type quicklistOp func(t *testing.T, ql *quicklist, ref []string) []string
+
+func pushFront(n int) quicklistOp {
+	return func(t *testing.T, ql *quicklist, ref []string) []string {
+		for i := 0; i < n; i++ {
+			v := "f" + strconv.Itoa(len(ref))
+			ql.PushFront(v)
+			ref = append([]string{v}, ref...)
+		}
+		return ref
+	}
+}
+
+func pushBack(n int) quicklistOp {
+	return func(t *testing.T, ql *quicklist, ref []string) []string {
+		for i := 0; i < n; i++ {
+			v := "b" + strconv.Itoa(len(ref))
+			ql.PushBack(v)
+			ref = append(ref, v)
+		}
+		return ref
+	}
+}
+
+func popFront(n int) quicklistOp {
+	return func(t *testing.T, ql *quicklist, ref []string) []string {
+		for i := 0; i < n; i++ {
+			if got := ql.PopFront(); got != ref[0] {
+				t.Fatalf("PopFront() = %q, want %q", got, ref[0])
+			}
+			ref = ref[1:]
+		}
+		return ref
+	}
+}
+
+func popBack(n int) quicklistOp {
+	return func(t *testing.T, ql *quicklist, ref []string) []string {
+		for i := 0; i < n; i++ {
+			if got := ql.PopBack(); got != ref[len(ref)-1] {
+				t.Fatalf("PopBack() = %q, want %q", got, ref[len(ref)-1])
+			}
+			ref = ref[:len(ref)-1]
+		}
+		return ref
+	}
+}
+
+func insertAt(index int) quicklistOp {
+	return func(t *testing.T, ql *quicklist, ref []string) []string {
+		v := "i" + strconv.Itoa(index)
+		ql.Insert(index, v)
+		return slices.Insert(ref, index, v)
+	}
+}
+
+func setAt(index int) quicklistOp {
+	return func(t *testing.T, ql *quicklist, ref []string) []string {
+		v := "s" + strconv.Itoa(index)
+		ql.Set(index, v)
+		ref[index] = v
+		return ref
+	}
+}
+
+func TestQuicklist(t *testing.T) {
+	const c = quicklistChunkSize
+	tests := []struct {
+		name string
+		ops  []quicklistOp
+	}{
+		{"push back", []quicklistOp{pushBack(3*c + 1)}},
+		{"push front", []quicklistOp{pushFront(3*c + 1)}},
+		{"push both ends", []quicklistOp{pushFront(c + 5), pushBack(2 * c), pushFront(c)}},
+		{"queue", []quicklistOp{pushBack(3 * c), popFront(2*c + 1), pushBack(c)}},
+		{"reverse queue", []quicklistOp{pushFront(3 * c), popBack(2*c + 1), pushFront(c)}},
+		{"pop front across chunks", []quicklistOp{pushFront(5), pushBack(2 * c), popFront(c + 10)}},
+		{"pop back across chunks", []quicklistOp{pushFront(c + 5), pushBack(5), popBack(c)}},
+		{"empty and refill from front", []quicklistOp{pushBack(2 * c), popFront(2 * c), pushFront(c + 1)}},
+		{"empty and refill from back", []quicklistOp{pushFront(2 * c), popBack(2 * c), pushBack(c + 1)}},
+		{"shrink chunk index", []quicklistOp{pushFront(40 * c), popFront(39 * c), pushBack(c), popBack(c)}},
+		{"insert at chunk edges", []quicklistOp{
+			pushFront(5), pushBack(2 * c),
+			insertAt(0), insertAt(6), insertAt(5 + c + 1), insertAt(c), insertAt(2*c + 9),
+		}},
+		{"insert in front chunk", []quicklistOp{pushFront(3), pushBack(c), insertAt(2), insertAt(1)}},
+		{"set across chunks", []quicklistOp{pushFront(7), pushBack(2 * c), setAt(0), setAt(6), setAt(7), setAt(c + 7), setAt(2*c + 6)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ql := newQuicklist()
+			var ref []string
+			for _, op := range tt.ops {
+				ref = op(t, ql, ref)
+				checkQuicklist(t, ql, ref)
+			}
+		})
+	}
+}
+
+// newTestLists returns a quicklist of n elements whose first chunk is only
+// partly filled, and the same elements as a slice.
+func newTestLists(n int) (*quicklist, []string) {
+	ref := make([]string, n)
+	for i := range ref {
+		ref[i] = strconv.Itoa(i)
+	}
+	ql := newQuicklist()
+	for i := n/3 - 1; i >= 0; i-- {
+		ql.PushFront(ref[i])
+	}
+	for _, v := range ref[n/3:] {
+		ql.PushBack(v)
+	}
+	return ql, ref
+}
+
+func TestQuicklistRange(t *testing.T) {
+	const n = 3*quicklistChunkSize + 17
+	tests := []struct {
+		start, stop int
+	}{
+		{0, -1},
+		{0, 0},
+		{-1, -1},
+		{-10, -1},
+		{-n, -n},
+		{-n - 100, 5},
+		{5, 2},
+		{-2, -5},
+		{n, n + 10},
+		{quicklistChunkSize - 1, quicklistChunkSize},
+		{quicklistChunkSize, -quicklistChunkSize - 1},
+		{-2 * quicklistChunkSize, n * 2},
+	}
+	for _, tt := range tests {
+		ql, ref := newTestLists(n)
+		from, to := listRange(tt.start, tt.stop, n)
+		if got := ql.Range(from, to); !slices.Equal(got, ref[from:to]) {
+			t.Errorf("Range of [%d, %d] = %v, want %v", tt.start, tt.stop, got, ref[from:to])
+		}
+		ql.Trim(from, to)
+		checkQuicklist(t, ql, ref[from:to])
+	}
+}
+
+func TestQuicklistCopy(t *testing.T) {
+	ql, ref := newTestLists(2*quicklistChunkSize + 3)
+	c := ql.copy()
+	ql.Set(0, "changed")
+	ql.PopBack()
+	ql.PushFront("new")
+	checkQuicklist(t, c, ref)
+}
+
+// The benchmarks compare quicklist with the slice based lists it replaced,
+// where LPUSH prepended by copying the whole list and LPOP resliced it.
+
+func slicePushFront(list []string, value string) []string {
+	return append([]string{value}, list...)
+}
+
+func slicePopFront(list []string) (string, []string) {
+	return list[0], list[1:]
+}
+
+var benchmarkSizes = []int{1000, 10000, 100000}
+
+func BenchmarkPushFront(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		if n > 10000 {
+			// The slice version is quadratic; 100000 pushes take minutes.
+			continue
+		}
+		b.Run(fmt.Sprintf("slice/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var list []string
+				for j := 0; j < n; j++ {
+					list = slicePushFront(list, "element")
+				}
+			}
+		})
+	}
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("quicklist/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ql := newQuicklist()
+				for j := 0; j < n; j++ {
+					ql.PushFront("element")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPushBack(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("slice/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var list []string
+				for j := 0; j < n; j++ {
+					list = append(list, "element")
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("quicklist/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ql := newQuicklist()
+				for j := 0; j < n; j++ {
+					ql.PushBack("element")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkQueue pushes and pops n elements at opposite ends, the way a job
+// queue uses RPUSH and LPOP.
+func BenchmarkQueue(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("slice/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var list []string
+				for j := 0; j < n; j++ {
+					list = append(list, "element")
+				}
+				for len(list) > 0 {
+					_, list = slicePopFront(list)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("quicklist/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ql := newQuicklist()
+				for j := 0; j < n; j++ {
+					ql.PushBack("element")
+				}
+				for ql.Len() > 0 {
+					ql.PopFront()
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkIndex(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		list := make([]string, n)
+		ql := newQuicklist()
+		for j := 0; j < n; j++ {
+			list[j] = strconv.Itoa(j)
+			if j%2 == 0 {
+				ql.PushBack(list[j])
+			} else {
+				ql.PushFront(list[j])
+			}
+		}
+		b.Run(fmt.Sprintf("slice/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = list[(i*7919)%n]
+			}
+		})
+		b.Run(fmt.Sprintf("quicklist/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = ql.Index((i * 7919) % n)
+			}
+		})
+	}
+}
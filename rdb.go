@@ -0,0 +1,907 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+// rdbVersion is the version of the RDB format written by this server.
+const rdbVersion = 9
+
+// rdbMaxLoadVersion is the newest RDB format version we can read, the one
+// written by Redis 7.4.
+const rdbMaxLoadVersion = 12
+
+// RDB opcodes
+const (
+	rdbOpcodeSlotInfo      = 0xF4
+	rdbOpcodeFunction2     = 0xF5
+	rdbOpcodeFunctionPreGA = 0xF6
+	rdbOpcodeModuleAux     = 0xF7
+	rdbOpcodeIdle          = 0xF8
+	rdbOpcodeFreq          = 0xF9
+	rdbOpcodeAux           = 0xFA
+	rdbOpcodeResizeDB      = 0xFB
+	rdbOpcodeExpireTimeMs  = 0xFC
+	rdbOpcodeExpireTime    = 0xFD
+	rdbOpcodeSelectDB      = 0xFE
+	rdbOpcodeEOF           = 0xFF
+)
+
+// RDB object types
+const (
+	rdbTypeString = 0
+	rdbTypeList   = 1
+	rdbTypeSet    = 2
+	rdbTypeZSet   = 3
+	rdbTypeHash   = 4
+	rdbTypeZSet2  = 5
+
+	// Encoded types written by real Redis, which we only read.
+	rdbTypeModulePreGA         = 6
+	rdbTypeModule2             = 7
+	rdbTypeHashZipmap          = 9
+	rdbTypeListZiplist         = 10
+	rdbTypeSetIntset           = 11
+	rdbTypeZSetZiplist         = 12
+	rdbTypeHashZiplist         = 13
+	rdbTypeListQuicklist       = 14
+	rdbTypeStreamListpacks     = 15
+	rdbTypeHashListpack        = 16
+	rdbTypeZSetListpack        = 17
+	rdbTypeListQuicklist2      = 18
+	rdbTypeStreamListpacks2    = 19
+	rdbTypeSetListpack         = 20
+	rdbTypeStreamListpacks3    = 21
+	rdbTypeHashMetadataPreGA   = 22
+	rdbTypeHashListpackExPreGA = 23
+	rdbTypeHashMetadata        = 24
+	rdbTypeHashListpackEx      = 25
+)
+
+// Quicklist node containers
+const (
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+// rdbUnsupportedTypes names the RDB types we recognise but cannot load.
+var rdbUnsupportedTypes = map[byte]string{
+	rdbTypeModulePreGA:         "module",
+	rdbTypeModule2:             "module",
+	rdbTypeStreamListpacks:     "stream",
+	rdbTypeStreamListpacks2:    "stream",
+	rdbTypeStreamListpacks3:    "stream",
+	rdbTypeHashMetadataPreGA:   "hash with field expiration",
+	rdbTypeHashListpackExPreGA: "hash with field expiration",
+	rdbTypeHashMetadata:        "hash with field expiration",
+	rdbTypeHashListpackEx:      "hash with field expiration",
+}
+
+// Length encodings. The two most significant bits of the first byte select
+// a 6 bit, 14 bit or 32/64 bit length, or a specially encoded string.
+const (
+	rdb6BitLen  = 0
+	rdb14BitLen = 1
+	rdb32BitLen = 0x80
+	rdb64BitLen = 0x81
+	rdbEncVal   = 3
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// crcTable is CRC-64/Jones, the checksum used by RDB files, in the
+// reflected form expected by hash/crc64.
+var crcTable = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+// crc64Update extends crc over p. Unlike crc64.Update, Redis does not
+// invert the checksum before and after each update.
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crcTable, p)
+}
+
+// rdbWriter encodes RDB data, keeping a running checksum of all bytes written.
+type rdbWriter struct {
+	w   io.Writer
+	crc uint64
+}
+
+func newRDBWriter(w io.Writer) *rdbWriter {
+	return &rdbWriter{w: w}
+}
+
+func (e *rdbWriter) write(p []byte) error {
+	e.crc = crc64Update(e.crc, p)
+	_, err := e.w.Write(p)
+	return err
+}
+
+func (e *rdbWriter) writeByte(b byte) error {
+	return e.write([]byte{b})
+}
+
+func (e *rdbWriter) writeLength(n uint64) error {
+	switch {
+	case n < 1<<6:
+		return e.writeByte(byte(n))
+	case n < 1<<14:
+		return e.write([]byte{byte(n>>8) | rdb14BitLen<<6, byte(n)})
+	case n <= math.MaxUint32:
+		buf := []byte{rdb32BitLen, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		return e.write(buf)
+	default:
+		buf := []byte{rdb64BitLen, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(buf[1:], n)
+		return e.write(buf)
+	}
+}
+
+// writeString writes a length-prefixed string, using the compact integer
+// encoding when s is the canonical form of a small integer.
+func (e *rdbWriter) writeString(s string) error {
+	if len(s) <= 11 {
+		if n, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(n, 10) == s {
+			switch {
+			case n >= math.MinInt8 && n <= math.MaxInt8:
+				return e.write([]byte{rdbEncVal<<6 | rdbEncInt8, byte(n)})
+			case n >= math.MinInt16 && n <= math.MaxInt16:
+				buf := []byte{rdbEncVal<<6 | rdbEncInt16, 0, 0}
+				binary.LittleEndian.PutUint16(buf[1:], uint16(n))
+				return e.write(buf)
+			default:
+				buf := []byte{rdbEncVal<<6 | rdbEncInt32, 0, 0, 0, 0}
+				binary.LittleEndian.PutUint32(buf[1:], uint32(n))
+				return e.write(buf)
+			}
+		}
+	}
+	if err := e.writeLength(uint64(len(s))); err != nil {
+		return err
+	}
+	return e.write([]byte(s))
+}
+
+func (e *rdbWriter) writeDouble(d float64) error {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(d))
+	return e.write(buf)
+}
+
+func (e *rdbWriter) writeAux(key, value string) error {
+	if err := e.writeByte(rdbOpcodeAux); err != nil {
+		return err
+	}
+	if err := e.writeString(key); err != nil {
+		return err
+	}
+	return e.writeString(value)
+}
+
+// rdbObjectType returns the RDB type used to save obj.
+func rdbObjectType(obj *Object) (byte, error) {
+	switch obj.Type {
+	case TypeString:
+		return rdbTypeString, nil
+	case TypeList:
+		return rdbTypeList, nil
+	case TypeSet:
+		return rdbTypeSet, nil
+	case TypeZSet:
+		return rdbTypeZSet2, nil
+	case TypeHash:
+		return rdbTypeHash, nil
+	}
+	return 0, fmt.Errorf("unknown type %q", obj.Type)
+}
+
+// writeObject writes the value of obj, without its type byte.
+func (e *rdbWriter) writeObject(obj *Object) error {
+	switch obj.Type {
+	case TypeString:
+		return e.writeString(obj.Str)
+	case TypeList:
+		if err := e.writeLength(uint64(obj.List.Len())); err != nil {
+			return err
+		}
+		for _, elem := range obj.List.Slice() {
+			if err := e.writeString(elem); err != nil {
+				return err
+			}
+		}
+	case TypeSet:
+		if err := e.writeLength(uint64(len(obj.Set))); err != nil {
+			return err
+		}
+		for member := range obj.Set {
+			if err := e.writeString(member); err != nil {
+				return err
+			}
+		}
+	case TypeZSet:
+		if err := e.writeLength(uint64(len(obj.ZSet))); err != nil {
+			return err
+		}
+		for member, score := range obj.ZSet {
+			if err := e.writeString(member); err != nil {
+				return err
+			}
+			if err := e.writeDouble(score); err != nil {
+				return err
+			}
+		}
+	case TypeHash:
+		if err := e.writeLength(uint64(len(obj.Hash))); err != nil {
+			return err
+		}
+		for field, value := range obj.Hash {
+			if err := e.writeString(field); err != nil {
+				return err
+			}
+			if err := e.writeString(value); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown type %q", obj.Type)
+	}
+	return nil
+}
+
+// writeKey writes a key with its type and optional expiry.
+func (e *rdbWriter) writeKey(key string, obj *Object, expireAt time.Time, hasExpire bool) error {
+	typ, err := rdbObjectType(obj)
+	if err != nil {
+		return err
+	}
+	if hasExpire {
+		buf := []byte{rdbOpcodeExpireTimeMs, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(buf[1:], uint64(expireAt.UnixMilli()))
+		if err := e.write(buf); err != nil {
+			return err
+		}
+	}
+	if err := e.writeByte(typ); err != nil {
+		return err
+	}
+	if err := e.writeString(key); err != nil {
+		return err
+	}
+	return e.writeObject(obj)
+}
+
+// writeRDB writes the live keys of kv to w as an RDB file. The caller must
+// hold the store lock.
+func writeRDB(w io.Writer, kv *KeyValueStore) error {
+	e := newRDBWriter(w)
+	if err := e.write([]byte(fmt.Sprintf("REDIS%04d", rdbVersion))); err != nil {
+		return err
+	}
+	aux := [][2]string{
+		{"redis-ver", serverVersion},
+		{"redis-bits", strconv.Itoa(strconv.IntSize)},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+		{"aof-base", "0"},
+	}
+	for _, field := range aux {
+		if err := e.writeAux(field[0], field[1]); err != nil {
+			return err
+		}
+	}
+
+	if err := e.writeByte(rdbOpcodeSelectDB); err != nil {
+		return err
+	}
+	if err := e.writeLength(0); err != nil {
+		return err
+	}
+	if err := e.writeByte(rdbOpcodeResizeDB); err != nil {
+		return err
+	}
+	if err := e.writeLength(uint64(len(kv.Keys))); err != nil {
+		return err
+	}
+	if err := e.writeLength(uint64(len(kv.Expirations))); err != nil {
+		return err
+	}
+
+	for key, obj := range kv.Keys {
+		if kv.isExpired(key) {
+			continue
+		}
+		when, hasExpire := kv.Expirations[key]
+		if err := e.writeKey(key, obj, when, hasExpire); err != nil {
+			return fmt.Errorf("failed to write key %q: %v", key, err)
+		}
+	}
+
+	if err := e.writeByte(rdbOpcodeEOF); err != nil {
+		return err
+	}
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, e.crc)
+	_, err := e.w.Write(checksum)
+	return err
+}
+
+// rdbReader decodes RDB data, keeping a running checksum of all bytes read.
+type rdbReader struct {
+	r   *bufio.Reader
+	crc uint64
+	// remaining is the number of bytes left in the input. Lengths read from
+	// the data are checked against it before anything is allocated, so
+	// corrupt data fails the load instead of exhausting memory.
+	remaining uint64
+}
+
+// newRDBReader returns a reader for the size bytes of RDB data in r.
+func newRDBReader(r io.Reader, size int64) *rdbReader {
+	return &rdbReader{r: bufio.NewReader(r), remaining: uint64(max(size, 0))}
+}
+
+var errRDBTruncated = errors.New("unexpected end of file")
+
+func (d *rdbReader) read(n uint64) ([]byte, error) {
+	if n > d.remaining {
+		return nil, errRDBTruncated
+	}
+	d.remaining -= n
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errRDBTruncated
+		}
+		return nil, err
+	}
+	d.crc = crc64Update(d.crc, buf)
+	return buf, nil
+}
+
+func (d *rdbReader) readByte() (byte, error) {
+	buf, err := d.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+// readLength reads a length. If encoded is set, the value is instead one of
+// the special string encodings (rdbEncInt8 ... rdbEncLZF).
+func (d *rdbReader) readLength() (n uint64, encoded bool, err error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case rdb6BitLen:
+		return uint64(b & 0x3F), false, nil
+	case rdb14BitLen:
+		next, err := d.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3F)<<8 | uint64(next), false, nil
+	case rdbEncVal:
+		return uint64(b & 0x3F), true, nil
+	}
+	switch b {
+	case rdb32BitLen:
+		buf, err := d.read(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case rdb64BitLen:
+		buf, err := d.read(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	}
+	return 0, false, fmt.Errorf("unknown length encoding 0x%02x", b)
+}
+
+// readLen reads a length that may not be a special string encoding.
+func (d *rdbReader) readLen() (uint64, error) {
+	n, encoded, err := d.readLength()
+	if err == nil && encoded {
+		err = fmt.Errorf("unexpected string encoding %d for a length", n)
+	}
+	return n, err
+}
+
+func (d *rdbReader) readString() (string, error) {
+	n, encoded, err := d.readLength()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		buf, err := d.read(n)
+		return string(buf), err
+	}
+	switch n {
+	case rdbEncInt8:
+		b, err := d.readByte()
+		return strconv.Itoa(int(int8(b))), err
+	case rdbEncInt16:
+		buf, err := d.read(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), nil
+	case rdbEncInt32:
+		buf, err := d.read(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), nil
+	case rdbEncLZF:
+		compressedLen, err := d.readLen()
+		if err != nil {
+			return "", err
+		}
+		length, err := d.readLen()
+		if err != nil {
+			return "", err
+		}
+		compressed, err := d.read(compressedLen)
+		if err != nil {
+			return "", err
+		}
+		buf, err := lzfDecompress(compressed, int(length))
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress LZF string: %v", err)
+		}
+		return string(buf), nil
+	}
+	return "", fmt.Errorf("unsupported string encoding %d", n)
+}
+
+func (d *rdbReader) readDouble() (float64, error) {
+	buf, err := d.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// readTextDouble reads a score in the string form used by the old zset type.
+func (d *rdbReader) readTextDouble() (float64, error) {
+	n, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := d.read(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	return redisprotocol.ParseDouble(string(buf))
+}
+
+// readStrings reads a length-prefixed sequence of strings.
+func (d *rdbReader) readStrings() ([]string, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]string, 0, min(n, 1024))
+	for i := uint64(0); i < n; i++ {
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, s)
+	}
+	return items, nil
+}
+
+// readObject reads a value of the given RDB type.
+func (d *rdbReader) readObject(typ byte) (*Object, error) {
+	switch typ {
+	case rdbTypeString:
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		return &Object{Type: TypeString, Str: s}, nil
+	case rdbTypeList:
+		items, err := d.readStrings()
+		if err != nil {
+			return nil, err
+		}
+		obj := newObject(TypeList)
+		obj.List = newQuicklistFrom(items)
+		return obj, nil
+	case rdbTypeSet:
+		items, err := d.readStrings()
+		if err != nil {
+			return nil, err
+		}
+		obj := newObject(TypeSet)
+		for _, member := range items {
+			obj.Set[member] = struct{}{}
+		}
+		return obj, nil
+	case rdbTypeZSet, rdbTypeZSet2:
+		n, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		obj := newObject(TypeZSet)
+		for i := uint64(0); i < n; i++ {
+			member, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if typ == rdbTypeZSet2 {
+				score, err = d.readDouble()
+			} else {
+				score, err = d.readTextDouble()
+			}
+			if err != nil {
+				return nil, err
+			}
+			obj.ZSet[member] = score
+		}
+		return obj, nil
+	case rdbTypeHash:
+		n, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		obj := newObject(TypeHash)
+		for i := uint64(0); i < n; i++ {
+			field, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			obj.Hash[field] = value
+		}
+		return obj, nil
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		return d.readQuicklist(typ)
+	}
+
+	// The remaining types store the whole value in a single encoded blob.
+	blob, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case rdbTypeHashZipmap:
+		entries, err := zipmapEntries([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		return pairsToHash(entries)
+	case rdbTypeListZiplist:
+		entries, err := ziplistEntries([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		obj := newObject(TypeList)
+		obj.List = newQuicklistFrom(entries)
+		return obj, nil
+	case rdbTypeSetIntset, rdbTypeSetListpack:
+		var entries []string
+		if typ == rdbTypeSetIntset {
+			entries, err = intsetEntries([]byte(blob))
+		} else {
+			entries, err = listpackEntries([]byte(blob))
+		}
+		if err != nil {
+			return nil, err
+		}
+		obj := newObject(TypeSet)
+		for _, member := range entries {
+			obj.Set[member] = struct{}{}
+		}
+		return obj, nil
+	case rdbTypeZSetZiplist, rdbTypeZSetListpack:
+		entries, err := d.packedEntries(typ == rdbTypeZSetZiplist, blob)
+		if err != nil {
+			return nil, err
+		}
+		return pairsToZSet(entries)
+	case rdbTypeHashZiplist, rdbTypeHashListpack:
+		entries, err := d.packedEntries(typ == rdbTypeHashZiplist, blob)
+		if err != nil {
+			return nil, err
+		}
+		return pairsToHash(entries)
+	}
+	return nil, fmt.Errorf("unsupported object type %d", typ)
+}
+
+func (d *rdbReader) packedEntries(ziplist bool, blob string) ([]string, error) {
+	if ziplist {
+		return ziplistEntries([]byte(blob))
+	}
+	return listpackEntries([]byte(blob))
+}
+
+// readQuicklist reads a list saved as a sequence of ziplist nodes, or for
+// quicklist 2 of listpack and plain nodes.
+func (d *rdbReader) readQuicklist(typ byte) (*Object, error) {
+	nodes, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	obj := newObject(TypeList)
+	for i := uint64(0); i < nodes; i++ {
+		container := uint64(quicklistNodePacked)
+		if typ == rdbTypeListQuicklist2 {
+			if container, err = d.readLen(); err != nil {
+				return nil, err
+			}
+		}
+		blob, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		var entries []string
+		switch {
+		case container == quicklistNodePlain:
+			entries = []string{blob}
+		case container != quicklistNodePacked:
+			return nil, fmt.Errorf("unknown quicklist node container %d", container)
+		case typ == rdbTypeListQuicklist:
+			entries, err = ziplistEntries([]byte(blob))
+		default:
+			entries, err = listpackEntries([]byte(blob))
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			obj.List.PushBack(entry)
+		}
+	}
+	return obj, nil
+}
+
+// readRDB loads the keys of the size bytes of RDB data in r into kv. Keys
+// that have already expired are skipped, as are keys of databases other than
+// 0 since we have a single keyspace. Types we cannot represent, such as
+// streams, fail the load with an error naming the key.
+func readRDB(r io.Reader, size int64, kv *KeyValueStore) error {
+	d := newRDBReader(r, size)
+	header, err := d.read(9)
+	if err != nil {
+		return err
+	}
+	if string(header[:5]) != "REDIS" {
+		return errors.New("wrong signature, not an RDB file")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > rdbMaxLoadVersion {
+		return fmt.Errorf("can't handle RDB format version %s", header[5:])
+	}
+
+	var expireAt time.Time
+	hasExpire := false
+	db := uint64(0)
+	skipped := 0
+	for {
+		typ, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case rdbOpcodeExpireTimeMs:
+			buf, err := d.read(8)
+			if err != nil {
+				return err
+			}
+			expireAt, hasExpire = time.UnixMilli(int64(binary.LittleEndian.Uint64(buf))), true
+			continue
+		case rdbOpcodeExpireTime:
+			buf, err := d.read(4)
+			if err != nil {
+				return err
+			}
+			expireAt, hasExpire = time.Unix(int64(binary.LittleEndian.Uint32(buf)), 0), true
+			continue
+		case rdbOpcodeAux:
+			if _, err := d.readString(); err != nil {
+				return err
+			}
+			if _, err := d.readString(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpcodeSelectDB:
+			if db, err = d.readLen(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpcodeResizeDB:
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpcodeSlotInfo:
+			// Slot id, keys in the slot and expiring keys in the slot.
+			for i := 0; i < 3; i++ {
+				if _, err := d.readLen(); err != nil {
+					return err
+				}
+			}
+			continue
+		case rdbOpcodeIdle:
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpcodeFreq:
+			if _, err := d.readByte(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpcodeFunction2:
+			if _, err := d.readString(); err != nil {
+				return err
+			}
+			fmt.Println("Warning: ignoring function library stored in the RDB file")
+			continue
+		case rdbOpcodeFunctionPreGA:
+			return errors.New("can't load functions saved by a pre-release Redis 7.0")
+		case rdbOpcodeModuleAux:
+			return errors.New("can't load module data, modules are not supported")
+		case rdbOpcodeEOF:
+			if skipped > 0 {
+				fmt.Printf("Warning: skipped %d keys stored in databases other than 0\n", skipped)
+			}
+			return d.verifyChecksum(version)
+		}
+
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if name, ok := rdbUnsupportedTypes[typ]; ok {
+			return fmt.Errorf("key %q has unsupported type %s (RDB type %d)", key, name, typ)
+		}
+		obj, err := d.readObject(typ)
+		if err != nil {
+			return fmt.Errorf("failed to read key %q: %v", key, err)
+		}
+		// Empty collections can't exist in the keyspace, so they are dropped.
+		empty := obj.Type != TypeString && obj.Len() == 0
+		if db != 0 {
+			skipped++
+		} else if !empty && (!hasExpire || time.Now().Before(expireAt)) {
+			kv.Keys[key] = obj
+			if hasExpire {
+				kv.Expirations[key] = expireAt
+			}
+		}
+		hasExpire = false
+	}
+}
+
+// verifyChecksum reads the CRC64 footer and compares it with the checksum of
+// the data read so far. Files written with checksums disabled store zero.
+func (d *rdbReader) verifyChecksum(version int) error {
+	if version < 5 {
+		return nil
+	}
+	expected := d.crc
+	var buf [8]byte
+	if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+		return errRDBTruncated
+	}
+	stored := binary.LittleEndian.Uint64(buf[:])
+	if stored != 0 && stored != expected {
+		return fmt.Errorf("wrong RDB checksum, expected %016x got %016x", expected, stored)
+	}
+	return nil
+}
+
+// saveRDBFile writes kv to filePath in RDB format and fsyncs it.
+func saveRDBFile(filePath string, kv *KeyValueStore) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	if err := writeRDB(w, kv); err != nil {
+		file.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// loadRDBFile reads the RDB file at filePath into kv. The checksum of the
+// whole file is verified first, so that a corrupt file is rejected before
+// any of it is parsed.
+func loadRDBFile(filePath string, kv *KeyValueStore) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := checkRDBChecksum(file, info.Size()); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return readRDB(file, info.Size(), kv)
+}
+
+// checkRDBChecksum compares the CRC64 footer of the size bytes of RDB data
+// in r with the checksum of the data before it. Files older than version 5
+// have no footer, and files written with checksums disabled store zero.
+func checkRDBChecksum(r io.Reader, size int64) error {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return errRDBTruncated
+	}
+	if version, err := strconv.Atoi(string(header[5:])); err != nil || version < 5 {
+		// Not an RDB file, or one without a checksum: readRDB decides.
+		return nil
+	}
+	if size < 9+8 {
+		return errRDBTruncated
+	}
+	crc := crc64Update(0, header)
+	buf := make([]byte, 64*1024)
+	for left := size - 9 - 8; left > 0; {
+		n, err := io.ReadFull(r, buf[:min(int64(len(buf)), left)])
+		if err != nil {
+			return errRDBTruncated
+		}
+		crc = crc64Update(crc, buf[:n])
+		left -= int64(n)
+	}
+	if _, err := io.ReadFull(r, buf[:8]); err != nil {
+		return errRDBTruncated
+	}
+	stored := binary.LittleEndian.Uint64(buf[:8])
+	if stored != 0 && stored != crc {
+		return fmt.Errorf("wrong RDB checksum, expected %016x got %016x", crc, stored)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestStore returns a store holding a key of every type, some of them
+// with a TTL.
+func newTestStore() *KeyValueStore {
+	kv := NewKeyValueStore()
+	kv.Keys["str"] = &Object{Type: TypeString, Str: "hello"}
+	kv.Keys["empty"] = &Object{Type: TypeString, Str: ""}
+	kv.Keys["int8"] = &Object{Type: TypeString, Str: "-12"}
+	kv.Keys["int16"] = &Object{Type: TypeString, Str: "3000"}
+	kv.Keys["int32"] = &Object{Type: TypeString, Str: "-2000000000"}
+	kv.Keys["notint"] = &Object{Type: TypeString, Str: "007"}
+	kv.Keys["long"] = &Object{Type: TypeString, Str: strings.Repeat("x", 300)}
+	kv.Keys["binary"] = &Object{Type: TypeString, Str: "\x00\xff\r\n"}
+	list := newObject(TypeList)
+	for i := 0; i < 300; i++ {
+		list.List.PushBack(strings.Repeat("e", i%7))
+	}
+	kv.Keys["list"] = list
+	hash := newObject(TypeHash)
+	hash.Hash["f1"] = "v1"
+	hash.Hash["f2"] = "12"
+	kv.Keys["hash"] = hash
+	set := newObject(TypeSet)
+	set.Set["a"] = struct{}{}
+	set.Set["b"] = struct{}{}
+	kv.Keys["set"] = set
+	zset := newObject(TypeZSet)
+	zset.ZSet["one"] = 1
+	zset.ZSet["half"] = 0.5
+	zset.ZSet["neg"] = -3.25
+	kv.Keys["zset"] = zset
+	kv.Expirations["str"] = time.UnixMilli(4102444800123)
+	kv.Expirations["hash"] = time.UnixMilli(4102444800000)
+	return kv
+}
+
+// encodeTestStore returns the RDB encoding of newTestStore.
+func encodeTestStore(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, newTestStore()); err != nil {
+		t.Fatalf("writeRDB failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// checkSameStore compares the keys and TTLs of two stores.
+func checkSameStore(t *testing.T, got, want *KeyValueStore) {
+	t.Helper()
+	if len(got.Keys) != len(want.Keys) {
+		t.Fatalf("loaded %d keys, want %d", len(got.Keys), len(want.Keys))
+	}
+	for key, w := range want.Keys {
+		g := got.Keys[key]
+		switch {
+		case g == nil:
+			t.Errorf("key %q is missing", key)
+		case g.Type != w.Type:
+			t.Errorf("key %q has type %s, want %s", key, g.Type, w.Type)
+		case g.Str != w.Str:
+			t.Errorf("key %q = %.40q, want %.40q", key, g.Str, w.Str)
+		case w.Type == TypeList && !slices.Equal(g.List.Slice(), w.List.Slice()):
+			t.Errorf("list %q = %q, want %q", key, g.List.Slice(), w.List.Slice())
+		case !maps.Equal(g.Hash, w.Hash) || !maps.Equal(g.Set, w.Set) || !maps.Equal(g.ZSet, w.ZSet):
+			t.Errorf("key %q = %+v, want %+v", key, g, w)
+		}
+	}
+	if !maps.EqualFunc(got.Expirations, want.Expirations, time.Time.Equal) {
+		t.Errorf("expirations = %v, want %v", got.Expirations, want.Expirations)
+	}
+}
+
+func TestRDBRoundTrip(t *testing.T) {
+	want := newTestStore()
+	// Long enough for a 32 bit length.
+	want.Keys["huge"] = &Object{Type: TypeString, Str: strings.Repeat("y", 70000)}
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, want); err != nil {
+		t.Fatalf("writeRDB failed: %v", err)
+	}
+	kv := NewKeyValueStore()
+	if err := readRDB(&buf, int64(buf.Len()), kv); err != nil {
+		t.Fatalf("readRDB failed: %v", err)
+	}
+	checkSameStore(t, kv, want)
+}
+
+func TestRDBSkipsExpiredKeys(t *testing.T) {
+	kv := newTestStore()
+	kv.Expirations["set"] = time.Now().Add(-time.Second)
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, kv); err != nil {
+		t.Fatalf("writeRDB failed: %v", err)
+	}
+	loaded := NewKeyValueStore()
+	if err := readRDB(&buf, int64(buf.Len()), loaded); err != nil {
+		t.Fatalf("readRDB failed: %v", err)
+	}
+	if _, ok := loaded.Keys["set"]; ok {
+		t.Errorf("expired key was saved")
+	}
+	if len(loaded.Keys) != len(kv.Keys)-1 {
+		t.Errorf("loaded %d keys, want %d", len(loaded.Keys), len(kv.Keys)-1)
+	}
+}
+
+// TestRDBTruncated checks that every truncation of a valid file is
+// rejected, including one that only lacks part of the checksum.
+func TestRDBTruncated(t *testing.T) {
+	data := encodeTestStore(t)
+	for n := 0; n < len(data); n++ {
+		if err := readRDB(bytes.NewReader(data[:n]), int64(n), NewKeyValueStore()); err == nil {
+			t.Fatalf("readRDB of the first %d of %d bytes succeeded", n, len(data))
+		}
+	}
+}
+
+// TestRDBCorrupt flips every byte of a valid file in turn. Whatever the
+// parser makes of the result, it must fail rather than panic or load it.
+func TestRDBCorrupt(t *testing.T) {
+	data := encodeTestStore(t)
+	for i := range data {
+		corrupt := bytes.Clone(data)
+		corrupt[i] ^= 0x5a
+		if err := readRDB(bytes.NewReader(corrupt), int64(len(corrupt)), NewKeyValueStore()); err == nil {
+			t.Errorf("readRDB succeeded with byte %d flipped", i)
+		}
+		if i >= 9 {
+			if err := checkRDBChecksum(bytes.NewReader(corrupt), int64(len(corrupt))); err == nil {
+				t.Errorf("checkRDBChecksum succeeded with byte %d flipped", i)
+			}
+		}
+	}
+}
+
+// rdbFile wraps the encoding of a single key in a minimal RDB file.
+func rdbFile(entry []byte) []byte {
+	data := append([]byte("REDIS0009"), entry...)
+	data = append(data, rdbOpcodeEOF)
+	return binary.LittleEndian.AppendUint64(data, crc64Update(0, data))
+}
+
+// TestRDBLengths checks that lengths larger than the file are rejected
+// before anything is allocated for them.
+func TestRDBLengths(t *testing.T) {
+	huge := []byte{0x81, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	tests := map[string][]byte{
+		"key":            append([]byte{rdbTypeString}, huge...),
+		"string":         append([]byte{rdbTypeString, 0x01, 'k'}, huge...),
+		"list":           append([]byte{rdbTypeList, 0x01, 'k'}, huge...),
+		"hash":           append([]byte{rdbTypeHash, 0x01, 'k'}, huge...),
+		"lzf compressed": append([]byte{rdbTypeString, 0x01, 'k', 0xC3}, huge...),
+		"lzf output":     {rdbTypeString, 0x01, 'k', 0xC3, 0x02, 0x81, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x01, 'a', 'a'},
+	}
+	for name, entry := range tests {
+		data := rdbFile(entry)
+		if err := readRDB(bytes.NewReader(data), int64(len(data)), NewKeyValueStore()); err == nil {
+			t.Errorf("readRDB with a huge %s length succeeded", name)
+		}
+	}
+}
+
+// TestRDBLZF loads a string compressed the way Redis does: the literal "a"
+// followed by a back reference repeating it nine times.
+func TestRDBLZF(t *testing.T) {
+	data := rdbFile([]byte{rdbTypeString, 0x01, 'k', 0xC3, 0x05, 0x0a, 0x00, 'a', 0xe0, 0x00, 0x00})
+	kv := NewKeyValueStore()
+	if err := readRDB(bytes.NewReader(data), int64(len(data)), kv); err != nil {
+		t.Fatalf("readRDB failed: %v", err)
+	}
+	if got := kv.Keys["k"]; got == nil || got.Str != "aaaaaaaaaa" {
+		t.Errorf("k = %+v, want aaaaaaaaaa", got)
+	}
+}
+
+func TestRDBFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := saveRDBFile(path, newTestStore()); err != nil {
+		t.Fatalf("saveRDBFile failed: %v", err)
+	}
+	kv := NewKeyValueStore()
+	if err := loadRDBFile(path, kv); err != nil {
+		t.Fatalf("loadRDBFile failed: %v", err)
+	}
+	checkSameStore(t, kv, newTestStore())
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 1
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	kv = NewKeyValueStore()
+	if err := loadRDBFile(path, kv); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("loadRDBFile of a corrupt file error = %v, want a checksum error", err)
+	}
+	if len(kv.Keys) != 0 {
+		t.Errorf("loadRDBFile of a corrupt file loaded %d keys", len(kv.Keys))
+	}
+}
@@ -0,0 +1,172 @@
+package redisprotocol
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+)
+
+// MaxInlineSize bounds the length of a single inline command line.
+const MaxInlineSize = 64 * 1024
+
+// ProtocolError reports a malformed request; the connection should be
+// answered with an error and closed.
+type ProtocolError struct {
+	Msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.Msg
+}
+
+// ReadCommand reads the next client command. Requests starting with '*'
+// are parsed as RESP arrays, anything else as an inline command such as
+// the lines typed into telnet or netcat. Empty inline lines are skipped.
+func (r *Resp) ReadCommand() (Value, error) {
+	for {
+		b, err := r.reader.Peek(1)
+		if err != nil {
+			return Value{}, err
+		}
+		if b[0] == ARRAY {
+			return r.Read()
+		}
+
+		v, err := r.readInline()
+		if err != nil {
+			return v, err
+		}
+		if len(v.Array) > 0 {
+			return v, nil
+		}
+	}
+}
+
+func (r *Resp) readInline() (Value, error) {
+	var line []byte
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > MaxInlineSize {
+			return Value{}, &ProtocolError{Msg: "too big inline request"}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return Value{}, err
+		}
+		break
+	}
+
+	args, err := SplitArgs(strings.TrimRight(string(line), "\r\n"))
+	if err != nil {
+		return Value{}, err
+	}
+	return NewBulkArray(args), nil
+}
+
+// SplitArgs splits an inline command line into arguments using the same
+// rules as redis-cli: arguments are separated by whitespace, double quoted
+// strings support \n, \r, \t, \b, \a and \xHH escapes, and single quoted
+// strings only support \'.
+func SplitArgs(line string) ([]string, error) {
+	args := []string{}
+	p := 0
+	for {
+		for p < len(line) && isSpace(line[p]) {
+			p++
+		}
+		if p >= len(line) {
+			return args, nil
+		}
+
+		var (
+			current  strings.Builder
+			inDouble bool
+			inSingle bool
+			done     bool
+		)
+		for !done {
+			switch {
+			case inDouble:
+				if p >= len(line) {
+					return nil, &ProtocolError{Msg: "unbalanced quotes in request"}
+				}
+				c := line[p]
+				if c == '\\' && p+3 < len(line) && line[p+1] == 'x' && isHex(line[p+2]) && isHex(line[p+3]) {
+					b, _ := strconv.ParseUint(line[p+2:p+4], 16, 8)
+					current.WriteByte(byte(b))
+					p += 3
+				} else if c == '\\' && p+1 < len(line) {
+					p++
+					switch line[p] {
+					case 'n':
+						current.WriteByte('\n')
+					case 'r':
+						current.WriteByte('\r')
+					case 't':
+						current.WriteByte('\t')
+					case 'b':
+						current.WriteByte('\b')
+					case 'a':
+						current.WriteByte('\a')
+					default:
+						current.WriteByte(line[p])
+					}
+				} else if c == '"' {
+					// The closing quote must be followed by a space or the end of the line.
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, &ProtocolError{Msg: "unbalanced quotes in request"}
+					}
+					done = true
+				} else {
+					current.WriteByte(c)
+				}
+			case inSingle:
+				if p >= len(line) {
+					return nil, &ProtocolError{Msg: "unbalanced quotes in request"}
+				}
+				c := line[p]
+				if c == '\\' && p+1 < len(line) && line[p+1] == '\'' {
+					p++
+					current.WriteByte('\'')
+				} else if c == '\'' {
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, &ProtocolError{Msg: "unbalanced quotes in request"}
+					}
+					done = true
+				} else {
+					current.WriteByte(c)
+				}
+			default:
+				if p >= len(line) {
+					done = true
+					break
+				}
+				switch c := line[p]; {
+				case isSpace(c):
+					done = true
+				case c == '"':
+					inDouble = true
+				case c == '\'':
+					inSingle = true
+				default:
+					current.WriteByte(c)
+				}
+			}
+			if p < len(line) {
+				p++
+			}
+		}
+		args = append(args, current.String())
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
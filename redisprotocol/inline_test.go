@@ -0,0 +1,77 @@
+package redisprotocol
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", []string{}},
+		{"   \t ", []string{}},
+		{"PING", []string{"PING"}},
+		{"  set  key   value ", []string{"set", "key", "value"}},
+		{`SET k "hello world"`, []string{"SET", "k", "hello world"}},
+		{`SET k ""`, []string{"SET", "k", ""}},
+		{`SET k "a\nb\tc\\d\"e"`, []string{"SET", "k", "a\nb\tc\\d\"e"}},
+		{`SET k "\x41\x00\xff"`, []string{"SET", "k", "A\x00\xff"}},
+		{`SET k "\xzz"`, []string{"SET", "k", "xzz"}},
+		{`SET k 'it\'s'`, []string{"SET", "k", "it's"}},
+		{`SET k 'no \n escapes'`, []string{"SET", "k", `no \n escapes`}},
+		{`a"b"`, []string{"ab"}},
+	}
+	for _, tt := range tests {
+		got, err := SplitArgs(tt.line)
+		if err != nil {
+			t.Errorf("SplitArgs(%q) failed: %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitArgs(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestSplitArgsUnbalanced(t *testing.T) {
+	for _, line := range []string{`SET k "open`, `SET k 'open`, `SET k "a"b`, `SET k 'a'b`, `"\"`} {
+		_, err := SplitArgs(line)
+		var protoErr *ProtocolError
+		if !errors.As(err, &protoErr) {
+			t.Errorf("SplitArgs(%q) error = %v, want a protocol error", line, err)
+		}
+	}
+}
+
+func TestReadCommandInline(t *testing.T) {
+	// Inline and RESP requests may be mixed on one connection, and empty
+	// inline lines are skipped.
+	r := NewResp(strings.NewReader("\r\nPING\r\n\nSET k \"v 1\"\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\nECHO x"), nil)
+	for _, want := range [][]string{{"PING"}, {"SET", "k", "v 1"}, {"GET", "k"}} {
+		got, err := r.ReadCommand()
+		if err != nil {
+			t.Fatalf("ReadCommand failed: %v", err)
+		}
+		if !reflect.DeepEqual(got, NewBulkArray(want)) {
+			t.Errorf("ReadCommand = %+v, want %q", got, want)
+		}
+	}
+	// A last line without a newline is incomplete.
+	if _, err := r.ReadCommand(); err != io.EOF {
+		t.Errorf("ReadCommand of an unterminated line error = %v, want EOF", err)
+	}
+}
+
+func TestReadCommandInlineTooBig(t *testing.T) {
+	line := "SET k " + strings.Repeat("x", MaxInlineSize) + "\r\n"
+	_, err := NewResp(strings.NewReader(line), nil).ReadCommand()
+	var protoErr *ProtocolError
+	if !errors.As(err, &protoErr) {
+		t.Errorf("ReadCommand of a %d byte line error = %v, want a protocol error", len(line), err)
+	}
+}
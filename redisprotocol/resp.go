@@ -15,26 +15,79 @@ const (
 	ARRAY   = '*'
 )
 
+// RESP3 type bytes
+const (
+	NULL      = '_'
+	BOOLEAN   = '#'
+	DOUBLE    = ','
+	BIGNUMBER = '('
+	BLOBERROR = '!'
+	VERBATIM  = '='
+	MAP       = '%'
+	SET       = '~'
+	ATTRIBUTE = '|'
+	PUSH      = '>'
+)
+
+// MaxBulkLen bounds the length of a bulk string, like proto-max-bulk-len in
+// Redis, so that a bogus length cannot make the reader allocate without
+// limit.
+const MaxBulkLen = 512 * 1024 * 1024
+
+// maxPrealloc bounds the number of elements preallocated for an aggregate
+// from its declared length; larger ones grow as their elements arrive.
+const maxPrealloc = 1024
+
+// Value is a single RESP reply. Map and attribute entries are stored in
+// Array as alternating key/value pairs; a verbatim string keeps its format
+// in Str and its text in Bulk.
 type Value struct {
 	Type   string
 	Str    string
 	Num    int
 	Bulk   string
 	Array  []Value
+	Double float64
+	Bool   bool
+	Attrs  []Value
 }
 
 type Resp struct {
-	reader *bufio.Reader
-	writer io.Writer
+	reader  *bufio.Reader
+	writer  io.Writer
+	version int
 }
 
 func NewResp(rd io.Reader, wr io.Writer) *Resp {
 	return &Resp{
-		reader: bufio.NewReader(rd),
-		writer: wr,
+		reader:  bufio.NewReader(rd),
+		writer:  wr,
+		version: 2,
 	}
 }
 
+// Buffered returns the number of bytes read from the underlying reader
+// that have not been consumed yet.
+func (r *Resp) Buffered() int {
+	return r.reader.Buffered()
+}
+
+// Peek waits until input is available without consuming it, returning the
+// error that ended the wait otherwise.
+func (r *Resp) Peek() error {
+	_, err := r.reader.Peek(1)
+	return err
+}
+
+// SetProtocol selects the RESP version (2 or 3) used when writing replies.
+func (r *Resp) SetProtocol(version int) {
+	r.version = version
+}
+
+func (r *Resp) Protocol() int {
+	return r.version
+}
+
 // Reader methods
 func (r *Resp) readLine() (line []byte, n int, err error) {
 	for {
@@ -74,6 +127,33 @@ func (r *Resp) Read() (Value, error) {
 		return r.readArray()
 	case BULK:
 		return r.readBulk()
+	case STRING:
+		return r.readSimple("string")
+	case ERROR:
+		return r.readSimple("error")
+	case INTEGER:
+		return r.readNumber()
+	case NULL:
+		_, _, err := r.readLine()
+		return Value{Type: "null"}, err
+	case BOOLEAN:
+		return r.readBoolean()
+	case DOUBLE:
+		return r.readDouble()
+	case BIGNUMBER:
+		return r.readSimple("bignum")
+	case BLOBERROR:
+		return r.readBlobError()
+	case VERBATIM:
+		return r.readVerbatim()
+	case MAP:
+		return r.readAggregate("map", 2)
+	case SET:
+		return r.readAggregate("set", 1)
+	case PUSH:
+		return r.readAggregate("push", 1)
+	case ATTRIBUTE:
+		return r.readAttribute()
 	default:
 		return Value{}, fmt.Errorf("unknown type: %v", string(_type))
 	}
@@ -85,8 +165,11 @@ func (r *Resp) readArray() (Value, error) {
 	if err != nil {
 		return v, err
 	}
+	if len < 0 {
+		return Value{Type: "null"}, nil
+	}
 
-	v.Array = make([]Value, 0, len)
+	v.Array = make([]Value, 0, min(len, maxPrealloc))
 	for i := 0; i < len; i++ {
 		val, err := r.Read()
 		if err != nil {
@@ -104,6 +187,12 @@ func (r *Resp) readBulk() (Value, error) {
 	if err != nil {
 		return v, err
 	}
+	if len < 0 {
+		return Value{Type: "null"}, nil
+	}
+	if len > MaxBulkLen {
+		return v, &ProtocolError{Msg: "invalid bulk length"}
+	}
 
 	bulk := make([]byte, len)
 	_, err = io.ReadFull(r.reader, bulk)
@@ -113,13 +202,21 @@ func (r *Resp) readBulk() (Value, error) {
 	v.Bulk = string(bulk)
 
 	// Read the trailing CRLF
-	r.readLine()
+	if _, _, err := r.readLine(); err != nil {
+		return v, err
+	}
 
 	return v, nil
 }
 
 // Writer methods
 func (r *Resp) Write(v Value) error {
+	if len(v.Attrs) > 0 && r.version >= 3 {
+		if err := r.writeAggregate(ATTRIBUTE, len(v.Attrs)/2, v.Attrs); err != nil {
+			return err
+		}
+	}
+
 	switch v.Type {
 	case "array":
 		return r.writeArray(v.Array)
@@ -131,6 +228,24 @@ func (r *Resp) Write(v Value) error {
 		return r.writeError(v.Str)
 	case "integer":
 		return r.writeInteger(v.Num)
+	case "null":
+		return r.writeNull()
+	case "nullarray":
+		return r.writeNullArray()
+	case "boolean":
+		return r.writeBoolean(v.Bool)
+	case "double":
+		return r.writeDouble(v.Double)
+	case "bignum":
+		return r.writeBigNumber(v.Str)
+	case "verbatim":
+		return r.writeVerbatim(v.Str, v.Bulk)
+	case "map":
+		return r.writeMap(v.Array)
+	case "set":
+		return r.writeCollection(SET, v.Array)
+	case "push":
+		return r.writeCollection(PUSH, v.Array)
 	default:
 		return fmt.Errorf("unknown type: %v", v.Type)
 	}
@@ -168,4 +283,113 @@ func (r *Resp) writeError(s string) error {
 func (r *Resp) writeInteger(i int) error {
 	_, err := fmt.Fprintf(r.writer, ":%d\r\n", i)
 	return err
-}
\ No newline at end of file
+}
+
+func (r *Resp) writeNull() error {
+	if r.version >= 3 {
+		_, err := fmt.Fprint(r.writer, "_\r\n")
+		return err
+	}
+	_, err := fmt.Fprint(r.writer, "$-1\r\n")
+	return err
+}
+
+func (r *Resp) writeNullArray() error {
+	if r.version >= 3 {
+		_, err := fmt.Fprint(r.writer, "_\r\n")
+		return err
+	}
+	_, err := fmt.Fprint(r.writer, "*-1\r\n")
+	return err
+}
+
+// ReadBulkPayload reads a "$<len>\r\n" header followed by len raw bytes with
+// no trailing CRLF, the framing of the snapshot sent on a replication sync.
+// Newlines sent as keepalives before the header are skipped.
+func (r *Resp) ReadBulkPayload() ([]byte, error) {
+	for {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == '\n' {
+			continue
+		}
+		if b != BULK {
+			return nil, fmt.Errorf("unexpected byte %q, expected a bulk payload", b)
+		}
+		break
+	}
+	n, _, err := r.readInteger()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("invalid bulk payload length %d", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r.reader, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// EncodeCommand encodes a command as a RESP array of bulk strings, the form
+// used for requests, the append-only file and the replication stream.
+func EncodeCommand(args []string) []byte {
+	buf := make([]byte, 0, 16*len(args)+16)
+	buf = append(buf, ARRAY)
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, BULK)
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// Reply constructors
+func NewString(s string) Value {
+	return Value{Type: "string", Str: s}
+}
+
+func NewError(s string) Value {
+	return Value{Type: "error", Str: s}
+}
+
+func NewInteger(n int) Value {
+	return Value{Type: "integer", Num: n}
+}
+
+func NewBulk(s string) Value {
+	return Value{Type: "bulk", Bulk: s}
+}
+
+// NewNull returns the null bulk reply used for missing keys and fields.
+func NewNull() Value {
+	return Value{Type: "null"}
+}
+
+// NewNullArray returns the null array reply, e.g. for an aborted transaction.
+func NewNullArray() Value {
+	return Value{Type: "nullarray"}
+}
+
+func NewArray(values []Value) Value {
+	if values == nil {
+		values = []Value{}
+	}
+	return Value{Type: "array", Array: values}
+}
+
+// NewBulkArray wraps each string as a bulk reply inside an array.
+func NewBulkArray(items []string) Value {
+	values := make([]Value, len(items))
+	for i, item := range items {
+		values[i] = NewBulk(item)
+	}
+	return NewArray(values)
+}
@@ -0,0 +1,265 @@
+package redisprotocol
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// RESP3 reader methods
+
+func (r *Resp) readSimple(typ string) (Value, error) {
+	line, _, err := r.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{Type: typ, Str: string(line)}, nil
+}
+
+func (r *Resp) readNumber() (Value, error) {
+	num, _, err := r.readInteger()
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{Type: "integer", Num: num}, nil
+}
+
+func (r *Resp) readBoolean() (Value, error) {
+	line, _, err := r.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+	switch string(line) {
+	case "t":
+		return Value{Type: "boolean", Bool: true}, nil
+	case "f":
+		return Value{Type: "boolean", Bool: false}, nil
+	default:
+		return Value{}, fmt.Errorf("invalid boolean: %q", line)
+	}
+}
+
+func (r *Resp) readDouble() (Value, error) {
+	line, _, err := r.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+	d, err := ParseDouble(string(line))
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{Type: "double", Double: d}, nil
+}
+
+// readBlob reads a length-prefixed payload and its trailing CRLF.
+func (r *Resp) readBlob() ([]byte, error) {
+	length, _, err := r.readInteger()
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 || length > MaxBulkLen {
+		return nil, fmt.Errorf("invalid blob length: %d", length)
+	}
+	blob := make([]byte, length+2)
+	if _, err := io.ReadFull(r.reader, blob); err != nil {
+		return nil, err
+	}
+	return blob[:length], nil
+}
+
+func (r *Resp) readBlobError() (Value, error) {
+	blob, err := r.readBlob()
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{Type: "error", Str: string(blob)}, nil
+}
+
+func (r *Resp) readVerbatim() (Value, error) {
+	blob, err := r.readBlob()
+	if err != nil {
+		return Value{}, err
+	}
+	if len(blob) < 4 || blob[3] != ':' {
+		return Value{}, fmt.Errorf("invalid verbatim string")
+	}
+	return Value{Type: "verbatim", Str: string(blob[:3]), Bulk: string(blob[4:])}, nil
+}
+
+// readAggregate reads count*per elements into a value of the given type. A
+// negative count is read as null, like for arrays.
+func (r *Resp) readAggregate(typ string, per int) (Value, error) {
+	count, _, err := r.readInteger()
+	if err != nil {
+		return Value{}, err
+	}
+	if count < 0 {
+		return Value{Type: "null"}, nil
+	}
+	if count > math.MaxInt/per {
+		return Value{}, fmt.Errorf("invalid %s length: %d", typ, count)
+	}
+	n := count * per
+	v := Value{Type: typ, Array: make([]Value, 0, min(n, maxPrealloc))}
+	for i := 0; i < n; i++ {
+		val, err := r.Read()
+		if err != nil {
+			return v, err
+		}
+		v.Array = append(v.Array, val)
+	}
+	return v, nil
+}
+
+// readAttribute reads an attribute map and attaches it to the reply that follows.
+func (r *Resp) readAttribute() (Value, error) {
+	attrs, err := r.readAggregate("attribute", 2)
+	if err != nil {
+		return Value{}, err
+	}
+	v, err := r.Read()
+	if err != nil {
+		return v, err
+	}
+	v.Attrs = attrs.Array
+	return v, nil
+}
+
+// RESP3 writer methods. Replies are downgraded to their RESP2 equivalents
+// when the connection has not negotiated protocol 3.
+
+func (r *Resp) writeBoolean(b bool) error {
+	if r.version < 3 {
+		if b {
+			return r.writeInteger(1)
+		}
+		return r.writeInteger(0)
+	}
+	flag := "f"
+	if b {
+		flag = "t"
+	}
+	_, err := fmt.Fprintf(r.writer, "#%s\r\n", flag)
+	return err
+}
+
+func (r *Resp) writeDouble(d float64) error {
+	if r.version < 3 {
+		return r.writeBulk(FormatDouble(d))
+	}
+	_, err := fmt.Fprintf(r.writer, ",%s\r\n", FormatDouble(d))
+	return err
+}
+
+func (r *Resp) writeBigNumber(n string) error {
+	if r.version < 3 {
+		return r.writeBulk(n)
+	}
+	_, err := fmt.Fprintf(r.writer, "(%s\r\n", n)
+	return err
+}
+
+func (r *Resp) writeVerbatim(format, text string) error {
+	if r.version < 3 {
+		return r.writeBulk(text)
+	}
+	_, err := fmt.Fprintf(r.writer, "=%d\r\n%s:%s\r\n", len(text)+4, format, text)
+	return err
+}
+
+func (r *Resp) writeMap(pairs []Value) error {
+	if r.version < 3 {
+		return r.writeArray(pairs)
+	}
+	return r.writeAggregate(MAP, len(pairs)/2, pairs)
+}
+
+func (r *Resp) writeCollection(prefix byte, items []Value) error {
+	if r.version < 3 {
+		return r.writeArray(items)
+	}
+	return r.writeAggregate(prefix, len(items), items)
+}
+
+func (r *Resp) writeAggregate(prefix byte, count int, items []Value) error {
+	_, err := fmt.Fprintf(r.writer, "%c%d\r\n", prefix, count)
+	if err != nil {
+		return err
+	}
+	for _, v := range items {
+		if err := r.Write(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FormatDouble renders a float the way Redis does in replies.
+func FormatDouble(d float64) string {
+	switch {
+	case math.IsInf(d, 1):
+		return "inf"
+	case math.IsInf(d, -1):
+		return "-inf"
+	case math.IsNaN(d):
+		return "nan"
+	}
+	return strconv.FormatFloat(d, 'g', -1, 64)
+}
+
+// ParseDouble parses a float in the forms accepted by Redis, including inf and -inf.
+func ParseDouble(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// RESP3 reply constructors
+
+func NewBoolean(b bool) Value {
+	return Value{Type: "boolean", Bool: b}
+}
+
+func NewDouble(d float64) Value {
+	return Value{Type: "double", Double: d}
+}
+
+func NewBigNumber(digits string) Value {
+	return Value{Type: "bignum", Str: digits}
+}
+
+// NewVerbatim returns a verbatim string; format is a three letter hint such as "txt".
+func NewVerbatim(format, text string) Value {
+	return Value{Type: "verbatim", Str: format, Bulk: text}
+}
+
+// NewMap builds a map reply from alternating key/value pairs.
+func NewMap(pairs []Value) Value {
+	if pairs == nil {
+		pairs = []Value{}
+	}
+	return Value{Type: "map", Array: pairs}
+}
+
+func NewSet(members []Value) Value {
+	if members == nil {
+		members = []Value{}
+	}
+	return Value{Type: "set", Array: members}
+}
+
+// NewPush builds an out-of-band push frame, such as a pub/sub message.
+func NewPush(items []Value) Value {
+	if items == nil {
+		items = []Value{}
+	}
+	return Value{Type: "push", Array: items}
+}
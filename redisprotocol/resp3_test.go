@@ -0,0 +1,106 @@
+package redisprotocol
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var negInf = math.Inf(-1)
+
+func TestReadResp3(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Value
+	}{
+		{"_\r\n", Value{Type: "null"}},
+		{"#t\r\n", Value{Type: "boolean", Bool: true}},
+		{"#f\r\n", Value{Type: "boolean"}},
+		{",1.5\r\n", Value{Type: "double", Double: 1.5}},
+		{",-inf\r\n", NewDouble(negInf)},
+		{"(12345678901234567890\r\n", Value{Type: "bignum", Str: "12345678901234567890"}},
+		{"!3\r\nERR\r\n", Value{Type: "error", Str: "ERR"}},
+		{"=7\r\ntxt:abc\r\n", Value{Type: "verbatim", Str: "txt", Bulk: "abc"}},
+		{"%1\r\n+k\r\n:1\r\n", Value{Type: "map", Array: []Value{NewString("k"), NewInteger(1)}}},
+		{"~2\r\n+a\r\n+b\r\n", Value{Type: "set", Array: []Value{NewString("a"), NewString("b")}}},
+		{">1\r\n+m\r\n", Value{Type: "push", Array: []Value{NewString("m")}}},
+		{"%0\r\n", Value{Type: "map", Array: []Value{}}},
+		{"|1\r\n+ttl\r\n:3\r\n+OK\r\n", Value{Type: "string", Str: "OK", Attrs: []Value{NewString("ttl"), NewInteger(3)}}},
+	}
+	for _, tt := range tests {
+		got, err := NewResp(strings.NewReader(tt.in), nil).Read()
+		if err != nil {
+			t.Errorf("Read(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Read(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestReadAggregateLength checks that the declared length of a map, set,
+// push or attribute cannot crash the reader or make it allocate without
+// limit, whether it comes as a reply or inside a command.
+func TestReadAggregateLength(t *testing.T) {
+	for _, prefix := range []string{"%", "~", ">", "|"} {
+		for _, count := range []string{"-1", "-9223372036854775808", "9223372036854775807", "4611686018427387904", "100000000000"} {
+			in := prefix + count + "\r\n"
+			v, err := NewResp(strings.NewReader(in+"+OK\r\n"), nil).Read()
+			if strings.HasPrefix(count, "-") {
+				if err != nil {
+					t.Errorf("Read(%q) failed: %v", in, err)
+				} else if prefix != "|" && v.Type != "null" {
+					t.Errorf("Read(%q) = %+v, want null", in, v)
+				}
+			} else if err == nil {
+				t.Errorf("Read(%q) succeeded, want an error", in)
+			}
+
+			if _, err := NewResp(strings.NewReader("*1\r\n"+in), nil).ReadCommand(); err == nil && !strings.HasPrefix(count, "-") {
+				t.Errorf("ReadCommand(%q) succeeded, want an error", "*1\r\n"+in)
+			}
+		}
+	}
+}
+
+func TestReadBlobLength(t *testing.T) {
+	for _, in := range []string{"!-1\r\n", "=-5\r\n", "!9223372036854775807\r\n", "=100000000000\r\n"} {
+		if _, err := NewResp(strings.NewReader(in), nil).Read(); err == nil {
+			t.Errorf("Read(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestWriteResp3(t *testing.T) {
+	tests := []struct {
+		v     Value
+		resp2 string
+		resp3 string
+	}{
+		{NewNull(), "$-1\r\n", "_\r\n"},
+		{NewNullArray(), "*-1\r\n", "_\r\n"},
+		{NewBoolean(true), ":1\r\n", "#t\r\n"},
+		{NewDouble(2.5), "$3\r\n2.5\r\n", ",2.5\r\n"},
+		{NewDouble(negInf), "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{NewBigNumber("123"), "$3\r\n123\r\n", "(123\r\n"},
+		{NewVerbatim("txt", "hi"), "$2\r\nhi\r\n", "=6\r\ntxt:hi\r\n"},
+		{NewMap([]Value{NewBulk("k"), NewInteger(1)}), "*2\r\n$1\r\nk\r\n:1\r\n", "%1\r\n$1\r\nk\r\n:1\r\n"},
+		{NewMap(nil), "*0\r\n", "%0\r\n"},
+		{NewPush([]Value{NewBulk("m")}), "*1\r\n$1\r\nm\r\n", ">1\r\n$1\r\nm\r\n"},
+	}
+	for _, tt := range tests {
+		for version, want := range map[int]string{2: tt.resp2, 3: tt.resp3} {
+			var buf bytes.Buffer
+			r := NewResp(nil, &buf)
+			r.SetProtocol(version)
+			if err := r.Write(tt.v); err != nil {
+				t.Errorf("RESP%d Write(%+v) failed: %v", version, tt.v, err)
+			} else if buf.String() != want {
+				t.Errorf("RESP%d Write(%+v) = %q, want %q", version, tt.v, buf.String(), want)
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package redisprotocol
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Value
+	}{
+		{"+OK\r\n", NewString("OK")},
+		{"-ERR boom\r\n", NewError("ERR boom")},
+		{":42\r\n", NewInteger(42)},
+		{":-7\r\n", NewInteger(-7)},
+		{"$5\r\nhello\r\n", NewBulk("hello")},
+		{"$0\r\n\r\n", NewBulk("")},
+		{"$4\r\na\r\nb\r\n", NewBulk("a\r\nb")},
+		{"$-1\r\n", NewNull()},
+		{"*-1\r\n", NewNull()},
+		{"*0\r\n", NewArray(nil)},
+		{"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", NewBulkArray([]string{"GET", "k"})},
+		{"*2\r\n:1\r\n*1\r\n+x\r\n", NewArray([]Value{NewInteger(1), NewArray([]Value{NewString("x")})})},
+	}
+	for _, tt := range tests {
+		got, err := NewResp(strings.NewReader(tt.in), nil).Read()
+		if err != nil {
+			t.Errorf("Read(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Read(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"?1\r\n",
+		":abc\r\n",
+		"$abc\r\n",
+		"$5\r\nhel",
+		"$3\r\nabc",
+		"*2\r\n$1\r\na\r\n",
+		"*x\r\n",
+		"+no terminator",
+	} {
+		if _, err := NewResp(strings.NewReader(in), nil).Read(); err == nil {
+			t.Errorf("Read(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestReadBulkLength(t *testing.T) {
+	for _, in := range []string{"$536870913\r\n", "$9223372036854775807\r\n", "*1\r\n$100000000000\r\n"} {
+		_, err := NewResp(strings.NewReader(in), nil).Read()
+		var protoErr *ProtocolError
+		if !errors.As(err, &protoErr) {
+			t.Errorf("Read(%q) error = %v, want a protocol error", in, err)
+		}
+	}
+	// A huge array length is read lazily and fails on the missing elements.
+	if _, err := NewResp(strings.NewReader("*9223372036854775807\r\n:1\r\n"), nil).Read(); err == nil {
+		t.Errorf("Read of a truncated huge array succeeded, want an error")
+	}
+}
+
+func TestReadPipelined(t *testing.T) {
+	r := NewResp(strings.NewReader("+a\r\n:1\r\n$1\r\nb\r\n"), nil)
+	for _, want := range []Value{NewString("a"), NewInteger(1), NewBulk("b")} {
+		got, err := r.Read()
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Read = %+v, want %+v", got, want)
+		}
+	}
+	if r.Buffered() != 0 {
+		t.Errorf("Buffered() = %d after reading everything, want 0", r.Buffered())
+	}
+}
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		v    Value
+		want string
+	}{
+		{NewString("OK"), "+OK\r\n"},
+		{NewError("ERR boom"), "-ERR boom\r\n"},
+		{NewInteger(-3), ":-3\r\n"},
+		{NewBulk(""), "$0\r\n\r\n"},
+		{NewBulk("a\r\nb"), "$4\r\na\r\nb\r\n"},
+		{NewNull(), "$-1\r\n"},
+		{NewNullArray(), "*-1\r\n"},
+		{NewArray(nil), "*0\r\n"},
+		{NewBulkArray([]string{"a", "bc"}), "*2\r\n$1\r\na\r\n$2\r\nbc\r\n"},
+		{NewArray([]Value{NewInteger(1), NewNull()}), "*2\r\n:1\r\n$-1\r\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := NewResp(nil, &buf).Write(tt.v); err != nil {
+			t.Errorf("Write(%+v) failed: %v", tt.v, err)
+		} else if buf.String() != tt.want {
+			t.Errorf("Write(%+v) = %q, want %q", tt.v, buf.String(), tt.want)
+		}
+	}
+
+	if err := NewResp(nil, &bytes.Buffer{}).Write(Value{Type: "bogus"}); err == nil {
+		t.Errorf("Write of an unknown type succeeded, want an error")
+	}
+}
+
+// TestRoundTrip checks that what Write produces reads back as the same value.
+func TestRoundTrip(t *testing.T) {
+	for _, v := range []Value{
+		NewString("PONG"),
+		NewError("WRONGTYPE Operation against a key holding the wrong kind of value"),
+		NewInteger(1 << 40),
+		NewBulk("binary\x00\xff"),
+		NewArray([]Value{NewBulk("x"), NewArray([]Value{NewInteger(2)}), NewString("y")}),
+	} {
+		var buf bytes.Buffer
+		if err := NewResp(nil, &buf).Write(v); err != nil {
+			t.Fatalf("Write(%+v) failed: %v", v, err)
+		}
+		got, err := NewResp(&buf, nil).Read()
+		if err != nil {
+			t.Errorf("Read of %+v failed: %v", v, err)
+		} else if !reflect.DeepEqual(got, v) {
+			t.Errorf("Read of %+v = %+v", v, got)
+		}
+	}
+}
+
+func TestEncodeCommand(t *testing.T) {
+	argv := []string{"SET", "key", "", "a b\r\n"}
+	encoded := EncodeCommand(argv)
+	if want := "*4\r\n$3\r\nSET\r\n$3\r\nkey\r\n$0\r\n\r\n$5\r\na b\r\n\r\n"; string(encoded) != want {
+		t.Fatalf("EncodeCommand(%q) = %q, want %q", argv, encoded, want)
+	}
+	got, err := NewResp(bytes.NewReader(encoded), nil).ReadCommand()
+	if err != nil {
+		t.Fatalf("ReadCommand failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, NewBulkArray(argv)) {
+		t.Errorf("ReadCommand = %+v, want %q", got, argv)
+	}
+}
+
+func TestReadBulkPayload(t *testing.T) {
+	r := NewResp(strings.NewReader("\n\n$5\r\nREDIS+OK\r\n"), nil)
+	payload, err := r.ReadBulkPayload()
+	if err != nil {
+		t.Fatalf("ReadBulkPayload failed: %v", err)
+	}
+	if string(payload) != "REDIS" {
+		t.Errorf("ReadBulkPayload = %q, want %q", payload, "REDIS")
+	}
+	// There is no CRLF after the payload: the stream continues right away.
+	if v, err := r.Read(); err != nil || !reflect.DeepEqual(v, NewString("OK")) {
+		t.Errorf("Read after the payload = %+v, %v", v, err)
+	}
+
+	for _, in := range []string{"+FULLRESYNC\r\n", "$-1\r\n", "$10\r\nshort"} {
+		if _, err := NewResp(strings.NewReader(in), nil).ReadBulkPayload(); err == nil {
+			t.Errorf("ReadBulkPayload(%q) succeeded, want an error", in)
+		}
+	}
+}
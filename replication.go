@@ -0,0 +1,785 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+const (
+	// replTimeout is how long either side of a replication link may stay
+	// silent before the link is considered dead.
+	replTimeout = 60 * time.Second
+	// replPingPeriod is how often a master pings its replicas through the
+	// replication stream, so they can tell an idle master from a dead one.
+	replPingPeriod = 10 * time.Second
+	// replicaOutputLimit is how much data may be queued for a replica that
+	// does not keep up before it is disconnected.
+	replicaOutputLimit = 256 << 20
+	// replAckPeriod is how often a replica reports its offset to its master.
+	replAckPeriod = time.Second
+)
+
+// replicationState is the replication side of the server. A master feeds
+// every write to its replicas and keeps the most recent part of that stream
+// in a backlog so that replicas can resume after a short disconnection. A
+// replica additionally has a link to its master. Everything is guarded by
+// the kvstore lock.
+type replicationState struct {
+	// replID and offset identify the position in the replication stream:
+	// offset is the number of bytes of the stream produced so far.
+	replID string
+	offset int64
+	// replID2 is the ID of the previous master of a promoted replica, valid
+	// up to secondOffset, so that its former fellow replicas can resume
+	// from the new master without a full resync.
+	replID2      string
+	secondOffset int64
+	backlog      replBacklog
+	replicas     map[*replica]struct{}
+	lastPing     time.Time
+	// acks is closed and replaced whenever a replica acknowledges an
+	// offset, waking up the clients blocked in WAIT.
+	acks chan struct{}
+
+	// link is the connection to our master, nil on a master.
+	link *masterLink
+	// applyingMaster is set while commands received from the master run, so
+	// that they are proxied to our replicas verbatim instead of propagated.
+	applyingMaster bool
+	// aofRewriteScheduled asks for an append-only file rewrite once the one
+	// in progress is done, after the dataset was replaced by a full sync.
+	aofRewriteScheduled bool
+}
+
+func newReplicationState() replicationState {
+	return replicationState{
+		replID:   newReplID(),
+		backlog:  replBacklog{size: int(config.ReplBacklogSize)},
+		replicas: make(map[*replica]struct{}),
+		acks:     make(chan struct{}),
+	}
+}
+
+// newReplID returns a random 40 character replication ID.
+func newReplID() string {
+	buf := make([]byte, 20)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// replBacklog keeps the last size bytes of the replication stream.
+type replBacklog struct {
+	size int
+	data []byte
+	// end is the stream offset of the last byte in data.
+	end int64
+}
+
+func (b *replBacklog) append(p []byte) {
+	b.data = append(b.data, p...)
+	b.end += int64(len(p))
+	// Trim only once the buffer is twice the limit so appends stay cheap.
+	if len(b.data) > 2*b.size {
+		b.data = append([]byte(nil), b.data[len(b.data)-b.size:]...)
+	}
+}
+
+// firstOffset returns the stream offset of the first byte held.
+func (b *replBacklog) firstOffset() int64 {
+	return b.end - int64(len(b.data)) + 1
+}
+
+// since returns the stream from offset, the first byte a replica still
+// needs, to the end, or false if part of it has already been discarded.
+func (b *replBacklog) since(offset int64) ([]byte, bool) {
+	if offset < b.firstOffset() || offset > b.end+1 {
+		return nil, false
+	}
+	return b.data[offset-b.firstOffset():], true
+}
+
+// reset empties the backlog, which continues the stream at offset.
+func (b *replBacklog) reset(offset int64) {
+	b.data = nil
+	b.end = offset
+}
+
+// replica is a connected replica. Data sent to it is queued and written by
+// its own goroutine, so a slow replica never blocks the master.
+type replica struct {
+	client *Client
+	// online is set once the initial synchronization was sent.
+	online bool
+	// ackOffset is the last offset of the stream the replica reported as
+	// processed, at ackTime.
+	ackOffset int64
+	ackTime   time.Time
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	closed  bool
+}
+
+func newReplica(c *Client) *replica {
+	r := &replica{client: c}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// send queues data for the replica, dropping the replica if too much is
+// already waiting.
+func (r *replica) send(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if len(r.pending)+len(p) > replicaOutputLimit {
+		fmt.Println("Replica output buffer limit reached, disconnecting", r.client.conn.RemoteAddr())
+		r.closed = true
+		r.client.conn.Close()
+		r.cond.Broadcast()
+		return
+	}
+	r.pending = append(r.pending, p...)
+	r.cond.Signal()
+}
+
+func (r *replica) writeLoop() {
+	for {
+		r.mu.Lock()
+		for len(r.pending) == 0 && !r.closed {
+			r.cond.Wait()
+		}
+		if r.closed {
+			r.mu.Unlock()
+			return
+		}
+		data := r.pending
+		r.pending = nil
+		r.mu.Unlock()
+
+		if err := r.client.WriteRaw(data); err != nil {
+			r.close()
+			r.client.conn.Close()
+			return
+		}
+	}
+}
+
+func (r *replica) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.cond.Broadcast()
+}
+
+// addr returns the address the replica listens on, as reported in INFO.
+func (r *replica) addr() (ip, port string) {
+	ip, _, _ = net.SplitHostPort(r.client.conn.RemoteAddr().String())
+	return ip, r.client.replListeningPort
+}
+
+// isReplica reports whether the server replicates a master.
+// The caller must hold the store lock.
+func (s *Server) isReplica() bool {
+	return s.repl.link != nil
+}
+
+// feedReplicationStream appends data to the replication stream.
+// The caller must hold the store write lock.
+func (s *Server) feedReplicationStream(data []byte) {
+	s.repl.offset += int64(len(data))
+	s.repl.backlog.append(data)
+	for r := range s.repl.replicas {
+		r.send(data)
+	}
+}
+
+// propagateExpire replicates the deletion of an expired key. Replicas never
+// expire keys themselves, they wait for the master's DEL.
+func (s *Server) propagateExpire(key string) {
+	s.propagateCommand([]string{"DEL", key})
+}
+
+// replicationCron pings the replicas periodically.
+func (s *Server) replicationCron() {
+	s.kvstore.Lock()
+	defer s.kvstore.Unlock()
+	if len(s.repl.replicas) > 0 && time.Since(s.repl.lastPing) >= replPingPeriod {
+		s.repl.lastPing = time.Now()
+		s.feedReplicationStream(redisprotocol.EncodeCommand([]string{"PING"}))
+	}
+	if s.repl.aofRewriteScheduled && s.aof != nil && s.startAOFRewrite() == nil {
+		s.repl.aofRewriteScheduled = false
+	}
+	if s.isReplica() {
+		s.repl.link.ackIfDue(s.repl.offset)
+	}
+}
+
+// handleReplconf implements REPLCONF, which replicas use to describe
+// themselves during the handshake and to acknowledge the stream.
+func (s *Server) handleReplconf(args []string, c *Client) redisprotocol.Value {
+	if len(args)%2 != 0 {
+		return redisprotocol.NewError("ERR syntax error")
+	}
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToLower(args[i]) {
+		case "ack":
+			// Acknowledgements are never replied to.
+			if offset, err := strconv.ParseInt(args[i+1], 10, 64); err == nil {
+				s.replicaAck(c, offset)
+			}
+			return noReply
+		case "getack":
+			// Only meaningful in the stream a master sends to its replicas.
+			return noReply
+		case "listening-port":
+			if _, err := strconv.Atoi(args[i+1]); err != nil {
+				return redisprotocol.NewError("ERR value is not an integer or out of range")
+			}
+			c.replListeningPort = args[i+1]
+		case "capa", "ip-address":
+		default:
+			return redisprotocol.NewError("ERR Unrecognized REPLCONF option: " + args[i])
+		}
+	}
+	return redisprotocol.NewString("OK")
+}
+
+// handlePsync implements PSYNC replicationid offset, and SYNC (no args)
+// which always does a full resynchronization. The connection becomes a
+// replication link: from now on it receives the replication stream.
+func (s *Server) handlePsync(args []string, c *Client) redisprotocol.Value {
+	legacy := args == nil
+	replID, offset := "?", int64(-1)
+	if !legacy {
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return redisprotocol.NewError("ERR value is not an integer or out of range")
+		}
+		replID, offset = args[0], n
+	}
+
+	s.kvstore.Lock()
+	if c.replica != nil {
+		s.kvstore.Unlock()
+		return noReply
+	}
+	if s.isReplica() && !s.repl.link.isUp() {
+		s.kvstore.Unlock()
+		return redisprotocol.NewError("NOMASTERLINK Can't SYNC while not connected with my master")
+	}
+	r := newReplica(c)
+	c.replica = r
+
+	if s.canPartialSync(replID, offset) {
+		// The backlog tail is copied and written without the lock, and the
+		// replica queues the stream that follows it meanwhile, as for a
+		// full resynchronization.
+		tail, _ := s.repl.backlog.since(offset)
+		data := append([]byte("+CONTINUE "+s.repl.replID+"\r\n"), tail...)
+		s.repl.replicas[r] = struct{}{}
+		s.kvstore.Unlock()
+		fmt.Printf("Partial resynchronization with replica %s, sending %d bytes of backlog\n", c.conn.RemoteAddr(), len(tail))
+		c.conn.SetWriteDeadline(time.Now().Add(replTimeout))
+		err := c.WriteRaw(data)
+		c.conn.SetWriteDeadline(time.Time{})
+		if err != nil {
+			c.conn.Close()
+			return noReply
+		}
+		s.kvstore.Lock()
+		r.online = true
+		s.kvstore.Unlock()
+		go r.writeLoop()
+		return noReply
+	}
+
+	// Full resynchronization: the snapshot and the offset are taken at the
+	// same point of the stream, and from then on the replica collects the
+	// stream in its queue while the snapshot is being sent.
+	snap := s.kvstore.snapshot()
+	replID, offset = s.repl.replID, s.repl.offset
+	s.repl.replicas[r] = struct{}{}
+	s.kvstore.Unlock()
+
+	fmt.Printf("Full resynchronization with replica %s\n", c.conn.RemoteAddr())
+	var payload bytes.Buffer
+	err := writeRDB(&payload, snap)
+	s.kvstore.releaseSnapshot()
+	if err != nil {
+		fmt.Println("Error creating the snapshot for the replica:", err)
+		c.conn.Close()
+		return noReply
+	}
+	header := fmt.Sprintf("$%d\r\n", payload.Len())
+	if !legacy {
+		header = fmt.Sprintf("+FULLRESYNC %s %d\r\n", replID, offset) + header
+	}
+	if err := c.WriteRaw(append([]byte(header), payload.Bytes()...)); err != nil {
+		c.conn.Close()
+		return noReply
+	}
+
+	s.kvstore.Lock()
+	r.online = true
+	s.kvstore.Unlock()
+	go r.writeLoop()
+	return noReply
+}
+
+// canPartialSync reports whether a replica at offset of the stream replID
+// can continue from our backlog. The caller must hold the store lock.
+func (s *Server) canPartialSync(replID string, offset int64) bool {
+	if replID != s.repl.replID && (replID != s.repl.replID2 || offset > s.repl.secondOffset+1) {
+		return false
+	}
+	_, ok := s.repl.backlog.since(offset)
+	return ok
+}
+
+// replicaAck records the offset acknowledged by the replica on c.
+func (s *Server) replicaAck(c *Client, offset int64) {
+	s.kvstore.Lock()
+	defer s.kvstore.Unlock()
+	if c.replica == nil {
+		return
+	}
+	if offset > c.replica.ackOffset {
+		c.replica.ackOffset = offset
+	}
+	c.replica.ackTime = time.Now()
+	close(s.repl.acks)
+	s.repl.acks = make(chan struct{})
+}
+
+// ackedReplicas counts the replicas that acknowledged offset.
+// The caller must hold the store lock.
+func (s *Server) ackedReplicas(offset int64) int {
+	n := 0
+	for r := range s.repl.replicas {
+		if r.online && r.ackOffset >= offset {
+			n++
+		}
+	}
+	return n
+}
+
+// handleWait implements WAIT numreplicas timeout. It blocks the calling
+// connection until numreplicas replicas acknowledged all the writes it made
+// so far, or until timeout milliseconds passed (0 waits forever), and
+// replies with the number of replicas that did.
+func (s *Server) handleWait(args []string, c *Client) redisprotocol.Value {
+	if len(args) != 2 {
+		return wrongArgs("WAIT")
+	}
+	numReplicas, err := strconv.Atoi(args[0])
+	if err != nil {
+		return redisprotocol.NewError("ERR value is not an integer or out of range")
+	}
+	timeout, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return redisprotocol.NewError("ERR timeout is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return redisprotocol.NewError("ERR timeout is negative")
+	}
+
+	s.kvstore.Lock()
+	defer s.kvstore.Unlock()
+	if s.isReplica() {
+		return redisprotocol.NewError("ERR WAIT cannot be used with replica instances.")
+	}
+	acked := s.ackedReplicas(c.woff)
+	if acked >= numReplicas {
+		return redisprotocol.NewInteger(acked)
+	}
+	// Ask the replicas for an acknowledgement now rather than waiting for
+	// their periodic one.
+	s.feedReplicationStream(redisprotocol.EncodeCommand([]string{"REPLCONF", "GETACK", "*"}))
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for acked < numReplicas {
+		acks := s.repl.acks
+		s.kvstore.Unlock()
+		select {
+		case <-acks:
+			s.kvstore.Lock()
+		case <-expired:
+			s.kvstore.Lock()
+			return redisprotocol.NewInteger(s.ackedReplicas(c.woff))
+		}
+		acked = s.ackedReplicas(c.woff)
+	}
+	return redisprotocol.NewInteger(acked)
+}
+
+// removeReplica forgets a replica whose connection was closed.
+func (s *Server) removeReplica(c *Client) {
+	s.kvstore.Lock()
+	defer s.kvstore.Unlock()
+	if c.replica == nil {
+		return
+	}
+	c.replica.close()
+	delete(s.repl.replicas, c.replica)
+	fmt.Println("Connection with replica", c.conn.RemoteAddr(), "lost")
+}
+
+// disconnectReplicas drops all replicas, which then resynchronize.
+// The caller must hold the store lock.
+func (s *Server) disconnectReplicas() {
+	for r := range s.repl.replicas {
+		r.close()
+		r.client.conn.Close()
+	}
+}
+
+// handleReplicaof implements REPLICAOF host port and REPLICAOF NO ONE.
+func (s *Server) handleReplicaof(args []string, c *Client) redisprotocol.Value {
+	if len(args) != 2 {
+		return wrongArgs("REPLICAOF")
+	}
+	if s.cluster != nil {
+		return redisprotocol.NewError("ERR REPLICAOF not allowed in cluster mode.")
+	}
+	if strings.EqualFold(args[0], "no") && strings.EqualFold(args[1], "one") {
+		s.kvstore.Lock()
+		defer s.kvstore.Unlock()
+		if s.isReplica() {
+			s.promoteToMaster()
+		}
+		return redisprotocol.NewString("OK")
+	}
+	if _, err := strconv.Atoi(args[1]); err != nil {
+		return redisprotocol.NewError("ERR Invalid master port")
+	}
+
+	s.kvstore.Lock()
+	defer s.kvstore.Unlock()
+	if s.isReplica() && s.repl.link.host == args[0] && s.repl.link.port == args[1] {
+		return redisprotocol.NewString("OK Already connected to specified master")
+	}
+	s.replicate(args[0], args[1])
+	return redisprotocol.NewString("OK")
+}
+
+// replicate starts replicating host:port, replacing any previous master.
+// The caller must hold the store write lock.
+func (s *Server) replicate(host, port string) {
+	if s.repl.link != nil {
+		s.repl.link.stop()
+	}
+	link := newMasterLink(host, port)
+	s.repl.link = link
+	s.kvstore.expireDisabled = true
+	s.replicaReadOnly.Store(config.ReplicaReadOnly)
+	fmt.Printf("Connecting to master %s:%s\n", host, port)
+	go s.runMasterLink(link)
+}
+
+// promoteToMaster stops replicating and starts a new replication history,
+// remembering the old one so the other replicas of our former master can
+// continue from us. The caller must hold the store write lock.
+func (s *Server) promoteToMaster() {
+	s.repl.link.stop()
+	s.repl.link = nil
+	s.kvstore.expireDisabled = false
+	s.replicaReadOnly.Store(false)
+	s.repl.replID2, s.repl.secondOffset = s.repl.replID, s.repl.offset
+	s.repl.replID = newReplID()
+	fmt.Println("Replication stopped, now acting as a master")
+}
+
+// masterLink is a replica's connection to its master.
+type masterLink struct {
+	host, port string
+	done       chan struct{}
+
+	mu        sync.Mutex
+	peer      *peerConn
+	lastAck   time.Time
+	up        bool
+	syncing   bool
+	lastIO    time.Time
+	stopped   bool
+	downSince time.Time
+}
+
+func newMasterLink(host, port string) *masterLink {
+	return &masterLink{host: host, port: port, done: make(chan struct{}), downSince: time.Now()}
+}
+
+func (l *masterLink) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return
+	}
+	l.stopped = true
+	close(l.done)
+	if l.peer != nil {
+		l.peer.Close()
+	}
+}
+
+func (l *masterLink) isStopped() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopped
+}
+
+func (l *masterLink) isUp() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.up
+}
+
+// setPeer records the connection in use so stop can interrupt it.
+func (l *masterLink) setPeer(peer *peerConn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return false
+	}
+	l.peer = peer
+	return true
+}
+
+func (l *masterLink) setState(up, syncing bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.up && !up {
+		l.downSince = time.Now()
+	}
+	l.up, l.syncing = up, syncing
+	l.lastIO = time.Now()
+}
+
+func (l *masterLink) touch() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastIO = time.Now()
+}
+
+// ack reports to the master that the stream was processed up to offset.
+func (l *masterLink) ack(offset int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.up || l.peer == nil {
+		return
+	}
+	l.lastAck = time.Now()
+	l.peer.Send("REPLCONF", "ACK", strconv.FormatInt(offset, 10))
+}
+
+// ackIfDue sends the periodic acknowledgement.
+func (l *masterLink) ackIfDue(offset int64) {
+	l.mu.Lock()
+	due := time.Since(l.lastAck) >= replAckPeriod
+	l.mu.Unlock()
+	if due {
+		l.ack(offset)
+	}
+}
+
+// runMasterLink keeps a replica synchronized with its master, reconnecting
+// after errors until the link is stopped.
+func (s *Server) runMasterLink(link *masterLink) {
+	for {
+		err := s.syncWithMaster(link)
+		link.setState(false, false)
+		if link.isStopped() {
+			return
+		}
+		fmt.Println("Error replicating from master:", err)
+		select {
+		case <-link.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+var errLinkStopped = errors.New("replication link stopped")
+
+// syncWithMaster performs the replication handshake, the initial
+// synchronization and then applies the replication stream until the
+// connection fails.
+func (s *Server) syncWithMaster(link *masterLink) error {
+	peer, err := dialPeer(net.JoinHostPort(link.host, link.port), replTimeout)
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+	if !link.setPeer(peer) {
+		return errLinkStopped
+	}
+
+	peer.SetDeadline(replTimeout)
+	if _, err := peer.Do("PING"); err != nil {
+		return err
+	}
+	if _, err := peer.Do("REPLCONF", "listening-port", config.Port); err != nil {
+		return err
+	}
+	if _, err := peer.Do("REPLCONF", "capa", "psync2"); err != nil {
+		return err
+	}
+
+	// Ask to continue from where our copy of the stream ends. A master that
+	// does not know our replication ID answers with a full resync.
+	s.kvstore.RLock()
+	replID, offset := s.repl.replID, s.repl.offset
+	s.kvstore.RUnlock()
+	link.setState(false, true)
+	reply, err := peer.Do("PSYNC", replID, strconv.FormatInt(offset+1, 10))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(reply.Str)
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		masterOffset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid FULLRESYNC reply %q", reply.Str)
+		}
+		if err := s.fullSyncFromMaster(link, peer, fields[1], masterOffset); err != nil {
+			return err
+		}
+	case len(fields) >= 1 && fields[0] == "CONTINUE":
+		s.kvstore.Lock()
+		if len(fields) == 2 && fields[1] != s.repl.replID {
+			// The master was promoted, its stream continues ours.
+			s.repl.replID2, s.repl.secondOffset = s.repl.replID, s.repl.offset
+			s.repl.replID = fields[1]
+		}
+		s.kvstore.Unlock()
+		fmt.Println("Partial resynchronization with master accepted")
+	default:
+		return fmt.Errorf("unexpected PSYNC reply %q", reply.Str)
+	}
+
+	link.setState(true, false)
+	s.kvstore.RLock()
+	link.ack(s.repl.offset)
+	s.kvstore.RUnlock()
+	return s.streamFromMaster(link, peer)
+}
+
+// fullSyncFromMaster receives the master's snapshot and replaces our
+// dataset with it.
+func (s *Server) fullSyncFromMaster(link *masterLink, peer *peerConn, replID string, offset int64) error {
+	payload, err := peer.resp.ReadBulkPayload()
+	if err != nil {
+		return fmt.Errorf("failed to receive the snapshot: %v", err)
+	}
+	loaded := NewKeyValueStore()
+	if err := readRDB(bytes.NewReader(payload), int64(len(payload)), loaded); err != nil {
+		return fmt.Errorf("failed to load the snapshot: %v", err)
+	}
+
+	s.kvstore.Lock()
+	defer s.kvstore.Unlock()
+	if link.isStopped() {
+		return errLinkStopped
+	}
+	s.kvstore.Keys = loaded.Keys
+	s.kvstore.Expirations = loaded.Expirations
+	s.touchAllWatchedKeys()
+	s.repl.replID, s.repl.offset = replID, offset
+	s.repl.replID2, s.repl.secondOffset = "", 0
+	s.repl.backlog.reset(offset)
+	// Our replicas hold data from before the sync and must start over.
+	s.disconnectReplicas()
+	if s.aof != nil && s.startAOFRewrite() != nil {
+		s.repl.aofRewriteScheduled = true
+	}
+	fmt.Printf("Full resynchronization with master done, %d keys loaded\n", len(loaded.Keys))
+	return nil
+}
+
+// streamFromMaster applies the replication stream. Each command is also
+// proxied verbatim to our own replicas, so the whole chain shares the same
+// stream and offsets.
+func (s *Server) streamFromMaster(link *masterLink, peer *peerConn) error {
+	var multi [][]string
+	inMulti := false
+	for {
+		peer.SetDeadline(replTimeout)
+		value, err := peer.resp.Read()
+		if err != nil {
+			return err
+		}
+		argv, err := commandArgs(value)
+		if err != nil || len(argv) == 0 {
+			return fmt.Errorf("invalid command in the replication stream")
+		}
+		link.touch()
+
+		s.kvstore.Lock()
+		if link.isStopped() {
+			s.kvstore.Unlock()
+			return errLinkStopped
+		}
+		switch name := strings.ToUpper(argv[0]); {
+		case name == "REPLCONF" && len(argv) > 1 && strings.EqualFold(argv[1], "GETACK"):
+			// The reply covers the stream up to, not including, this request.
+			link.ack(s.repl.offset)
+		case name == "MULTI":
+			multi, inMulti = nil, true
+		case name == "EXEC" && inMulti:
+			s.applyFromMaster(multi...)
+			multi, inMulti = nil, false
+		case inMulti:
+			multi = append(multi, argv)
+		default:
+			s.applyFromMaster(argv)
+		}
+		s.feedReplicationStream(redisprotocol.EncodeCommand(argv))
+		// Our own clients blocked on keys the master pushed to, after the
+		// push itself so that our replicas see them in that order.
+		s.serveBlockedClients()
+		s.kvstore.Unlock()
+	}
+}
+
+// applyFromMaster executes commands received from the master, atomically
+// when there are several. The caller must hold the store write lock.
+func (s *Server) applyFromMaster(cmds ...[]string) {
+	s.repl.applyingMaster = true
+	defer func() { s.repl.applyingMaster = false }()
+	if len(cmds) > 1 {
+		s.inExec, s.execPropagated = true, false
+	}
+	for _, argv := range cmds {
+		cmd, ok := s.commands[strings.ToUpper(argv[0])]
+		if !ok || cmd.Flags&cmdWrite == 0 {
+			// PING and other commands without effect on the dataset.
+			continue
+		}
+		s.execute(cmd, argv)
+	}
+	if s.execPropagated {
+		s.propagateCommand([]string{"EXEC"})
+	}
+	s.inExec, s.execPropagated = false, false
+}
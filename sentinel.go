@@ -0,0 +1,896 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+// Sentinel mode watches a master and its standby replicas. Every instance is
+// pinged once a second; an instance without a valid reply for
+// -sentinel-down-after is subjectively down (sdown). When the master is
+// sdown, the sentinel asks the others whether they agree, and once a quorum
+// does the master is objectively down (odown) and a failover starts: the
+// sentinel asks the others to elect it leader for a new epoch and, with the
+// votes of the quorum and of a majority, promotes the replica with the
+// highest replication offset. The remaining instances, the old master
+// included when it comes back, are then told to replicate the new master.
+//
+// Like in Redis, sentinels discover each other and spread the current master
+// address by publishing hello messages on the __sentinel__:hello channel of
+// every monitored instance.
+
+const (
+	sentinelHelloChannel = "__sentinel__:hello"
+	sentinelPingPeriod   = time.Second
+	sentinelHelloPeriod  = 2 * time.Second
+	sentinelAskPeriod    = time.Second
+	sentinelCronPeriod   = 100 * time.Millisecond
+	// sentinelInfoValidity is how recent the INFO of a replica must be for
+	// it to be promoted.
+	sentinelInfoValidity = 5 * time.Second
+	// sentinelReconfPeriod spaces the REPLICAOF commands sent to an instance
+	// that still follows the wrong master.
+	sentinelReconfPeriod = 10 * time.Second
+)
+
+// Sentinel is the state of a sentinel process. mu guards every field of the
+// sentinel and of the instances it monitors.
+type Sentinel struct {
+	mu           sync.Mutex
+	runID        string
+	currentEpoch int64
+	master       *sentinelMaster
+	startTime    time.Time
+}
+
+// sentinelMaster is a monitored master together with its replicas and the
+// other sentinels watching it.
+type sentinelMaster struct {
+	name   string
+	quorum int
+	// addr is the current master, which changes on failover.
+	addr        string
+	configEpoch int64
+	instances   map[string]*sentinelInstance
+	sentinels   map[string]*sentinelPeer
+
+	sdown bool
+	odown bool
+	// asking is set while the other sentinels are asked about the master.
+	asking  bool
+	lastAsk time.Time
+
+	// leader is the sentinel this one voted for in leaderEpoch.
+	leader      string
+	leaderEpoch int64
+
+	failingOver bool
+	// failoverStart is the last failover attempt, or vote for another
+	// sentinel; no new attempt is made for -sentinel-failover-timeout.
+	failoverStart time.Time
+	// failoverAt delays the attempt by a random amount, so that sentinels
+	// rarely compete for the same epoch.
+	failoverAt time.Time
+}
+
+// sentinelInstance is the master or one of the replicas, as last seen.
+type sentinelInstance struct {
+	addr   string
+	lastOK time.Time
+
+	// Reported by INFO replication.
+	lastInfo   time.Time
+	role       string
+	masterAddr string
+	offset     int64
+	// roleChanged is when the role or master reported last changed.
+	roleChanged time.Time
+
+	lastReconf time.Time
+}
+
+// sentinelPeer is another sentinel, known from its hello messages.
+type sentinelPeer struct {
+	runID     string
+	addr      string
+	lastHello time.Time
+}
+
+func newSentinel() *Sentinel {
+	monitor := config.SentinelMonitor
+	m := &sentinelMaster{
+		name:      monitor.Name,
+		quorum:    monitor.Quorum,
+		addr:      net.JoinHostPort(monitor.Host, monitor.Port),
+		instances: make(map[string]*sentinelInstance),
+		sentinels: make(map[string]*sentinelPeer),
+	}
+	return &Sentinel{runID: newReplID(), master: m, startTime: time.Now()}
+}
+
+func (s *Sentinel) downAfter() time.Duration {
+	return time.Duration(config.SentinelDownAfter) * time.Millisecond
+}
+
+func (s *Sentinel) failoverTimeout() time.Duration {
+	return time.Duration(config.SentinelFailoverTimeout) * time.Millisecond
+}
+
+// linkTimeout bounds every network operation with a monitored instance or
+// another sentinel.
+func (s *Sentinel) linkTimeout() time.Duration {
+	return min(s.downAfter(), time.Second)
+}
+
+func (s *Sentinel) isDown(inst *sentinelInstance) bool {
+	return time.Since(inst.lastOK) > s.downAfter()
+}
+
+// addInstance starts monitoring addr. The caller must hold s.mu.
+func (s *Sentinel) addInstance(addr string) *sentinelInstance {
+	m := s.master
+	if inst, ok := m.instances[addr]; ok {
+		return inst
+	}
+	// The grace period starts now rather than at the first reply.
+	inst := &sentinelInstance{addr: addr, lastOK: time.Now()}
+	m.instances[addr] = inst
+	go s.monitor(inst)
+	go s.listenHello(inst)
+	return inst
+}
+
+// runSentinel runs the process in sentinel mode until it is killed.
+func runSentinel() {
+	s := newSentinel()
+	s.mu.Lock()
+	s.addInstance(s.master.addr)
+	for _, addr := range config.SentinelReplicas {
+		s.addInstance(addr)
+	}
+	s.mu.Unlock()
+	go s.cron()
+
+	listener, err := net.Listen("tcp", ":"+config.Port)
+	if err != nil {
+		fmt.Println("Error starting sentinel:", err)
+		return
+	}
+	defer listener.Close()
+
+	fmt.Printf("Sentinel ID %s monitoring master %s %s quorum %d\n", s.runID, s.master.name, s.master.addr, s.master.quorum)
+	fmt.Printf("Sentinel listening on :%s\n", config.Port)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("Error accepting connection:", err)
+			continue
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+// event logs a state change in the Redis sentinel format, e.g.
+// "+sdown master mymaster 127.0.0.1 6379".
+func (s *Sentinel) event(kind, role, addr string) {
+	host, port, _ := net.SplitHostPort(addr)
+	fmt.Printf("%s %s %s %s %s\n", kind, role, s.master.name, host, port)
+}
+
+// monitor pings an instance and reads its replication state every second.
+// It also publishes the hello message on it and, when it follows the wrong
+// master, reconfigures it.
+func (s *Sentinel) monitor(inst *sentinelInstance) {
+	var peer *peerConn
+	ticker := time.NewTicker(sentinelPingPeriod)
+	defer ticker.Stop()
+	for n := 0; ; n++ {
+		if peer == nil {
+			peer, _ = dialPeer(inst.addr, s.linkTimeout())
+		}
+		if peer != nil {
+			hello := n%int(sentinelHelloPeriod/sentinelPingPeriod) == 0
+			if err := s.checkInstance(inst, peer, hello); err != nil {
+				peer.Close()
+				peer = nil
+			}
+		}
+		<-ticker.C
+	}
+}
+
+func (s *Sentinel) checkInstance(inst *sentinelInstance, peer *peerConn, hello bool) error {
+	peer.SetDeadline(s.linkTimeout())
+	reply, err := peer.Do("PING")
+	if err != nil && reply.Type != "error" {
+		return err
+	}
+	// An instance that is loading or lost its own master still works.
+	if reply.Str == "PONG" || strings.HasPrefix(reply.Str, "LOADING") || strings.HasPrefix(reply.Str, "MASTERDOWN") {
+		s.mu.Lock()
+		inst.lastOK = time.Now()
+		s.mu.Unlock()
+	}
+
+	info, err := peer.Do("INFO", "replication")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.applyInfo(inst, info.Bulk)
+	reconf := s.needsReconf(inst)
+	if reconf {
+		inst.lastReconf = time.Now()
+	}
+	master := s.master.addr
+	msg := s.helloMessage()
+	s.mu.Unlock()
+
+	if hello {
+		if _, err := peer.Do("PUBLISH", sentinelHelloChannel, msg); err != nil {
+			return err
+		}
+	}
+	if reconf {
+		host, port, _ := net.SplitHostPort(master)
+		if _, err := peer.Do("REPLICAOF", host, port); err != nil {
+			fmt.Printf("Error reconfiguring %s: %v\n", inst.addr, err)
+			return nil
+		}
+		s.event("+slave-reconf-sent", "slave", inst.addr)
+	}
+	return nil
+}
+
+// applyInfo records the replication state reported by INFO replication.
+// The caller must hold s.mu.
+func (s *Sentinel) applyInfo(inst *sentinelInstance, info string) {
+	var role, host, port string
+	inst.offset = 0
+	for _, line := range strings.Split(info, "\r\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch name {
+		case "role":
+			role = value
+		case "master_host":
+			host = value
+		case "master_port":
+			port = value
+		case "slave_repl_offset":
+			inst.offset, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	masterAddr := ""
+	if role == "slave" {
+		masterAddr = net.JoinHostPort(host, port)
+	}
+	if role != inst.role || masterAddr != inst.masterAddr {
+		inst.role, inst.masterAddr = role, masterAddr
+		inst.roleChanged = time.Now()
+	}
+	inst.lastInfo = time.Now()
+}
+
+// needsReconf reports whether inst should be told to replicate the current
+// master. That is only done while the master is up and confirms its role,
+// and once inst reported the same state for a few hello periods: a replica
+// that just became master may have been promoted by a failover whose hello
+// message has not arrived yet. The caller must hold s.mu.
+func (s *Sentinel) needsReconf(inst *sentinelInstance) bool {
+	m := s.master
+	if inst.addr == m.addr || m.failingOver || time.Since(inst.lastReconf) < sentinelReconfPeriod {
+		return false
+	}
+	if time.Since(inst.roleChanged) < 4*sentinelHelloPeriod {
+		return false
+	}
+	master := m.instances[m.addr]
+	if s.isDown(master) || master.role != "master" {
+		return false
+	}
+	return inst.role == "master" || (inst.role == "slave" && inst.masterAddr != m.addr)
+}
+
+// helloMessage describes this sentinel and its view of the master:
+// "ip,port,runid,current-epoch,name,master-ip,master-port,config-epoch".
+// The caller must hold s.mu.
+func (s *Sentinel) helloMessage() string {
+	m := s.master
+	host, port, _ := net.SplitHostPort(m.addr)
+	return fmt.Sprintf("%s,%s,%s,%d,%s,%s,%s,%d", config.SentinelAnnounceIP, config.Port, s.runID,
+		s.currentEpoch, m.name, host, port, m.configEpoch)
+}
+
+// listenHello subscribes to the hello channel of an instance.
+func (s *Sentinel) listenHello(inst *sentinelInstance) {
+	for {
+		if err := s.readHellos(inst.addr); err != nil {
+			time.Sleep(sentinelPingPeriod)
+		}
+	}
+}
+
+func (s *Sentinel) readHellos(addr string) error {
+	peer, err := dialPeer(addr, s.linkTimeout())
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+	if err := peer.Send("SUBSCRIBE", sentinelHelloChannel); err != nil {
+		return err
+	}
+	for {
+		// This sentinel publishes its own hello at least this often.
+		peer.SetDeadline(3 * sentinelHelloPeriod)
+		msg, err := peer.resp.Read()
+		if err != nil {
+			return err
+		}
+		if len(msg.Array) == 3 && msg.Array[0].Bulk == "message" {
+			s.processHello(msg.Array[2].Bulk)
+		}
+	}
+}
+
+// processHello learns about another sentinel and, when it saw a more recent
+// failover, about the new master.
+func (s *Sentinel) processHello(msg string) {
+	parts := strings.Split(msg, ",")
+	if len(parts) != 8 {
+		return
+	}
+	epoch, err1 := strconv.ParseInt(parts[3], 10, 64)
+	configEpoch, err2 := strconv.ParseInt(parts[7], 10, 64)
+	if err1 != nil || err2 != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.master
+	runID := parts[2]
+	if runID == s.runID || parts[4] != m.name {
+		return
+	}
+	peer, ok := m.sentinels[runID]
+	if !ok {
+		peer = &sentinelPeer{runID: runID}
+		m.sentinels[runID] = peer
+		s.event("+sentinel", "sentinel", net.JoinHostPort(parts[0], parts[1]))
+	}
+	peer.addr = net.JoinHostPort(parts[0], parts[1])
+	peer.lastHello = time.Now()
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+	}
+	if configEpoch > m.configEpoch {
+		s.switchMaster(net.JoinHostPort(parts[5], parts[6]), configEpoch)
+	}
+}
+
+// switchMaster makes addr the master. The caller must hold s.mu.
+func (s *Sentinel) switchMaster(addr string, configEpoch int64) {
+	m := s.master
+	old := m.addr
+	s.addInstance(addr)
+	m.addr, m.configEpoch = addr, configEpoch
+	m.sdown, m.odown = false, false
+	m.failoverAt = time.Time{}
+	oldHost, oldPort, _ := net.SplitHostPort(old)
+	host, port, _ := net.SplitHostPort(addr)
+	fmt.Printf("+switch-master %s %s %s %s %s\n", m.name, oldHost, oldPort, host, port)
+}
+
+// cron follows the state of the master and starts failovers.
+func (s *Sentinel) cron() {
+	ticker := time.NewTicker(sentinelCronPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		s.checkMaster()
+		s.mu.Unlock()
+	}
+}
+
+// checkMaster is called by cron with s.mu held.
+func (s *Sentinel) checkMaster() {
+	m := s.master
+	down := s.isDown(m.instances[m.addr])
+	if down != m.sdown {
+		m.sdown = down
+		if down {
+			s.event("+sdown", "master", m.addr)
+		} else {
+			s.event("-sdown", "master", m.addr)
+		}
+	}
+	if !down {
+		if m.odown {
+			m.odown = false
+			s.event("-odown", "master", m.addr)
+		}
+		m.failoverAt = time.Time{}
+		return
+	}
+	if m.failingOver {
+		return
+	}
+	if !m.asking && time.Since(m.lastAsk) >= sentinelAskPeriod {
+		m.asking = true
+		m.lastAsk = time.Now()
+		go s.askMasterState(m.addr)
+	}
+	if !m.odown || time.Since(m.failoverStart) < s.failoverTimeout() {
+		return
+	}
+	if m.failoverAt.IsZero() {
+		m.failoverAt = time.Now().Add(time.Duration(rand.Int63n(int64(time.Second))))
+	}
+	if time.Now().After(m.failoverAt) {
+		m.failoverAt = time.Time{}
+		m.failingOver = true
+		go s.failover(false)
+	}
+}
+
+// isDownReply is the answer of a sentinel to is-master-down-by-addr.
+type isDownReply struct {
+	down        bool
+	leader      string
+	leaderEpoch int64
+}
+
+// askSentinels sends is-master-down-by-addr to every other sentinel.
+// runID is "*" to only ask about the master, or this sentinel's ID to also
+// ask for its vote in epoch. Sentinels that do not answer are left out.
+func (s *Sentinel) askSentinels(addr string, epoch int64, runID string) []isDownReply {
+	s.mu.Lock()
+	var peers []string
+	for _, peer := range s.master.sentinels {
+		peers = append(peers, peer.addr)
+	}
+	s.mu.Unlock()
+
+	host, port, _ := net.SplitHostPort(addr)
+	args := []string{"SENTINEL", "is-master-down-by-addr", host, port, strconv.FormatInt(epoch, 10), runID}
+	replies := make([]*isDownReply, len(peers))
+	var wg sync.WaitGroup
+	for i, peerAddr := range peers {
+		wg.Add(1)
+		go func(i int, peerAddr string) {
+			defer wg.Done()
+			replies[i] = s.askSentinel(peerAddr, args)
+		}(i, peerAddr)
+	}
+	wg.Wait()
+
+	var answered []isDownReply
+	for _, reply := range replies {
+		if reply != nil {
+			answered = append(answered, *reply)
+		}
+	}
+	return answered
+}
+
+func (s *Sentinel) askSentinel(addr string, args []string) *isDownReply {
+	peer, err := dialPeer(addr, s.linkTimeout())
+	if err != nil {
+		return nil
+	}
+	defer peer.Close()
+	peer.SetDeadline(s.linkTimeout())
+	reply, err := peer.Do(args...)
+	if err != nil || len(reply.Array) != 3 {
+		return nil
+	}
+	return &isDownReply{
+		down:        reply.Array[0].Num == 1,
+		leader:      reply.Array[1].Bulk,
+		leaderEpoch: int64(reply.Array[2].Num),
+	}
+}
+
+// askMasterState updates whether the master is objectively down.
+func (s *Sentinel) askMasterState(addr string) {
+	s.mu.Lock()
+	epoch := s.currentEpoch
+	s.mu.Unlock()
+	replies := s.askSentinels(addr, epoch, "*")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.master
+	m.asking = false
+	if m.addr != addr || !m.sdown {
+		return
+	}
+	agreed := 1
+	for _, reply := range replies {
+		if reply.down {
+			agreed++
+		}
+	}
+	odown := agreed >= m.quorum
+	if odown && !m.odown {
+		fmt.Printf("+odown master %s %s #quorum %d/%d\n", m.name, strings.Replace(addr, ":", " ", 1), agreed, m.quorum)
+	} else if !odown && m.odown {
+		s.event("-odown", "master", addr)
+	}
+	m.odown = odown
+}
+
+// vote records the vote of this sentinel for runID in epoch, unless it
+// already voted in that epoch, and returns the sentinel it voted for.
+// The caller must hold s.mu.
+func (s *Sentinel) vote(runID string, epoch int64) (string, int64) {
+	m := s.master
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+	}
+	if m.leaderEpoch < epoch && s.currentEpoch <= epoch {
+		m.leader, m.leaderEpoch = runID, epoch
+		fmt.Printf("+vote-for-leader %s %d\n", runID, epoch)
+		if runID != s.runID {
+			// Give the leader time to fail over before trying ourselves.
+			m.failoverStart = time.Now()
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+// failover tries to replace the master with one of its replicas. Unless
+// forced, it first needs to be elected leader for a new epoch.
+func (s *Sentinel) failover(force bool) {
+	s.mu.Lock()
+	m := s.master
+	s.currentEpoch++
+	epoch := s.currentEpoch
+	m.failoverStart = time.Now()
+	s.vote(s.runID, epoch)
+	old := m.addr
+	needed := max(m.quorum, (len(m.sentinels)+1)/2+1)
+	s.mu.Unlock()
+	fmt.Printf("+new-epoch %d\n", epoch)
+	s.event("+try-failover", "master", old)
+
+	defer func() {
+		s.mu.Lock()
+		m.failingOver = false
+		s.mu.Unlock()
+	}()
+
+	if !force {
+		votes := 1
+		for _, reply := range s.askSentinels(old, epoch, s.runID) {
+			if reply.leader == s.runID && reply.leaderEpoch == epoch {
+				votes++
+			}
+		}
+		if votes < needed {
+			fmt.Printf("-failover-abort-not-elected master %s %s votes %d/%d\n", m.name, strings.Replace(old, ":", " ", 1), votes, needed)
+			return
+		}
+		fmt.Printf("+elected-leader %s epoch %d votes %d/%d\n", m.name, epoch, votes, needed)
+	}
+
+	s.mu.Lock()
+	candidate := s.selectReplica()
+	s.mu.Unlock()
+	if candidate == "" {
+		s.event("-failover-abort-no-good-slave", "master", old)
+		return
+	}
+	s.event("+selected-slave", "slave", candidate)
+	peer, err := dialPeer(candidate, s.linkTimeout())
+	if err == nil {
+		peer.SetDeadline(s.linkTimeout())
+		_, err = peer.Do("REPLICAOF", "NO", "ONE")
+		peer.Close()
+	}
+	if err != nil {
+		fmt.Printf("-failover-abort-slave-timeout %s: %v\n", candidate, err)
+		return
+	}
+	s.event("+promoted-slave", "slave", candidate)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.addr != old || m.configEpoch >= epoch {
+		// Another sentinel completed a failover meanwhile.
+		return
+	}
+	promoted := m.instances[candidate]
+	promoted.role, promoted.masterAddr = "master", ""
+	promoted.roleChanged = time.Now()
+	s.switchMaster(candidate, epoch)
+	// The monitors reconfigure the other instances from now on.
+}
+
+// selectReplica picks the replica to promote: one that is up, reported its
+// state recently and has the highest replication offset. The caller must
+// hold s.mu.
+func (s *Sentinel) selectReplica() string {
+	m := s.master
+	var best *sentinelInstance
+	for _, inst := range m.instances {
+		if inst.addr == m.addr || s.isDown(inst) || inst.role != "slave" || time.Since(inst.lastInfo) > sentinelInfoValidity {
+			continue
+		}
+		if best == nil || inst.offset > best.offset || (inst.offset == best.offset && inst.addr < best.addr) {
+			best = inst
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.addr
+}
+
+func (s *Sentinel) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	client := NewClient(conn)
+	for {
+		command, err := readCommand(client.resp)
+		if err != nil {
+			if err != io.EOF {
+				var protoErr *redisprotocol.ProtocolError
+				if errors.As(err, &protoErr) {
+					client.Write(redisprotocol.NewError("ERR " + protoErr.Error()))
+				}
+			}
+			return
+		}
+		if err := client.Write(s.processCommand(command)); err != nil {
+			return
+		}
+	}
+}
+
+// processCommand serves the few commands a sentinel understands.
+func (s *Sentinel) processCommand(command []string) redisprotocol.Value {
+	if len(command) == 0 {
+		return redisprotocol.NewError("ERR empty command")
+	}
+	cmd := strings.ToUpper(command[0])
+	args := command[1:]
+	switch cmd {
+	case "PING":
+		if len(args) > 1 {
+			return wrongArgs("PING")
+		}
+		if len(args) == 1 {
+			return redisprotocol.NewBulk(args[0])
+		}
+		return redisprotocol.NewString("PONG")
+	case "INFO":
+		return s.handleInfo()
+	case "SENTINEL":
+		return s.handleSentinel(args)
+	}
+	return redisprotocol.NewError("ERR unknown command '" + cmd + "'")
+}
+
+func (s *Sentinel) handleSentinel(args []string) redisprotocol.Value {
+	if len(args) == 0 {
+		return wrongArgs("SENTINEL")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.master
+	sub := strings.ToUpper(args[0])
+	switch sub {
+	case "MYID":
+		return redisprotocol.NewBulk(s.runID)
+	case "MASTERS":
+		return redisprotocol.NewArray([]redisprotocol.Value{s.masterFields()})
+	case "IS-MASTER-DOWN-BY-ADDR":
+		if len(args) != 5 {
+			return wrongArgs("SENTINEL IS-MASTER-DOWN-BY-ADDR")
+		}
+		epoch, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return redisprotocol.NewError("ERR value is not an integer or out of range")
+		}
+		return s.isMasterDownByAddr(net.JoinHostPort(args[1], args[2]), epoch, args[4])
+	}
+
+	if len(args) != 2 {
+		return wrongArgs("SENTINEL " + sub)
+	}
+	if args[1] != m.name {
+		switch sub {
+		case "GET-MASTER-ADDR-BY-NAME":
+			return redisprotocol.NewNullArray()
+		case "MASTER", "REPLICAS", "SLAVES", "SENTINELS", "CKQUORUM", "FAILOVER":
+			return redisprotocol.NewError("ERR No such master with that name")
+		}
+	}
+	switch sub {
+	case "GET-MASTER-ADDR-BY-NAME":
+		host, port, _ := net.SplitHostPort(m.addr)
+		return redisprotocol.NewBulkArray([]string{host, port})
+	case "MASTER":
+		return s.masterFields()
+	case "REPLICAS", "SLAVES":
+		var addrs []string
+		for addr := range m.instances {
+			if addr != m.addr {
+				addrs = append(addrs, addr)
+			}
+		}
+		sort.Strings(addrs)
+		replicas := make([]redisprotocol.Value, len(addrs))
+		for i, addr := range addrs {
+			replicas[i] = s.replicaFields(m.instances[addr])
+		}
+		return redisprotocol.NewArray(replicas)
+	case "SENTINELS":
+		return s.sentinelsReply()
+	case "CKQUORUM":
+		// Sentinels count as usable while their hello messages arrive.
+		usable := 1
+		for _, peer := range m.sentinels {
+			if time.Since(peer.lastHello) < 5*sentinelHelloPeriod {
+				usable++
+			}
+		}
+		if usable < m.quorum {
+			return redisprotocol.NewError(fmt.Sprintf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the specified quorum for this master", usable))
+		}
+		if usable < (len(m.sentinels)+1)/2+1 {
+			return redisprotocol.NewError(fmt.Sprintf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the majority and authorize a failover", usable))
+		}
+		return redisprotocol.NewString(fmt.Sprintf("OK %d usable Sentinels. Quorum and failover authorization can be reached", usable))
+	case "FAILOVER":
+		if m.failingOver {
+			return redisprotocol.NewError("INPROG Failover already in progress")
+		}
+		if s.selectReplica() == "" {
+			return redisprotocol.NewError("NOGOODSLAVE No suitable replica to promote")
+		}
+		m.failingOver = true
+		go s.failover(true)
+		return redisprotocol.NewString("OK")
+	}
+	return redisprotocol.NewError("ERR unknown subcommand '" + args[0] + "'. Try SENTINEL HELP.")
+}
+
+// isMasterDownByAddr answers whether this sentinel sees the master at addr
+// as down and, when runID is not "*", gives its vote for the epoch.
+// The caller must hold s.mu.
+func (s *Sentinel) isMasterDownByAddr(addr string, epoch int64, runID string) redisprotocol.Value {
+	m := s.master
+	down := 0
+	leader, leaderEpoch := "*", int64(0)
+	if addr == m.addr {
+		down = boolToInt(m.sdown)
+		if runID != "*" {
+			leader, leaderEpoch = s.vote(runID, epoch)
+		}
+	}
+	return redisprotocol.NewArray([]redisprotocol.Value{
+		redisprotocol.NewInteger(down),
+		redisprotocol.NewBulk(leader),
+		redisprotocol.NewInteger(int(leaderEpoch)),
+	})
+}
+
+// instanceFlags describes the state of an instance the way SENTINEL
+// MASTER and REPLICAS do. The caller must hold s.mu.
+func (s *Sentinel) instanceFlags(inst *sentinelInstance) string {
+	m := s.master
+	flags := "slave"
+	if inst.addr == m.addr {
+		flags = "master"
+	}
+	if s.isDown(inst) {
+		flags += ",s_down"
+	}
+	if inst.addr == m.addr {
+		if m.odown {
+			flags += ",o_down"
+		}
+		if m.failingOver {
+			flags += ",failover_in_progress"
+		}
+	}
+	return flags
+}
+
+func (s *Sentinel) masterFields() redisprotocol.Value {
+	m := s.master
+	inst := m.instances[m.addr]
+	host, port, _ := net.SplitHostPort(m.addr)
+	return redisprotocol.NewBulkArray([]string{
+		"name", m.name,
+		"ip", host,
+		"port", port,
+		"flags", s.instanceFlags(inst),
+		"last-ok-ping-reply", strconv.FormatInt(time.Since(inst.lastOK).Milliseconds(), 10),
+		"role-reported", inst.role,
+		"config-epoch", strconv.FormatInt(m.configEpoch, 10),
+		"num-slaves", strconv.Itoa(len(m.instances) - 1),
+		"num-other-sentinels", strconv.Itoa(len(m.sentinels)),
+		"quorum", strconv.Itoa(m.quorum),
+		"down-after-milliseconds", strconv.Itoa(config.SentinelDownAfter),
+		"failover-timeout", strconv.Itoa(config.SentinelFailoverTimeout),
+	})
+}
+
+func (s *Sentinel) replicaFields(inst *sentinelInstance) redisprotocol.Value {
+	host, port, _ := net.SplitHostPort(inst.addr)
+	masterHost, masterPort, _ := net.SplitHostPort(inst.masterAddr)
+	return redisprotocol.NewBulkArray([]string{
+		"name", inst.addr,
+		"ip", host,
+		"port", port,
+		"flags", s.instanceFlags(inst),
+		"last-ok-ping-reply", strconv.FormatInt(time.Since(inst.lastOK).Milliseconds(), 10),
+		"role-reported", inst.role,
+		"master-host", masterHost,
+		"master-port", masterPort,
+		"slave-repl-offset", strconv.FormatInt(inst.offset, 10),
+	})
+}
+
+func (s *Sentinel) sentinelsReply() redisprotocol.Value {
+	m := s.master
+	var ids []string
+	for id := range m.sentinels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	peers := make([]redisprotocol.Value, len(ids))
+	for i, id := range ids {
+		peer := m.sentinels[id]
+		host, port, _ := net.SplitHostPort(peer.addr)
+		peers[i] = redisprotocol.NewBulkArray([]string{
+			"name", peer.addr,
+			"ip", host,
+			"port", port,
+			"runid", peer.runID,
+			"flags", "sentinel",
+			"last-hello-message", strconv.FormatInt(time.Since(peer.lastHello).Milliseconds(), 10),
+		})
+	}
+	return redisprotocol.NewArray(peers)
+}
+
+func (s *Sentinel) handleInfo() redisprotocol.Value {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.master
+	status := "ok"
+	if m.odown {
+		status = "odown"
+	} else if m.sdown {
+		status = "sdown"
+	}
+	info := "# Server\r\n"
+	info += fmt.Sprintf("redis_version:%s\r\n", serverVersion)
+	info += "redis_mode:sentinel\r\n"
+	info += fmt.Sprintf("process_id:%d\r\n", os.Getpid())
+	info += fmt.Sprintf("run_id:%s\r\n", s.runID)
+	info += fmt.Sprintf("tcp_port:%s\r\n", config.Port)
+	info += fmt.Sprintf("uptime_in_seconds:%d\r\n", int64(time.Since(s.startTime).Seconds()))
+	info += "\r\n# Sentinel\r\n"
+	info += "sentinel_masters:1\r\n"
+	info += fmt.Sprintf("sentinel_current_epoch:%d\r\n", s.currentEpoch)
+	info += fmt.Sprintf("master0:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d\r\n",
+		m.name, status, m.addr, len(m.instances)-1, len(m.sentinels)+1)
+	return redisprotocol.NewVerbatim("txt", info)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+// multiControlCommands are executed immediately even inside MULTI.
+var multiControlCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+}
+
+func (s *Server) handleMulti(args []string, c *Client) redisprotocol.Value {
+	if len(args) != 0 {
+		return wrongArgs("MULTI")
+	}
+	if c.inMulti {
+		return redisprotocol.NewError("ERR MULTI calls can not be nested")
+	}
+	c.inMulti = true
+	return redisprotocol.NewString("OK")
+}
+
+// queueCommand adds a command to the client's transaction. Commands that
+// cannot be queued mark the transaction so that EXEC discards it.
+func (s *Server) queueCommand(cmd string, argv []string, c *Client) redisprotocol.Value {
+	if _, known := s.commands[cmd]; !known && cmd != "UNWATCH" {
+		c.multiError = true
+		if connCommands[cmd] {
+			return redisprotocol.NewError("ERR Command not allowed inside a transaction")
+		}
+		return redisprotocol.NewError("ERR unknown command '" + cmd + "'")
+	}
+	c.multiQueue = append(c.multiQueue, argv)
+	return redisprotocol.NewString("QUEUED")
+}
+
+// handleExec runs the queued commands atomically under the store write lock.
+// It replies with a null array if a watched key changed since WATCH.
+func (s *Server) handleExec(args []string, c *Client) redisprotocol.Value {
+	if len(args) != 0 {
+		return wrongArgs("EXEC")
+	}
+	if !c.inMulti {
+		return redisprotocol.NewError("ERR EXEC without MULTI")
+	}
+	queue, failed := c.multiQueue, c.multiError
+	c.resetMulti()
+
+	s.kvstore.Lock()
+	defer s.kvstore.Unlock()
+	defer s.unwatchKeys(c)
+
+	if failed {
+		return redisprotocol.NewError("EXECABORT Transaction discarded because of previous errors.")
+	}
+	if s.watchedKeysChanged(c) {
+		return redisprotocol.NewNullArray()
+	}
+
+	s.inExec, s.execPropagated = true, false
+	replies := make([]redisprotocol.Value, 0, len(queue))
+	for _, argv := range queue {
+		name := strings.ToUpper(argv[0])
+		if name == "UNWATCH" {
+			// Keys are unwatched once EXEC completes anyway.
+			replies = append(replies, redisprotocol.NewString("OK"))
+			continue
+		}
+		replies = append(replies, s.execute(s.commands[name], argv))
+	}
+	if s.execPropagated {
+		s.propagateCommand([]string{"EXEC"})
+	}
+	s.inExec, s.execPropagated = false, false
+	// Clients blocked on keys the transaction pushed to are served once it
+	// completed, never in the middle of it.
+	s.serveBlockedClients()
+	c.woff = s.repl.offset
+	return redisprotocol.NewArray(replies)
+}
+
+func (s *Server) handleDiscard(args []string, c *Client) redisprotocol.Value {
+	if len(args) != 0 {
+		return wrongArgs("DISCARD")
+	}
+	if !c.inMulti {
+		return redisprotocol.NewError("ERR DISCARD without MULTI")
+	}
+	c.resetMulti()
+	s.unwatchAllKeys(c)
+	return redisprotocol.NewString("OK")
+}
+
+func (c *Client) resetMulti() {
+	c.inMulti = false
+	c.multiQueue = nil
+	c.multiError = false
+	c.multiSlot = -1
+}
+
+// handleWatch marks keys for optimistic locking: EXEC aborts if any of
+// them is modified by another command before it runs.
+func (s *Server) handleWatch(args []string, c *Client) redisprotocol.Value {
+	if len(args) < 1 {
+		return wrongArgs("WATCH")
+	}
+	if c.inMulti {
+		return redisprotocol.NewError("ERR WATCH inside MULTI is not allowed")
+	}
+	s.kvstore.Lock()
+	defer s.kvstore.Unlock()
+
+	if c.watched == nil {
+		c.watched = make(map[string]bool)
+	}
+	for _, key := range args {
+		if _, ok := c.watched[key]; ok {
+			continue
+		}
+		c.watched[key] = s.kvstore.lookup(key) != nil
+		clients, ok := s.watchedKeys[key]
+		if !ok {
+			clients = make(map[*Client]struct{})
+			s.watchedKeys[key] = clients
+		}
+		clients[c] = struct{}{}
+	}
+	return redisprotocol.NewString("OK")
+}
+
+func (s *Server) handleUnwatch(args []string, c *Client) redisprotocol.Value {
+	if len(args) != 0 {
+		return wrongArgs("UNWATCH")
+	}
+	s.unwatchAllKeys(c)
+	return redisprotocol.NewString("OK")
+}
+
+// unwatchAllKeys drops every key watched by c.
+func (s *Server) unwatchAllKeys(c *Client) {
+	s.kvstore.Lock()
+	defer s.kvstore.Unlock()
+	s.unwatchKeys(c)
+}
+
+// unwatchKeys is unwatchAllKeys for callers already holding the store lock.
+func (s *Server) unwatchKeys(c *Client) {
+	for key := range c.watched {
+		if clients, ok := s.watchedKeys[key]; ok {
+			delete(clients, c)
+			if len(clients) == 0 {
+				delete(s.watchedKeys, key)
+			}
+		}
+	}
+	c.watched = nil
+	c.dirtyCAS = false
+}
+
+// touchWatchedKey flags every client watching key so its next EXEC fails.
+func (s *Server) touchWatchedKey(key string) {
+	for c := range s.watchedKeys[key] {
+		c.dirtyCAS = true
+	}
+}
+
+func (s *Server) touchAllWatchedKeys() {
+	for key := range s.watchedKeys {
+		s.touchWatchedKey(key)
+	}
+}
+
+// watchedKeysChanged reports whether a key watched by c was modified, or
+// expired, since it was watched.
+func (s *Server) watchedKeysChanged(c *Client) bool {
+	if c.dirtyCAS {
+		return true
+	}
+	for key, existed := range c.watched {
+		if existed && s.kvstore.lookup(key) == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Puneet-Pal-Singh/go-redis/redisprotocol"
+)
+
+// newTestClient returns a client whose connection is one end of a pipe,
+// for running commands through processCommand.
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return NewClient(conn)
+}
+
+// checkReply runs argv for c and compares the reply with want.
+func checkReply(t *testing.T, s *Server, c *Client, want redisprotocol.Value, argv ...string) {
+	t.Helper()
+	if got := s.processCommand(argv, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("%q = %+v, want %+v", argv, got, want)
+	}
+}
+
+var (
+	replyOK     = redisprotocol.NewString("OK")
+	replyQueued = redisprotocol.NewString("QUEUED")
+)
+
+func TestExec(t *testing.T) {
+	s := NewServer()
+	c := newTestClient(t)
+	checkReply(t, s, c, replyOK, "MULTI")
+	checkReply(t, s, c, replyQueued, "SET", "k", "v")
+	checkReply(t, s, c, replyQueued, "INCR", "k")
+	checkReply(t, s, c, replyQueued, "GET", "k")
+	checkReply(t, s, c, redisprotocol.NewArray([]redisprotocol.Value{
+		replyOK,
+		redisprotocol.NewError("ERR value is not an integer or out of range"),
+		redisprotocol.NewBulk("v"),
+	}), "EXEC")
+	checkReply(t, s, c, redisprotocol.NewError("ERR EXEC without MULTI"), "EXEC")
+}
+
+func TestExecAbort(t *testing.T) {
+	s := NewServer()
+	c := newTestClient(t)
+	checkReply(t, s, c, replyOK, "MULTI")
+	checkReply(t, s, c, replyQueued, "SET", "k", "v")
+	checkReply(t, s, c, redisprotocol.NewError("ERR unknown command 'NOPE'"), "NOPE")
+	checkReply(t, s, c, redisprotocol.NewError("EXECABORT Transaction discarded because of previous errors."), "EXEC")
+	checkReply(t, s, c, redisprotocol.NewNull(), "GET", "k")
+
+	checkReply(t, s, c, replyOK, "MULTI")
+	checkReply(t, s, c, replyQueued, "SET", "k", "v")
+	checkReply(t, s, c, replyOK, "DISCARD")
+	checkReply(t, s, c, redisprotocol.NewNull(), "GET", "k")
+}
+
+// TestWatch checks which commands of another client make EXEC fail for a
+// client watching k, h and missing. Writes that leave the keys as they
+// were must not.
+func TestWatch(t *testing.T) {
+	tests := []struct {
+		argv    []string
+		aborted bool
+	}{
+		{[]string{"SET", "k", "x"}, true},
+		{[]string{"SET", "k", "v"}, true},
+		{[]string{"DEL", "k"}, true},
+		{[]string{"EXPIRE", "k", "100"}, true},
+		{[]string{"HSET", "h", "g", "1"}, true},
+		{[]string{"SET", "missing", "1"}, true},
+		{[]string{"FLUSHALL"}, true},
+		{[]string{"SET", "other", "1"}, false},
+		{[]string{"GET", "k"}, false},
+		{[]string{"SETNX", "k", "x"}, false},
+		{[]string{"SET", "k", "x", "NX"}, false},
+		{[]string{"SET", "missing", "x", "XX"}, false},
+		{[]string{"DEL", "missing"}, false},
+		{[]string{"EXPIRE", "missing", "100"}, false},
+		{[]string{"PERSIST", "k"}, false},
+		{[]string{"HSETNX", "h", "f", "x"}, false},
+		{[]string{"HDEL", "h", "nope"}, false},
+		{[]string{"LPOP", "missing"}, false},
+		{[]string{"GETDEL", "missing"}, false},
+	}
+	for _, tt := range tests {
+		s := NewServer()
+		a, b := newTestClient(t), newTestClient(t)
+		checkReply(t, s, b, replyOK, "SET", "k", "v")
+		checkReply(t, s, b, redisprotocol.NewInteger(1), "HSET", "h", "f", "v")
+
+		checkReply(t, s, a, replyOK, "WATCH", "k", "h", "missing")
+		s.processCommand(tt.argv, b)
+		checkReply(t, s, a, replyOK, "MULTI")
+		checkReply(t, s, a, replyQueued, "PING")
+		want := redisprotocol.NewArray([]redisprotocol.Value{redisprotocol.NewString("PONG")})
+		if tt.aborted {
+			want = redisprotocol.NewNullArray()
+		}
+		if got := s.processCommand([]string{"EXEC"}, a); !reflect.DeepEqual(got, want) {
+			t.Errorf("EXEC after %q = %+v, want %+v", tt.argv, got, want)
+		}
+	}
+}
+
+func TestWatchExpired(t *testing.T) {
+	s := NewServer()
+	c := newTestClient(t)
+	checkReply(t, s, c, replyOK, "SET", "k", "v", "PX", "20")
+	checkReply(t, s, c, replyOK, "WATCH", "k")
+	time.Sleep(30 * time.Millisecond)
+	checkReply(t, s, c, replyOK, "MULTI")
+	checkReply(t, s, c, replyQueued, "PING")
+	checkReply(t, s, c, redisprotocol.NewNullArray(), "EXEC")
+
+	// Once EXEC ran, the keys are no longer watched.
+	checkReply(t, s, c, replyOK, "SET", "k", "v")
+	checkReply(t, s, c, replyOK, "MULTI")
+	checkReply(t, s, c, replyQueued, "PING")
+	checkReply(t, s, c, redisprotocol.NewArray([]redisprotocol.Value{redisprotocol.NewString("PONG")}), "EXEC")
+}